@@ -0,0 +1,77 @@
+package main
+
+//-------------------------Allocation bitmap---------------------------
+//Which blocks are taken, kept in RAM. Built on first use after mount from
+//whole inode table and image tables, contents of block say nothing, file
+//block may start with zero byte. bget sets bits, releases clear them.
+//Missed release only keeps block until next mount, bulk changes (resize,
+//rollback) drop map so it is built again
+
+var blockMap []bool
+
+func allocatedBlocks() []bool {
+	m := make([]bool, SB.BlockTableSize)
+	set := func(b int64) {
+		if b >= 0 && b < int64(len(m)) {
+			m[b] = true
+		}
+	}
+	for _, b := range []int64{SB.Snapshots, SB.Quotas, SB.Dedup} {
+		if b != 0 {
+			set(b)
+		}
+	}
+	if SB.Snapshots != 0 {
+		for _, rb := range readSnapTable().RefBlocks {
+			if rb != 0 {
+				set(rb)
+			}
+		}
+	}
+	if SB.Dedup != 0 {
+		for _, rb := range readDedupTable().RefBlocks {
+			if rb != 0 {
+				set(rb)
+			}
+		}
+	}
+	//Unlinked inodes still hold theirs
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		for _, b := range inodeBlocks(readInode(in)) {
+			set(b)
+		}
+	}
+	return m
+}
+
+func blockUsed(ib int64) bool {
+	if int64(len(blockMap)) != SB.BlockTableSize {
+		blockMap = allocatedBlocks()
+	}
+	return blockMap[ib]
+}
+
+//Map not built yet is left alone, building it reads current state
+func setBlockUsed(ib int64, used bool) {
+	if ib >= 0 && ib < int64(len(blockMap)) {
+		blockMap[ib] = used
+	}
+}
+
+//Gives back blocks just taken by bget when later allocation fails
+func ungetBlocks(bids []int64) {
+	for _, b := range bids {
+		setBlockUsed(b, false)
+	}
+}
+
+//Blocks bget can still hand out
+func freeBlockCount() int64 {
+	var n int64
+	for k := int64(0); k < SB.BlockTableSize; k++ {
+		if blockFree(k) {
+			n++
+		}
+	}
+	return n
+}
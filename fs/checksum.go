@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"path"
+	"unsafe"
+)
+
+//-------------------------Checksums---------------------------
+//Superblock and inodes carry CRC32C in their last field, blocks have
+//theirs in table placed after data blocks: [Superblock-Inodes-DataBlocks-Sums]
+//Zero entry in table means block is not checksummed
+
+//SuperBlock.Features bits
+const (
+	featChecksums = 1 << iota //Superblock, inodes and folder blocks
+	featDataSums              //File blocks too
+	featEncrypted             //Blocks sealed with key from passphrase
+	featExtents               //New files map blocks by extents
+	featDedup                 //Writes share blocks with equal contents
+)
+
+const sumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//Place of bad checksum found by scrub
+type badLocation struct {
+	Kind   string `json:"kind"` //superblock, inode or block
+	Index  int64  `json:"index"`
+	Sector int64  `json:"sector"`
+	Owner  string `json:"owner,omitempty"` //Path using inode or block, if reachable
+}
+
+//CRC32C of binary encoding, checksum field must be zeroed by caller
+func structSum(v interface{}) uint32 {
+	binBuf := new(bytes.Buffer)
+	err := binary.Write(binBuf, binary.BigEndian, v)
+	if err != nil {
+		log.Println(err)
+	}
+	return crc32.Checksum(binBuf.Bytes(), castagnoli)
+}
+
+//Never zero, zero entry marks unchecked block
+func blockSum(raw []byte) uint32 {
+	sum := crc32.Checksum(raw, castagnoli)
+	if sum == 0 {
+		sum = 1
+	}
+	return sum
+}
+
+//Offset of block in sectors
+func blockSector(ib int64) int64 {
+	offsetSB := int64(math.Ceil(float64(unsafe.Sizeof(SuperBlock{})) / float64(sectorSize)))
+	offsetInode := int64(SB.InodeTableSize) * int64(math.Ceil(float64(unsafe.Sizeof(Inode{}))/float64(sectorSize)))
+	offsetBlock := ib * int64(math.Ceil(float64(unsafe.Sizeof(Block{}))/float64(sectorSize)))
+	return offsetSB + offsetInode + offsetBlock
+}
+
+//Sector of table holding checksum of block and position inside it
+func sumEntry(ib int64) (int64, int64) {
+	pos := ib * sumSize
+	return blockSector(SB.BlockTableSize) + pos/sectorSize, pos % sectorSize
+}
+
+func readBlockSum(ib int64) uint32 {
+	sector, pos := sumEntry(ib)
+	buf := make([]byte, sectorSize)
+	readH(sector, &buf)
+	return binary.BigEndian.Uint32(buf[pos:])
+}
+
+func updateBlockSum(ib int64, raw []byte, sum bool) {
+	if SB.Features&featChecksums == 0 {
+		return
+	}
+	var v uint32
+	if sum {
+		v = blockSum(raw)
+	}
+	//Table is written in whole sectors
+	sector, pos := sumEntry(ib)
+	buf := make([]byte, sectorSize)
+	readH(sector, &buf)
+	binary.BigEndian.PutUint32(buf[pos:], v)
+	writeH(sector, &buf)
+}
+
+func verifyBlock(ib int64, raw []byte) error {
+	if SB.Features&featChecksums == 0 {
+		return nil
+	}
+	sum := readBlockSum(ib)
+	if sum != 0 && sum != blockSum(raw) {
+		return fmt.Errorf("block %d: %w", ib, errCorrupt)
+	}
+	return nil
+}
+
+//Checks superblock, every inode and every checksummed block
+func scrub() ([]badLocation, error) {
+	verbose := Verbose
+	Verbose = false
+	defer func() { Verbose = verbose }()
+
+	var bad []badLocation
+	sb, err := readSuperBlockChecked()
+	if errors.Is(err, errCorrupt) {
+		bad = append(bad, badLocation{Kind: "superblock"})
+	} else if err != nil {
+		return nil, err
+	}
+	if sb.Features&featChecksums == 0 {
+		return nil, errors.New("image has no checksums")
+	}
+	SB = sb
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		if _, err := readInodeChecked(in); errors.Is(err, errCorrupt) {
+			bad = append(bad, badLocation{Kind: "inode", Index: in, Sector: 1 + in})
+		}
+	}
+	for ib := int64(0); ib < SB.BlockTableSize; ib++ {
+		if _, err := readBlockChecked(ib); errors.Is(err, errCorrupt) {
+			bad = append(bad, badLocation{Kind: "block", Index: ib, Sector: blockSector(ib)})
+		}
+	}
+	if len(bad) > 0 {
+		inodes, blocks := map[int64]string{0: "/"}, map[int64]string{}
+		scrubOwners(0, "/", inodes, blocks)
+		for k, v := range bad {
+			switch v.Kind {
+			case "inode":
+				bad[k].Owner = inodes[v.Index]
+			case "block":
+				bad[k].Owner = blocks[v.Index]
+			}
+		}
+	}
+	return bad, nil
+}
+
+//Maps inodes and blocks reachable from folder dirID to their paths
+func scrubOwners(dirID int64, dirPath string, inodes, blocks map[int64]string) {
+	dir, _ := readInodeChecked(dirID)
+	bids := inodeBids(dir)
+	for _, b := range bids {
+		blocks[b] = path.Clean(dirPath)
+	}
+	var folder Folder
+	folderBuf := new(bytes.Buffer)
+	for _, b := range bids {
+		block, _ := readBlockChecked(b)
+		folderBuf.Write(block.Data[:])
+	}
+	if binary.Read(folderBuf, binary.BigEndian, &folder) != nil {
+		return
+	}
+	for k, v := range folder.FileName {
+		name := entryName(v)
+		if v[0] == 0 || name == ".." {
+			continue
+		}
+		iid := folder.FileInodeID[k]
+		if iid < 0 || iid >= SB.InodeTableSize {
+			continue
+		}
+		if _, seen := inodes[iid]; seen {
+			continue
+		}
+		p := dirPath + name
+		inodes[iid] = p
+		inode, _ := readInodeChecked(iid)
+		if inode.Mode == 1 {
+			scrubOwners(iid, p+"/", inodes, blocks)
+			continue
+		}
+		for _, b := range inodeBlocks(inode) {
+			blocks[b] = p
+		}
+	}
+}
+
+func (l badLocation) String() string {
+	s := fmt.Sprintf("%s %d (sector %d): %s", l.Kind, l.Index, l.Sector, errCorrupt)
+	if l.Kind == "superblock" {
+		s = fmt.Sprintf("superblock (sector 0): %s", errCorrupt)
+	}
+	if l.Owner != "" {
+		s += ", used by " + l.Owner
+	}
+	return s
+}
+
+//Prints every bad location of current image
+func scrubImage() {
+	mountIfNeeded()
+	bad, err := scrub()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, v := range bad {
+		fmt.Println(v)
+	}
+	fmt.Printf("Scrub finished, %d bad locations\n", len(bad))
+}
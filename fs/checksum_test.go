@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+//Flips one bit of image file at byte off
+func flipBit(t *testing.T, off int64) {
+	f, err := os.OpenFile(ImagePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0x10
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubFlippedBit(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{DataSums: true})
+	data := bytes.Repeat([]byte("sum"), int(blockSize))
+	quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &data)
+		close(0)
+		create("g")
+		umount()
+	})
+	if bad, err := scrub(); err != nil || len(bad) != 0 {
+		t.Fatalf("clean image: %v %v", bad, err)
+	}
+	fID, f, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gID, _, _ := lookupPath("/g")
+	b := fileBids(f)[1]
+	flipBit(t, blockSector(b)*sectorSize+100)
+	flipBit(t, (1+gID)*sectorSize+5)
+	bad, err := scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []badLocation{
+		{Kind: "inode", Index: gID, Sector: 1 + gID, Owner: "/g"},
+		{Kind: "block", Index: b, Sector: blockSector(b), Owner: "/f"},
+	}
+	if len(bad) != len(want) || bad[0] != want[0] || bad[1] != want[1] {
+		t.Fatalf("scrub found %v, want %v", bad, want)
+	}
+	if _, err := readFileChecked(readInode(fID)); err == nil {
+		t.Fatal("flipped block read without error")
+	}
+}
@@ -0,0 +1,1391 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-------------------------Command line mode---------------------------
+//fs [-json] [-v] <command> [flags] args, images are given as img:/path
+//so the same line works in scripts, Makefiles and batch files
+
+const cliUsage = `Usage: fs [-json] [-v] [-u uid[:gid]] <command> [flags] [args]
+
+Commands:
+  mkfs [-i inodes] [-s size] [-datasums] [-encrypt] [-extents] [-dedup] img
+                                     create image, size accepts K, M, G suffixes
+  ls [-l] img:/folder                list folder, -l with modes, sizes and times
+  cat img:/file...                   print file contents
+  put [-m perm] [-z] host img:/path  copy host file (- for stdin) into image, -z compressed
+  get img:/file host                 copy file out of image (- for stdout)
+  stat img:/path                     show inode of path
+  compress [-d] img:/path            compress file or folder's new files, -d undoes
+  fallocate [-p] [-k] img:/file off len
+                                     preallocate range, -p punches hole, -k keeps size
+  xattr [-d] img:/path [name [value]]
+                                     list, get or set extended attributes, -d removes
+  chown img:/path uid[:gid]          change owners of entry
+  quota report img                   show usage and limits per user and group
+  quota set img user|group id bsoft bhard isoft ihard
+  quota grace img blocks inodes      set limits (0 is none) and grace periods (168h)
+  extents [-d] img:/file             map file by extents, -d back to block pointers
+  rm [-r] img:/path                  remove file, or folder with -r
+  ln img:/target img:/name           hard link, target and name in same image
+  mkdir [-p] img:/folder             create folder, with parents for -p
+  snapshot create|delete|rollback img name
+  snapshot list img                  manage snapshots, img@name:/path reads one
+  scrub img                          verify checksums, report every bad location
+  fsck img                           check pointers and block ownership of image
+  resize [-i inodes] img size        grow image adding inodes, or shrink it
+  frag img[:/path]                   report block runs per file and free space
+  defrag img[:/path]                 make fragmented files contiguous
+  dedup report|on|off img            show space saved, toggle dedup on writes
+  dedup run img[:/path]              share equal blocks of existing files
+  debug img sb|inode n|folder n|block [-raw] n|path n
+                                     decode on-disk structures, hexdump blocks
+  map [-c owner|status|frag] img out.svg|out.html|-
+                                     draw layout and block ownership
+  replay trace img                   run recorded trace against fresh image img
+  crash [trace]                      fsck every image power cut during trace could leave
+  batch [script]                     run commands from script (stdin if omitted)
+`
+
+var jsonOutput bool
+
+//Image currently loaded, commands switch between images by name
+var cliImage string
+
+//Inode as printed by stat, ls and friends
+type entryInfo struct {
+	Name   string    `json:"name"`
+	Inode  int64     `json:"inode"`
+	Type   string    `json:"type"`
+	Size   int64     `json:"size"`
+	Stored int64     `json:"stored"` //Bytes in blocks, less than size if compressed
+	Perm   string    `json:"perm"`
+	Mtime  time.Time `json:"mtime"`
+	Blocks []int64   `json:"blocks"`
+	Target string    `json:"target,omitempty"`
+
+	Compressed bool       `json:"compressed,omitempty"`
+	Extents    [][2]int64 `json:"extents,omitempty"` //Start and length of runs
+
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	Uid    uint32            `json:"uid"`
+	Gid    uint32            `json:"gid"`
+	Links  uint32            `json:"links"`
+}
+
+//Returns process exit code
+func runCLI(args []string) int {
+	flags := flag.NewFlagSet("fs", flag.ContinueOnError)
+	flags.BoolVar(&jsonOutput, "json", false, "machine readable output")
+	flags.BoolVar(&Verbose, "v", false, "print internals of every operation")
+	owner := flags.String("u", "", "owner of created entries, uid[:gid]")
+	flags.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *owner != "" {
+		uid, gid, err := parseOwner(*owner, curGid)
+		if err != nil {
+			cliError(err)
+			return 2
+		}
+		curUid, curGid = uid, gid
+	}
+	err := runCommand(flags.Arg(0), flags.Args()[1:])
+	if err != nil {
+		cliError(err)
+		return 1
+	}
+	return 0
+}
+
+func runCommand(name string, args []string) error {
+	var err error
+	switch name {
+	case "mkfs":
+		err = cliMkfs(args)
+	case "ls":
+		err = cliLs(args)
+	case "cat":
+		err = cliCat(args)
+	case "put":
+		err = cliPut(args)
+	case "get":
+		err = cliGet(args)
+	case "stat":
+		err = cliStat(args)
+	case "rm":
+		err = cliRm(args)
+	case "ln":
+		err = cliLn(args)
+	case "mkdir":
+		err = cliMkdir(args)
+	case "compress":
+		err = cliCompress(args)
+	case "extents":
+		err = cliExtents(args)
+	case "fallocate":
+		err = cliFallocate(args)
+	case "xattr":
+		err = cliXattr(args)
+	case "chown":
+		err = cliChown(args)
+	case "quota":
+		err = cliQuota(args)
+	case "scrub":
+		err = cliScrub(args)
+	case "fsck":
+		err = cliFsck(args)
+	case "resize":
+		err = cliResize(args)
+	case "frag", "defrag":
+		err = cliFrag(name, args)
+	case "dedup":
+		err = cliDedup(args)
+	case "debug":
+		err = cliDebug(args)
+	case "map":
+		err = cliMap(args)
+	case "snapshot":
+		err = cliSnapshot(args)
+	case "replay":
+		err = cliReplay(args)
+	case "crash":
+		err = cliCrash(args)
+	case "batch":
+		err = cliBatch(args)
+	default:
+		err = fmt.Errorf("unknown command %q, run fs -h for help", name)
+	}
+	//Allocations are persisted after every command
+	if cliImage != "" {
+		umount()
+	}
+	return err
+}
+
+func cliError(err error) {
+	if jsonOutput {
+		cliPrint(map[string]string{"error": err.Error()})
+		return
+	}
+	fmt.Fprintln(os.Stderr, "fs:", err)
+}
+
+//JSON Lines, one value per command
+func cliPrint(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fs:", err)
+		return
+	}
+	fmt.Println(string(b))
+}
+
+func cliFlags(name string, args []string, setup func(*flag.FlagSet), nargs int) (*flag.FlagSet, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	if setup != nil {
+		setup(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if nargs >= 0 && flags.NArg() != nargs {
+		return nil, fmt.Errorf("%s: expected %d arguments, got %d", name, nargs, flags.NArg())
+	}
+	return flags, nil
+}
+
+//Splits img:/path and loads image, path defaults to root,
+//img@snapshot:/path opens snapshot read-only
+func cliOpen(arg string) (string, error) {
+	k := strings.Index(arg, ":")
+	if k <= 0 {
+		return "", fmt.Errorf("%s: expected image:/path", arg)
+	}
+	img, p := arg[:k], arg[k+1:]
+	if p == "" {
+		p = "/"
+	}
+	if img == cliImage {
+		return p, nil
+	}
+	file, snap := img, ""
+	if j := strings.LastIndex(img, "@"); j > 0 {
+		if _, err := os.Stat(img); err != nil {
+			file, snap = img[:j], img[j+1:]
+		}
+	}
+	if _, err := os.Stat(file); err != nil {
+		return "", err
+	}
+	if cliImage != "" {
+		umount()
+		snapView = nil
+	}
+	ImagePath = file
+	if err := mountImage(); err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	cliImage = img
+	if snap != "" {
+		if err := mountSnapshot(snap); err != nil {
+			cliImage = ""
+			return "", fmt.Errorf("%s: %w", img, err)
+		}
+	}
+	return p, nil
+}
+
+//Commands changing image refuse snapshots
+func cliWritable(p string) error {
+	if snapView != nil {
+		return fmt.Errorf("%s: %w", p, errReadOnly)
+	}
+	return nil
+}
+
+//Accepts plain bytes or K, M, G suffixes
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = KB
+	case strings.HasSuffix(s, "M"):
+		mult = MB
+	case strings.HasSuffix(s, "G"):
+		mult = GB
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func inodeType(i Inode) string {
+	switch i.Mode {
+	case 1:
+		return "folder"
+	case 2:
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
+func newEntryInfo(name string, iid int64, i Inode) entryInfo {
+	info := entryInfo{
+		Name:   name,
+		Inode:  iid,
+		Type:   inodeType(i),
+		Size:   i.Size,
+		Stored: keptSize(i),
+		Perm:   fmt.Sprintf("%04o", inodePerm(i)),
+		Mtime:  time.Unix(i.Mtime, 0).UTC(),
+		Blocks: append([]int64{}, fileBids(i)...),
+		Uid:    i.Uid,
+		Gid:    i.Gid,
+		Links:  inodeNlink(i),
+	}
+	if i.Mode == 2 {
+		info.Target = string(readFile(i))
+	}
+	info.Compressed = i.Flags&flagCompressed != 0
+	for _, a := range readXattrs(i) {
+		if info.Xattrs == nil {
+			info.Xattrs = map[string]string{}
+		}
+		info.Xattrs[a.Name] = string(a.Value)
+	}
+	if i.Flags&flagExtents != 0 {
+		for _, e := range readExtents(i) {
+			info.Extents = append(info.Extents, [2]int64{e.Start, e.Length})
+		}
+	}
+	return info
+}
+
+//Resolves path following symlinks, relative targets start at link's folder
+func lookupFollow(p string) (int64, Inode, error) {
+	for n := 0; n < 8; n++ {
+		iid, inode, err := lookupPath(p)
+		if err != nil || inode.Mode != 2 {
+			return iid, inode, err
+		}
+		target := string(readFile(inode))
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = target
+	}
+	return 0, Inode{}, errLinkLoop
+}
+
+func cliMkfs(args []string) error {
+	var iq int64
+	var size string
+	var dataSums, encrypt, extents, dedup bool
+	flags, err := cliFlags("mkfs", args, func(f *flag.FlagSet) {
+		f.BoolVar(&encrypt, "encrypt", false, "encrypt blocks with passphrase (FS_PASSPHRASE or prompt), inodes stay plain")
+		f.Int64Var(&iq, "i", 128, "quantity of inodes")
+		f.StringVar(&size, "s", "200000", "image size in bytes")
+		f.BoolVar(&dataSums, "datasums", false, "checksum file blocks, not only folders")
+		f.BoolVar(&extents, "extents", false, "map new files by extents")
+		f.BoolVar(&dedup, "dedup", false, "share equal blocks on every write")
+	}, 1)
+	if err != nil {
+		return err
+	}
+	sz, err := parseSize(size)
+	if err != nil {
+		return err
+	}
+	if cliImage != "" {
+		umount()
+	}
+	ImagePath = flags.Arg(0)
+	cliImage = ""
+	opts := mkfsOptions{DataSums: dataSums, Extents: extents, Dedup: dedup}
+	if encrypt {
+		if opts.Passphrase, err = newPassphrase(); err != nil {
+			return err
+		}
+	}
+	if err := mkfs(iq, sz, opts); err != nil {
+		return err
+	}
+	mount()
+	cliImage = ImagePath
+	if jsonOutput {
+		cliPrint(map[string]interface{}{"image": ImagePath, "size": SB.FsSize, "inodes": SB.InodeTableSize, "blocks": SB.BlockTableSize})
+	} else {
+		fmt.Printf("%s: %d bytes, %d inodes, %d blocks\n", ImagePath, SB.FsSize, SB.InodeTableSize, SB.BlockTableSize)
+	}
+	return nil
+}
+
+func cliLs(args []string) error {
+	var long bool
+	flags, err := cliFlags("ls", args, func(f *flag.FlagSet) {
+		f.BoolVar(&long, "l", false, "show modes, links, owners, sizes and times")
+	}, 1)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	iid, inode, err := lookupPath(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	entries := []entryInfo{}
+	if inode.Mode != 1 {
+		entries = append(entries, newEntryInfo(path.Base(p), iid, inode))
+	} else {
+		list, err := readdirAll(iid)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		for _, e := range list {
+			entries = append(entries, newEntryInfo(e.Name, e.Inode, readInode(e.Inode)))
+		}
+	}
+	if jsonOutput {
+		cliPrint(entries)
+		return nil
+	}
+	for _, e := range entries {
+		if long {
+			fmt.Println(longListing(e.Name, readInode(e.Inode)))
+			continue
+		}
+		if e.Type == "folder" {
+			e.Name += "/"
+		}
+		fmt.Println(e.Name)
+	}
+	return nil
+}
+
+func cliCat(args []string) error {
+	flags, err := cliFlags("cat", args, nil, -1)
+	if err != nil {
+		return err
+	}
+	for _, arg := range flags.Args() {
+		p, err := cliOpen(arg)
+		if err != nil {
+			return err
+		}
+		_, inode, err := lookupFollow(p)
+		if err == nil && inode.Mode == 1 {
+			err = errIsFolder
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		data, err := readFileChecked(inode)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		os.Stdout.Write(data)
+	}
+	return nil
+}
+
+func cliPut(args []string) error {
+	var perm string
+	var compress bool
+	flags, err := cliFlags("put", args, func(f *flag.FlagSet) {
+		f.StringVar(&perm, "m", "", "permission bits in octal, host file's by default")
+		f.BoolVar(&compress, "z", false, "store file compressed")
+	}, 2)
+	if err != nil {
+		return err
+	}
+	src := flags.Arg(0)
+	var data []byte
+	mode, mtime := uint32(0644), time.Now().Unix()
+	if src == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		var info os.FileInfo
+		info, err = os.Stat(src)
+		if err == nil {
+			mode, mtime = uint32(info.Mode().Perm()), info.ModTime().Unix()
+			data, err = os.ReadFile(src)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if perm != "" {
+		m, err := strconv.ParseUint(perm, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid permissions %q", perm)
+		}
+		mode = uint32(m)
+	}
+
+	p, err := cliOpen(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	//Existing folder as destination keeps host name
+	if _, inode, err := lookupPath(p); err == nil && inode.Mode == 1 && src != "-" {
+		p = path.Join(p, path.Base(src))
+	}
+	dirID, _, base, err := lookupParent(p)
+	if err == nil && base == "" {
+		err = errIsFolder
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	//Flag must be set before contents, they may fit only compressed
+	if compress {
+		iid, err := importEntry(dirID, base, 0, mode, mtime, nil)
+		if err == nil {
+			err = setCompression(iid, true)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	iid, err := importEntry(dirID, base, 0, mode, mtime, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if jsonOutput {
+		cliPrint(newEntryInfo(base, iid, readInode(iid)))
+	}
+	return nil
+}
+
+//Turns compression on, or off with -d, for file or folder
+func cliCompress(args []string) error {
+	var off bool
+	flags, err := cliFlags("compress", args, func(f *flag.FlagSet) {
+		f.BoolVar(&off, "d", false, "store uncompressed")
+	}, 1)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	iid, _, err := lookupFollow(p)
+	if err == nil {
+		err = setCompression(iid, !off)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if jsonOutput {
+		cliPrint(newEntryInfo(path.Base(p), iid, readInode(iid)))
+	}
+	return nil
+}
+
+//Switches file to extents, or back to block pointers with -d
+func cliExtents(args []string) error {
+	var off bool
+	flags, err := cliFlags("extents", args, func(f *flag.FlagSet) {
+		f.BoolVar(&off, "d", false, "use block pointers")
+	}, 1)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	iid, _, err := lookupFollow(p)
+	if err == nil {
+		err = setExtentFormat(iid, !off)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if jsonOutput {
+		cliPrint(newEntryInfo(path.Base(p), iid, readInode(iid)))
+	}
+	return nil
+}
+
+func cliFallocate(args []string) error {
+	var punch, keep bool
+	flags, err := cliFlags("fallocate", args, func(f *flag.FlagSet) {
+		f.BoolVar(&punch, "p", false, "punch hole, size is kept")
+		f.BoolVar(&keep, "k", false, "do not grow file")
+	}, 3)
+	if err != nil {
+		return err
+	}
+	off, err := parseSize(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	length, err := parseSize(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+	var mode uint32
+	if punch {
+		mode |= fallocPunchHole | fallocKeepSize
+	}
+	if keep {
+		mode |= fallocKeepSize
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	iid, inode, err := lookupFollow(p)
+	if err == nil {
+		inode, err = fallocate(inode, off, length, mode)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	writeInode(iid, inode)
+	if jsonOutput {
+		cliPrint(newEntryInfo(path.Base(p), iid, inode))
+	}
+	return nil
+}
+
+//Lists attributes, prints one with name, sets it with name and value
+func cliXattr(args []string) error {
+	var del bool
+	flags, err := cliFlags("xattr", args, func(f *flag.FlagSet) {
+		f.BoolVar(&del, "d", false, "remove attribute")
+	}, -1)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 3 || (del && flags.NArg() != 2) {
+		return errors.New("usage: xattr [-d] img:/path [name [value]]")
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 3 || del {
+		if err := cliWritable(p); err != nil {
+			return err
+		}
+	}
+	iid, inode, err := lookupPath(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	name := flags.Arg(1)
+	switch {
+	case del:
+		err = removeXattr(iid, name)
+	case flags.NArg() == 3:
+		err = setXattr(iid, name, []byte(flags.Arg(2)), 0)
+	case flags.NArg() == 2:
+		var v []byte
+		if v, err = getXattr(inode, name); err == nil {
+			if jsonOutput {
+				cliPrint(map[string]string{name: string(v)})
+			} else {
+				fmt.Println(string(v))
+			}
+		}
+	default:
+		info := newEntryInfo(path.Base(p), iid, inode)
+		if jsonOutput {
+			cliPrint(info.Xattrs)
+			return nil
+		}
+		for _, a := range readXattrs(inode) {
+			fmt.Printf("%s=%q\n", a.Name, a.Value)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	return nil
+}
+
+func cliChown(args []string) error {
+	flags, err := cliFlags("chown", args, nil, 2)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	iid, inode, err := lookupPath(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	uid, gid, err := parseOwner(flags.Arg(1), inode.Gid)
+	if err != nil {
+		return err
+	}
+	if err := chownInode(iid, uid, gid); err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	return nil
+}
+
+//quota report img | quota set img user|group id limits... | quota grace img blocks inodes
+func cliQuota(args []string) error {
+	usage := errors.New("usage: quota report img | quota set img user|group id bsoft bhard isoft ihard | quota grace img blocks inodes")
+	flags, err := cliFlags("quota", args, nil, -1)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return usage
+	}
+	if _, err := cliOpen(strings.TrimSuffix(flags.Arg(1), ":") + ":"); err != nil {
+		return err
+	}
+	switch op := flags.Arg(0); {
+	case op == "report" && flags.NArg() == 2:
+		lines := quotaReport()
+		if jsonOutput {
+			cliPrint(lines)
+		} else {
+			printQuotaReport(lines)
+		}
+		return nil
+	case op == "set" && flags.NArg() == 8 && (flags.Arg(2) == "user" || flags.Arg(2) == "group"):
+		if err := cliWritable("/"); err != nil {
+			return err
+		}
+		id, err := strconv.ParseUint(flags.Arg(3), 10, 32)
+		if err != nil {
+			return err
+		}
+		var limits [4]int64
+		for k := range limits {
+			if limits[k], err = strconv.ParseInt(flags.Arg(4+k), 10, 64); err != nil {
+				return err
+			}
+		}
+		return setQuota(flags.Arg(2) == "group", uint32(id), limits[0], limits[1], limits[2], limits[3])
+	case op == "grace" && flags.NArg() == 4:
+		if err := cliWritable("/"); err != nil {
+			return err
+		}
+		b, err := time.ParseDuration(flags.Arg(2))
+		if err != nil {
+			return err
+		}
+		i, err := time.ParseDuration(flags.Arg(3))
+		if err != nil {
+			return err
+		}
+		return setQuotaGrace(b, i)
+	}
+	return usage
+}
+
+func cliGet(args []string) error {
+	flags, err := cliFlags("get", args, nil, 2)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	iid, inode, err := lookupFollow(p)
+	if err == nil && inode.Mode == 1 {
+		err = errIsFolder
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	data, err := readFileChecked(inode)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	dst := flags.Arg(1)
+	if dst == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = path.Join(dst, path.Base(p))
+	}
+	if err := os.WriteFile(dst, data, os.FileMode(inodePerm(inode))); err != nil {
+		return err
+	}
+	if err := chtimesInode(dst, inode); err != nil {
+		return err
+	}
+	if jsonOutput {
+		cliPrint(newEntryInfo(path.Base(p), iid, inode))
+	}
+	return nil
+}
+
+func cliStat(args []string) error {
+	flags, err := cliFlags("stat", args, nil, 1)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	iid, inode, err := lookupPath(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	info := newEntryInfo(path.Base(p), iid, inode)
+	if jsonOutput {
+		cliPrint(info)
+		return nil
+	}
+	fmt.Printf("Name : %s\nInode : %d\nType : %s\nSize : %d\nStored : %d\nCompressed : %t\nPerm : %s\nMtime : %s\nBlocks : %v\n",
+		info.Name, info.Inode, info.Type, info.Size, info.Stored, info.Compressed, info.Perm, info.Mtime.Format(time.RFC3339), info.Blocks)
+	if info.Target != "" {
+		fmt.Printf("Target : %s\n", info.Target)
+	}
+	fmt.Printf("Owner : %d:%d\nLinks : %d\n", info.Uid, info.Gid, info.Links)
+	if info.Extents != nil {
+		fmt.Printf("Extents : %s\n", formatExtents(inode))
+	}
+	for _, a := range readXattrs(inode) {
+		fmt.Printf("Xattr : %s=%q\n", a.Name, a.Value)
+	}
+	return nil
+}
+
+func cliRm(args []string) error {
+	var recursive bool
+	flags, err := cliFlags("rm", args, func(f *flag.FlagSet) {
+		f.BoolVar(&recursive, "r", false, "remove folders and their contents")
+	}, 1)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	_, dir, base, err := lookupParent(p)
+	if err == nil && base == "" {
+		err = errors.New("root folder can not be removed")
+	}
+	if err == nil {
+		if recursive {
+			err = removeTree(dir, base)
+		} else {
+			err = removeEntry(dir, base, false)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if jsonOutput {
+		cliPrint(map[string]interface{}{"removed": p})
+	}
+	return nil
+}
+
+//Names are in one image, links can not reach other images or snapshots
+func cliLn(args []string) error {
+	flags, err := cliFlags("ln", args, nil, 2)
+	if err != nil {
+		return err
+	}
+	target, name := flags.Arg(0), flags.Arg(1)
+	k, j := strings.Index(target, ":"), strings.Index(name, ":")
+	if k > 0 && j > 0 && target[:k] != name[:j] {
+		return fmt.Errorf("%s: %w", name, errCrossLink)
+	}
+	tp, err := cliOpen(target)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(name)
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	iid, _, err := lookupPath(tp)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tp, err)
+	}
+	_, dir, base, err := lookupParent(p)
+	if err == nil && base == "" {
+		err = errExists
+	}
+	if err == nil {
+		err = linkIn(dir, base, iid)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if jsonOutput {
+		cliPrint(newEntryInfo(path.Base(p), iid, readInode(iid)))
+	}
+	return nil
+}
+
+func cliMkdir(args []string) error {
+	var parents bool
+	flags, err := cliFlags("mkdir", args, func(f *flag.FlagSet) {
+		f.BoolVar(&parents, "p", false, "create missing parents, no error if folder exists")
+	}, 1)
+	if err != nil {
+		return err
+	}
+	p, err := cliOpen(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := cliWritable(p); err != nil {
+		return err
+	}
+	var iid int64
+	if parents {
+		iid, err = ensureFolder(0, p)
+	} else {
+		var dirID int64
+		var dir Inode
+		var base string
+		dirID, dir, base, err = lookupParent(p)
+		if err == nil {
+			err = checkNewEntry(dir, base)
+		}
+		if err == nil {
+			iid, err = mkdirIn(dir, dirID, base, curUid, curGid)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if jsonOutput {
+		cliPrint(newEntryInfo(path.Base(p), iid, readInode(iid)))
+	}
+	return nil
+}
+
+//Fails when any bad location is found, so scripts can check exit code
+func cliScrub(args []string) error {
+	flags, err := cliFlags("scrub", args, nil, 1)
+	if err != nil {
+		return err
+	}
+	arg := flags.Arg(0)
+	if !strings.Contains(arg, ":") {
+		arg += ":"
+	}
+	if _, err := cliOpen(arg); err != nil {
+		return err
+	}
+	bad, err := scrub()
+	if err != nil {
+		return err
+	}
+	for _, v := range bad {
+		if jsonOutput {
+			cliPrint(v)
+		} else {
+			fmt.Println(v)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d bad locations", len(bad))
+	}
+	return nil
+}
+
+//Fails when image has problems, like scrub
+func cliFsck(args []string) error {
+	flags, err := cliFlags("fsck", args, nil, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := cliOpen(strings.TrimSuffix(flags.Arg(0), ":") + ":"); err != nil {
+		return err
+	}
+	problems := fsck()
+	for _, v := range problems {
+		if jsonOutput {
+			cliPrint(map[string]string{"problem": v})
+		} else {
+			fmt.Println(v)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems", len(problems))
+	}
+	return nil
+}
+
+func cliResize(args []string) error {
+	var add int64
+	flags, err := cliFlags("resize", args, func(f *flag.FlagSet) {
+		f.Int64Var(&add, "i", 0, "inodes to add")
+	}, 2)
+	if err != nil {
+		return err
+	}
+	img := strings.TrimSuffix(flags.Arg(0), ":")
+	if strings.Contains(img, "@") {
+		return fmt.Errorf("%s: %w", img, errReadOnly)
+	}
+	size, err := parseSize(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if _, err := cliOpen(img + ":"); err != nil {
+		return err
+	}
+	if err := resizeImage(size, add); err != nil {
+		return err
+	}
+	if jsonOutput {
+		cliPrint(map[string]int64{"size": SB.FsSize, "blocks": SB.BlockTableSize, "inodes": SB.InodeTableSize})
+	}
+	return nil
+}
+
+func cliFrag(name string, args []string) error {
+	flags, err := cliFlags(name, args, nil, 1)
+	if err != nil {
+		return err
+	}
+	arg := flags.Arg(0)
+	if !strings.Contains(arg, ":") {
+		arg += ":"
+	}
+	p, err := cliOpen(arg)
+	if err != nil {
+		return err
+	}
+	var lines []fragLine
+	if name == "defrag" {
+		if err := cliWritable(p); err != nil {
+			return err
+		}
+		lines, err = defrag(p)
+	} else {
+		lines, err = fragReport(p)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	switch {
+	case jsonOutput && name == "defrag":
+		cliPrint(lines)
+	case jsonOutput:
+		cliPrint(map[string]interface{}{"files": lines, "free": freeSpace()})
+	case name == "defrag":
+		printDefrag(lines)
+	default:
+		printFragReport(lines, freeSpace())
+	}
+	return nil
+}
+
+func cliDedup(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: dedup report|run|on|off img")
+	}
+	arg := args[1]
+	if !strings.Contains(arg, ":") {
+		arg += ":"
+	}
+	p, err := cliOpen(arg)
+	if err != nil {
+		return err
+	}
+	if args[0] != "report" {
+		if err := cliWritable(p); err != nil {
+			return err
+		}
+	}
+	switch args[0] {
+	case "report":
+		if jsonOutput {
+			cliPrint(dedupReport())
+		} else {
+			printDedupReport(dedupReport())
+		}
+	case "run":
+		n, err := dedupTree(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if jsonOutput {
+			cliPrint(map[string]int{"merged": n})
+		} else {
+			fmt.Printf("Merged %d blocks\n", n)
+		}
+	case "on", "off":
+		setDedupMode(args[0] == "on")
+	default:
+		return errors.New("usage: dedup report|run|on|off img")
+	}
+	return nil
+}
+
+func cliDebug(args []string) error {
+	usage := errors.New("usage: debug img sb|inode n|folder n|block [-raw] n|path n")
+	if len(args) < 2 {
+		return usage
+	}
+	if _, err := cliOpen(strings.TrimSuffix(args[0], ":") + ":"); err != nil {
+		return err
+	}
+	what := args[1]
+	if what == "sb" {
+		if jsonOutput {
+			cliPrint(map[string]interface{}{"superblock": SB, "layout": layout()})
+		} else {
+			printSuperBlockInfo()
+		}
+		return nil
+	}
+	raw := len(args) == 4 && what == "block" && args[2] == "-raw"
+	if len(args) != 3 && !raw {
+		return usage
+	}
+	n, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+	if err != nil {
+		return err
+	}
+	switch what {
+	case "inode":
+		if !jsonOutput {
+			return printInodeInfo(n)
+		}
+		if err := checkIndex(n, SB.InodeTableSize, "inode"); err != nil {
+			return err
+		}
+		cliPrint(map[string]interface{}{"inode": readInode(n), "sector": inodeSector(n), "path": inodePaths()[n]})
+	case "folder":
+		entries, err := folderEntries(n)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			cliPrint(entries)
+			return nil
+		}
+		printFolderEntries(entries)
+	case "block":
+		d, err := dumpBlock(n, raw)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			cliPrint(d)
+		} else {
+			printBlockDump(d)
+		}
+	case "path":
+		if !jsonOutput {
+			return printBlockPath(n)
+		}
+		if err := checkIndex(n, SB.BlockTableSize, "block"); err != nil {
+			return err
+		}
+		cliPrint(blockOwners(n))
+	default:
+		return usage
+	}
+	return nil
+}
+
+func cliMap(args []string) error {
+	var mode string
+	flags, err := cliFlags("map", args, func(f *flag.FlagSet) {
+		f.StringVar(&mode, "c", "owner", "color blocks by owner, status or frag")
+	}, 2)
+	if err != nil {
+		return err
+	}
+	if _, err := cliOpen(strings.TrimSuffix(flags.Arg(0), ":") + ":"); err != nil {
+		return err
+	}
+	return writeMapFile(flags.Arg(1), mode)
+}
+
+func cliSnapshot(args []string) error {
+	if len(args) < 2 {
+		return errors.New("snapshot: expected action and image")
+	}
+	action, img := args[0], strings.TrimSuffix(args[1], ":")
+	if strings.Contains(img, "@") {
+		return fmt.Errorf("%s: %w", img, errReadOnly)
+	}
+	if _, err := cliOpen(img + ":"); err != nil {
+		return err
+	}
+	if action == "list" {
+		for _, v := range listSnapshots() {
+			created := time.Unix(v.Created, 0)
+			if jsonOutput {
+				cliPrint(map[string]interface{}{"name": snapName(v), "created": created})
+			} else {
+				fmt.Printf("%-32s %s\n", snapName(v), created.Format(time.RFC3339))
+			}
+		}
+		return nil
+	}
+	if len(args) != 3 {
+		return fmt.Errorf("snapshot %s: expected image and name", action)
+	}
+	var err error
+	switch action {
+	case "create":
+		err = takeSnapshot(args[2])
+	case "delete":
+		err = deleteSnapshot(args[2])
+	case "rollback":
+		err = rollbackSnapshot(args[2])
+	default:
+		return fmt.Errorf("snapshot: unknown action %q", action)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[2], err)
+	}
+	return nil
+}
+
+//One command per line, # starts comment, stops at first failing line
+func cliReplay(args []string) error {
+	flags, err := cliFlags("replay", args, nil, 2)
+	if err != nil {
+		return err
+	}
+	if cliImage != "" {
+		umount()
+	}
+	cliImage = ""
+	//Operations print as in shell, keep stdout for result
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	info, err := replayTrace(flags.Arg(0), flags.Arg(1))
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	cliImage = ImagePath
+	if jsonOutput {
+		cliPrint(info)
+	} else {
+		printReplay(info)
+	}
+	if len(info.Mismatches) > 0 || len(info.Problems) > 0 {
+		return errors.New("replay differs from trace")
+	}
+	return nil
+}
+
+func cliCrash(args []string) error {
+	flags, err := cliFlags("crash", args, nil, -1)
+	if err != nil {
+		return err
+	}
+	records := crashWorkload()
+	if flags.NArg() > 0 {
+		if records, err = readTrace(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+	if cliImage != "" {
+		umount()
+	}
+	cliImage = ""
+	//Operations print as in shell, keep stdout for result
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	info, err := crashTest(records)
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		cliPrint(info)
+	} else {
+		printCrashReport(info)
+	}
+	if len(info.Findings) > 0 {
+		return fmt.Errorf("%d inconsistent crash images", len(info.Findings))
+	}
+	return nil
+}
+
+func cliBatch(args []string) error {
+	flags, err := cliFlags("batch", args, nil, -1)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	scanner := bufio.NewScanner(in)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		words, err := splitArgs(text)
+		if err == nil {
+			if words[0] == "batch" {
+				err = errors.New("batch can not be nested")
+			} else {
+				err = runCommand(words[0], words[1:])
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+//Splits line into words, single and double quotes group words
+//and backslash escapes next character outside single quotes
+func splitArgs(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return words, nil
+}
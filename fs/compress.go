@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"log"
+)
+
+//-------------------------Compression---------------------------
+//Compressed file is cut in clusters of clusterBlocks blocks. Each is kept
+//as flate stream at start of its own slot of as many blocks, rest of slot
+//is holes. Cluster that does not shrink fills its blocks plain, all zero
+//one is only holes. Writes recompress only clusters they touch.
+//Inode.Size stays logical size, Inode.Stored is size of slots
+
+const clusterBlocks = 4
+const clusterSize = clusterBlocks * blockSize
+
+//Inode.Flags bits
+const (
+	flagCompressed = 1 << iota //File contents are flate stream, on folders new files inherit it
+	flagExtents                //Blocks are mapped by runs, see extent.go
+)
+
+func deflate(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Damaged stream reads back as zeros of logical size
+func inflate(comp []byte, size int64) ([]byte, error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+	data := make([]byte, size)
+	r := flate.NewReader(bytes.NewReader(comp))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data); err != nil {
+		return make([]byte, size), fmt.Errorf("inflate: %w", err)
+	}
+	return data, nil
+}
+
+func clusterCount(size int64) int64 {
+	return (size + clusterSize - 1) / clusterSize
+}
+
+//Logical bytes of cluster k of file of given size
+func clusterLen(size, k int64) int64 {
+	if n := size - k*clusterSize; n < clusterSize {
+		return n
+	}
+	return clusterSize
+}
+
+//Part of range [off, end) inside cluster k, relative to its start
+func clusterSpan(k, off, end int64) (int64, int64) {
+	start := k * clusterSize
+	lo, hi := maxOffset(off, start)-start, end-start
+	if hi > clusterSize {
+		hi = clusterSize
+	}
+	return lo, hi
+}
+
+//Logical bytes of cluster k from slots mapped by bids
+func readCluster(bids []int64, size, k int64) ([]byte, error) {
+	n := clusterLen(size, k)
+	var slot []byte
+	var used int64
+	var firstErr error
+	for b := k * clusterBlocks; b < (k+1)*clusterBlocks && b < int64(len(bids)); b++ {
+		if bids[b] == 0 {
+			slot = append(slot, make([]byte, blockSize)...)
+			continue
+		}
+		used++
+		block, err := readBlockChecked(bids[b])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		slot = append(slot, block.Data[:]...)
+	}
+	if used == 0 {
+		return make([]byte, n), firstErr
+	}
+	//Plain cluster fills its blocks
+	if used == (n+blockSize-1)/blockSize {
+		if int64(len(slot)) < n {
+			return make([]byte, n), fmt.Errorf("cluster %d: %w", k, errCorrupt)
+		}
+		return slot[:n], firstErr
+	}
+	data, err := inflate(slot, n)
+	if firstErr == nil {
+		firstErr = err
+	}
+	return data, firstErr
+}
+
+//Whole logical contents of compressed file
+func readCompressed(i Inode) ([]byte, error) {
+	return readCompressedRange(i, 0, i.Size)
+}
+
+//Bytes [off, end) of compressed file, only clusters covering them are inflated
+func readCompressedRange(i Inode, off, end int64) ([]byte, error) {
+	//Damaged size must not make us allocate more than slots mapped
+	bids := fileBids(i)
+	if i.Size < 0 || clusterCount(i.Size)*clusterSize != i.Stored || int64(len(bids))*blockSize < i.Stored {
+		return nil, fmt.Errorf("uncompressed size %d, %d bytes of slots mapped: %w", i.Size, int64(len(bids))*blockSize, errCorrupt)
+	}
+	first := off / clusterSize
+	data := make([]byte, 0, end-first*clusterSize)
+	var firstErr error
+	for k := first; k*clusterSize < end; k++ {
+		cluster, err := readCluster(bids, i.Size, k)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		data = append(data, cluster...)
+	}
+	return data[off-first*clusterSize : end-first*clusterSize], firstErr
+}
+
+//Stores cluster k in its slot of raw file, blocks it does not need become holes
+func writeCluster(raw Inode, k int64, data []byte, c *blockCharge) (Inode, error) {
+	keep := data
+	if allZero(data) {
+		keep = nil
+	} else {
+		comp, err := deflate(data)
+		if err != nil {
+			return raw, err
+		}
+		if (int64(len(comp))+blockSize-1)/blockSize < (int64(len(data))+blockSize-1)/blockSize {
+			keep = comp
+		}
+	}
+	start := k * clusterSize
+	var err error
+	if len(keep) > 0 {
+		if raw, err = writeRaw(raw, start, keep, c); err != nil {
+			return raw, err
+		}
+	}
+	used := (int64(len(keep)) + blockSize - 1) / blockSize * blockSize
+	return punchHole(raw, start+used, start+clusterSize, c)
+}
+
+//Recompresses clusters ks of file resized to size, in order given.
+//edit changes logical bytes of cluster k first, inode is not stored
+func rewriteClusters(i Inode, size int64, ks []int64, edit func(k int64, data []byte), c *blockCharge) (Inode, error) {
+	//Slots are kept as contents of uncompressed file
+	raw := i
+	raw.Flags &^= flagCompressed
+	raw.Size = i.Stored
+	raw, err := resizeFile(raw, clusterCount(size)*clusterSize, c)
+	if err != nil {
+		return i, err
+	}
+	done := func(raw Inode) Inode {
+		raw.Flags = i.Flags
+		raw.Stored = raw.Size
+		raw.Size = size
+		return raw
+	}
+	for _, k := range ks {
+		data := make([]byte, clusterLen(size, k))
+		if k < clusterCount(i.Size) {
+			old, err := readCluster(fileBids(raw), i.Size, k)
+			if err != nil {
+				return done(raw), err
+			}
+			copy(data, old)
+		}
+		if edit != nil {
+			edit(k, data)
+		}
+		if raw, err = writeCluster(raw, k, data, c); err != nil {
+			return done(raw), err
+		}
+	}
+	return done(raw), nil
+}
+
+//Only cluster cut by old or new end is recompressed
+func resizeCompressed(i Inode, size int64, c *blockCharge) (Inode, error) {
+	end := i.Size
+	if size < end {
+		end = size
+	}
+	var ks []int64
+	if end%clusterSize != 0 {
+		ks = append(ks, end/clusterSize)
+	}
+	return rewriteClusters(i, size, ks, nil, c)
+}
+
+func writeCompressed(i Inode, off int64, data []byte, c *blockCharge) (Inode, error) {
+	end := off + int64(len(data))
+	size, first := i.Size, off
+	//Old last cluster grows too
+	if end > size {
+		size = end
+		if i.Size < off {
+			first = i.Size
+		}
+	}
+	var ks []int64
+	for k := first / clusterSize; k*clusterSize < end; k++ {
+		//Clusters between old end and write stay holes
+		if k*clusterSize >= i.Size && (k+1)*clusterSize <= off {
+			continue
+		}
+		ks = append(ks, k)
+	}
+	return rewriteClusters(i, size, ks, func(k int64, buf []byte) {
+		if lo, hi := clusterSpan(k, off, end); lo < hi {
+			copy(buf[lo:hi], data[k*clusterSize+lo-off:])
+		}
+	}, c)
+}
+
+//Zeroes range, clusters inside it become holes
+func punchCompressed(i Inode, off, end int64, c *blockCharge) (Inode, error) {
+	var ks []int64
+	for k := off / clusterSize; k*clusterSize < end; k++ {
+		ks = append(ks, k)
+	}
+	return rewriteClusters(i, i.Size, ks, func(k int64, buf []byte) {
+		lo, hi := clusterSpan(k, off, end)
+		for p := lo; p < hi && p < int64(len(buf)); p++ {
+			buf[p] = 0
+		}
+	}, c)
+}
+
+//Turns compression of file on or off converting its contents,
+//for folders only files created later are affected
+func setCompression(iid int64, on bool) error {
+	i := readInode(iid)
+	if (i.Flags&flagCompressed != 0) == on {
+		return nil
+	}
+	if i.Mode == 2 {
+		return errIsSymlink
+	}
+	if i.Mode == 1 {
+		i.Flags ^= flagCompressed
+		writeInode(iid, i)
+		return nil
+	}
+	data := readFile(i)
+	var err error
+	c := newCharge(i)
+	if on {
+		//Blocks become slots, each cluster is recompressed in place
+		i.Stored = i.Size
+		i.Size = 0
+		i.Flags |= flagCompressed
+		i, err = writeCompressed(i, 0, data, c)
+	} else {
+		i.Size = i.Stored
+		i.Flags &^= flagCompressed
+		i.Stored = 0
+		i, err = resizeFile(i, int64(len(data)), c)
+		if err == nil {
+			i, err = writeRaw(i, 0, data, c)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	writeInode(iid, i)
+	return nil
+}
+
+//Shell front-end: compress <path> on|off
+func compressCommand(p, state string) {
+	if state != "on" && state != "off" {
+		fmt.Println("Usage:", shellCommands["compress"].usage)
+		return
+	}
+	_, iid, err := getInodeByPath(p)
+	if err == nil {
+		err = setCompression(iid, state == "on")
+	}
+	if err != nil {
+		log.Println(p, err)
+		return
+	}
+	i := readInode(iid)
+	fmt.Printf("%s : %d bytes stored in %d\n", p, i.Size, keptSize(i))
+}
+
+//Bytes in blocks of file, holes of clusters do not count
+func keptSize(i Inode) int64 {
+	if i.Flags&flagCompressed == 0 {
+		return i.Size
+	}
+	var n int64
+	for _, b := range fileBids(i) {
+		if b != 0 {
+			n += blockSize
+		}
+	}
+	return n
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//-------------------------Crash harness---------------------------
+//Runs workload once recording every writeH, then builds every image power
+//cut could leave: any prefix of writes, last write torn after some sectors,
+//writes of unfinished operation landing in other order. Each image is
+//mounted, checked by fsck and scrub. Operation ends when superblock is
+//written back, so writes of earlier operations are never reordered
+
+//Subsets of unfinished operation are tried when it has at most this many writes,
+//otherwise each write is dropped alone
+const crashSubsetWrites = 6
+
+//Torn points tried per multi-sector write
+const crashTornPoints = 8
+
+//One writeH call
+type deviceWrite struct {
+	Sector int64
+	Data   []byte
+}
+
+//Image left by power cut: writes applied in order, last one maybe cut short
+type crashState struct {
+	Op      int   //Index of operation running when power went out
+	Applied []int //Writes that reached image
+	Torn    int   //Sectors of next write that landed, 0 when none
+	Name    string
+}
+
+//Problems of one crash image
+type crashFinding struct {
+	Op       string   `json:"operation"`
+	State    string   `json:"state"`
+	Problems []string `json:"problems"`
+}
+
+type crashInfo struct {
+	Ops      int            `json:"operations"`
+	Writes   int            `json:"writes"`
+	States   int            `json:"states"`
+	Findings []crashFinding `json:"findings"`
+}
+
+var (
+	deviceLog []deviceWrite
+	recording bool //writeH appends to deviceLog
+)
+
+//Called by writeH after every write reached image
+func recordWrite(sector int64, data []byte) {
+	if recording {
+		deviceLog = append(deviceLog, deviceWrite{sector, append([]byte(nil), data...)})
+	}
+}
+
+//Workload used when no trace is given, touches every operation of shell
+func crashWorkload() []traceRecord {
+	data := make([]byte, blockSize+blockSize/2)
+	for k := range data {
+		data[k] = byte('a' + k%26)
+	}
+	ops := [][]string{
+		{"mkfs", "16", "200000"}, {"mkdir", "d"}, {"cd", "d"}, {"create", "f"}, {"open", "f"},
+		{"write", "0"}, {"truncate", "f", "100"}, {"symlink", "f", "s"}, {"link", "f", "h"},
+		{"rename", "h", "g"}, {"unlink", "g"}, {"close", "0"}, {"cd", "/"}, {"mkdir", "e"}, {"rmdir", "e"},
+	}
+	var res []traceRecord
+	for k, op := range ops {
+		r := traceRecord{Seq: k + 1, Op: op[0], Args: op[1:]}
+		if r.Op == "write" {
+			r.Data, r.Hash = data, hashHex(data)
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+//Runs records after mkfs, returns index of first write of every operation and total
+func recordWorkload(records []traceRecord) ([]int, error) {
+	deviceLog, recording = nil, true
+	defer func() { recording = false }()
+	var starts []int
+	for _, r := range records {
+		starts = append(starts, len(deviceLog))
+		if _, err := replayRecord(r); err != nil {
+			return nil, err
+		}
+		//Operation is done once superblock is back on image
+		umount()
+	}
+	return append(starts, len(deviceLog)), nil
+}
+
+//Every image power cut during operation op could leave
+func crashStates(op, start, end int) []crashState {
+	prefix := func(n int) []int {
+		var res []int
+		for k := 0; k < n; k++ {
+			res = append(res, k)
+		}
+		return res
+	}
+	var res []crashState
+	for k := start; k < end; k++ {
+		res = append(res, crashState{Op: op, Applied: prefix(k), Name: fmt.Sprintf("first %d of %d writes", k-start, end-start)})
+		sectors := int((int64(len(deviceLog[k].Data)) + sectorSize - 1) / sectorSize)
+		step := (sectors + crashTornPoints - 1) / crashTornPoints
+		for t := step; t < sectors; t += step {
+			res = append(res, crashState{Op: op, Applied: prefix(k), Torn: t,
+				Name: fmt.Sprintf("first %d of %d writes, write %d torn after %d of %d sectors", k-start, end-start, k-start+1, t, sectors)})
+		}
+	}
+	n := end - start
+	if n < 2 {
+		return res
+	}
+	var subsets [][]int
+	if n <= crashSubsetWrites {
+		for mask := 1; mask < 1<<n-1; mask++ {
+			//Prefixes were tried above
+			if mask&(mask+1) == 0 {
+				continue
+			}
+			var s []int
+			for k := 0; k < n; k++ {
+				if mask&(1<<k) != 0 {
+					s = append(s, k)
+				}
+			}
+			subsets = append(subsets, s)
+		}
+	} else {
+		for drop := 0; drop < n-1; drop++ {
+			var s []int
+			for k := 0; k < n; k++ {
+				if k != drop {
+					s = append(s, k)
+				}
+			}
+			subsets = append(subsets, s)
+		}
+	}
+	for _, s := range subsets {
+		applied := prefix(start)
+		var names []string
+		for _, k := range s {
+			applied = append(applied, start+k)
+			names = append(names, fmt.Sprint(k+1))
+		}
+		res = append(res, crashState{Op: op, Applied: applied,
+			Name: fmt.Sprintf("writes %s of %d reordered ahead of rest", strings.Join(names, ","), n)})
+	}
+	return res
+}
+
+func buildCrashImage(base []byte, s crashState) []byte {
+	img := append([]byte(nil), base...)
+	apply := func(w deviceWrite, n int) {
+		off := w.Sector * sectorSize
+		if need := off + int64(n); need > int64(len(img)) {
+			img = append(img, make([]byte, need-int64(len(img)))...)
+		}
+		copy(img[off:], w.Data[:n])
+	}
+	for _, k := range s.Applied {
+		apply(deviceLog[k], len(deviceLog[k].Data))
+	}
+	if s.Torn > 0 {
+		apply(deviceLog[len(s.Applied)], s.Torn*int(sectorSize))
+	}
+	return img
+}
+
+//Mounts image at ImagePath, returns what fsck and scrub find
+func checkCrashImage() (problems []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			problems = append(problems, fmt.Sprint("panic: ", r))
+		}
+	}()
+	if _, err := readSuperBlockChecked(); err != nil {
+		return []string{"mount: " + err.Error()}
+	}
+	if err := mountImage(); err != nil {
+		return []string{"mount: " + err.Error()}
+	}
+	for _, v := range fsck() {
+		problems = append(problems, "fsck: "+v)
+	}
+	bad, err := scrub()
+	if err != nil {
+		problems = append(problems, "scrub: "+err.Error())
+	}
+	for _, v := range bad {
+		problems = append(problems, "scrub: "+v.String())
+	}
+	return problems
+}
+
+//Runs workload on scratch images, image in use is mounted again afterwards
+func crashTest(records []traceRecord) (crashInfo, error) {
+	info := crashInfo{Findings: []crashFinding{}}
+	if traceFile != nil {
+		return info, errTracing
+	}
+	if len(records) == 0 || records[0].Op != "mkfs" {
+		return info, fmt.Errorf("workload does not start with mkfs")
+	}
+	dir, err := os.MkdirTemp("", "fscrash")
+	if err != nil {
+		return info, err
+	}
+	defer os.RemoveAll(dir)
+	umount()
+	oldPath, oldOFT, verbose := ImagePath, OFT, Verbose
+	defer func() {
+		ImagePath, OFT, Verbose = oldPath, oldOFT, verbose
+		deviceLog = nil
+		log.SetOutput(os.Stderr)
+		if _, err := os.Stat(ImagePath); err == nil {
+			mount()
+		}
+	}()
+	Verbose = false
+	ImagePath = filepath.Join(dir, "work.bin")
+	if _, err := replayRecord(records[0]); err != nil {
+		return info, err
+	}
+	umount()
+	base, err := os.ReadFile(ImagePath)
+	if err != nil {
+		return info, err
+	}
+	starts, err := recordWorkload(records[1:])
+	if err != nil {
+		return info, err
+	}
+	info.Ops, info.Writes = len(records)-1, len(deviceLog)
+	//Broken images make every read complain
+	log.SetOutput(io.Discard)
+	ImagePath = filepath.Join(dir, "crash.bin")
+	for op := 0; op < info.Ops; op++ {
+		r := records[op+1]
+		opName := strings.TrimSpace(fmt.Sprintf("%d %s %s", r.Seq, r.Op, strings.Join(r.Args, " ")))
+		for _, s := range crashStates(op, starts[op], starts[op+1]) {
+			info.States++
+			if err := os.WriteFile(ImagePath, buildCrashImage(base, s), 0644); err != nil {
+				return info, err
+			}
+			if problems := checkCrashImage(); len(problems) > 0 {
+				info.Findings = append(info.Findings, crashFinding{opName, s.Name, problems})
+			}
+		}
+	}
+	//Image after last operation finished
+	info.States++
+	last := crashState{Applied: make([]int, len(deviceLog))}
+	for k := range last.Applied {
+		last.Applied[k] = k
+	}
+	if err := os.WriteFile(ImagePath, buildCrashImage(base, last), 0644); err != nil {
+		return info, err
+	}
+	if problems := checkCrashImage(); len(problems) > 0 {
+		info.Findings = append(info.Findings, crashFinding{"end", "all writes", problems})
+	}
+	return info, nil
+}
+
+func printCrashReport(info crashInfo) {
+	for _, f := range info.Findings {
+		fmt.Printf("%s, %s:\n", f.Op, f.State)
+		for _, p := range f.Problems {
+			fmt.Println("  ", p)
+		}
+	}
+	fmt.Printf("%d operations, %d writes, %d crash images, %d inconsistent\n",
+		info.Ops, info.Writes, info.States, len(info.Findings))
+}
+
+//Shell front-end: crash [trace]
+func crashCommand(args []string) {
+	records := crashWorkload()
+	if len(args) > 0 {
+		var err error
+		if records, err = readTrace(args[0]); err != nil {
+			log.Println(args[0], err)
+			return
+		}
+	}
+	info, err := crashTest(records)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	printCrashReport(info)
+}
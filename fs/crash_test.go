@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+//Three one-sector writes: every prefix plus every other order of them
+func TestCrashStates(t *testing.T) {
+	deviceLog = []deviceWrite{{1, []byte{1}}, {2, []byte{2}}, {3, []byte{3}}}
+	defer func() { deviceLog = nil }()
+	var got []string
+	for _, s := range crashStates(0, 0, 3) {
+		got = append(got, s.Name)
+	}
+	want := []string{
+		"first 0 of 3 writes", "first 1 of 3 writes", "first 2 of 3 writes",
+		"writes 2 of 3 reordered ahead of rest", "writes 3 of 3 reordered ahead of rest",
+		"writes 1,3 of 3 reordered ahead of rest", "writes 2,3 of 3 reordered ahead of rest",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("states:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+//Torn write lands only its first sectors
+func TestCrashTornWrite(t *testing.T) {
+	data := append(bytes.Repeat([]byte{1}, int(sectorSize)), bytes.Repeat([]byte{2}, int(sectorSize))...)
+	deviceLog = []deviceWrite{{0, data}}
+	defer func() { deviceLog = nil }()
+	img := buildCrashImage(make([]byte, 2*sectorSize), crashState{Torn: 1})
+	if img[0] != 1 || img[sectorSize] != 0 {
+		t.Fatalf("torn write left %d %d", img[0], img[sectorSize])
+	}
+}
+
+//Harness reports nothing for image all writes reached, images cut short are checked too
+func TestCrashHarness(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	records := crashWorkload()[:6]
+	var info crashInfo
+	var err error
+	quiet(t, func() { info, err = crashTest(records) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ops != 5 || info.States <= info.Writes {
+		t.Fatalf("%d operations, %d writes, %d images", info.Ops, info.Writes, info.States)
+	}
+	for _, f := range info.Findings {
+		if f.Op == "end" {
+			t.Fatalf("finished workload inconsistent: %v", f.Problems)
+		}
+	}
+	//Image in use is mounted back untouched
+	if entries, _ := readdirAll(0); len(entries) != 0 {
+		t.Fatalf("image in use changed: %v", entries)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+//-------------------------Encryption---------------------------
+//Blocks (file contents, folders with their names, snapshot tables) are
+//sealed with AES-GCM, key comes from passphrase through scrypt with
+//parameters kept in superblock. Nonce and tag of every block live in
+//table after checksums: [Superblock-Inodes-DataBlocks-Sums-Nonces]
+//All zero blocks stay plain, so blocks never written read back as zeros.
+//Inodes are not sealed: sizes, owners, times and block numbers stay
+//readable, extended attributes go to sealed xattr block instead
+
+const cryptEntrySize = 32 //Nonce and tag of block, padded to fit sectors
+
+//Key of mounted image, nil while image is locked
+var fsKey cipher.AEAD
+
+var (
+	errLocked   = errors.New("image is encrypted, passphrase required")
+	errWrongKey = errors.New("wrong passphrase")
+)
+
+var keyCheckAD = []byte("osfs key check")
+
+func deriveKey(pass string, sb SuperBlock) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(pass), sb.KDFSalt[:], 1<<sb.KDFLogN, int(sb.KDFR), int(sb.KDFP), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Fills KDF fields of new superblock and unlocks image with derived key
+func setupEncryption(sb *SuperBlock, pass string) error {
+	if _, err := rand.Read(sb.KDFSalt[:]); err != nil {
+		return err
+	}
+	sb.KDFLogN, sb.KDFR, sb.KDFP = 15, 8, 1
+	aead, err := deriveKey(pass, *sb)
+	if err != nil {
+		return err
+	}
+	//Tag of empty message tells right key from wrong one
+	copy(sb.KeyCheck[:], aead.Seal(nil, sb.KDFSalt[:aead.NonceSize()], nil, keyCheckAD))
+	sb.Features |= featEncrypted
+	fsKey = aead
+	return nil
+}
+
+//Asks for passphrase of mounted image, image stays locked on error
+func unlockImage() error {
+	fsKey = nil
+	if SB.Features&featEncrypted == 0 {
+		return nil
+	}
+	pass, err := readPassphrase("Passphrase: ")
+	if err != nil {
+		return err
+	}
+	aead, err := deriveKey(pass, SB)
+	if err != nil {
+		return err
+	}
+	if _, err := aead.Open(nil, SB.KDFSalt[:aead.NonceSize()], SB.KeyCheck[:], keyCheckAD); err != nil {
+		return errWrongKey
+	}
+	fsKey = aead
+	return nil
+}
+
+func imageLocked() bool {
+	return SB.Features&featEncrypted != 0 && fsKey == nil
+}
+
+//FS_PASSPHRASE is used by scripts, terminal is asked otherwise
+func readPassphrase(prompt string) (string, error) {
+	if p, ok := os.LookupEnv("FS_PASSPHRASE"); ok {
+		return p, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("passphrase required, set FS_PASSPHRASE")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(p), err
+}
+
+//Passphrase for new image, typed twice on terminal
+func newPassphrase() (string, error) {
+	pass, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", errors.New("empty passphrase")
+	}
+	if _, ok := os.LookupEnv("FS_PASSPHRASE"); !ok {
+		again, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	return pass, nil
+}
+
+//Sector of table holding nonce and tag of block and position inside it
+func cryptEntry(ib int64) (int64, int64) {
+	sumSectors := (SB.BlockTableSize*sumSize + sectorSize - 1) / sectorSize
+	pos := ib * cryptEntrySize
+	return blockSector(SB.BlockTableSize) + sumSectors + pos/sectorSize, pos % sectorSize
+}
+
+func readCryptEntry(ib int64) [cryptEntrySize]byte {
+	sector, pos := cryptEntry(ib)
+	buf := make([]byte, sectorSize)
+	readH(sector, &buf)
+	var entry [cryptEntrySize]byte
+	copy(entry[:], buf[pos:])
+	return entry
+}
+
+func writeCryptEntry(ib int64, entry [cryptEntrySize]byte) {
+	sector, pos := cryptEntry(ib)
+	buf := make([]byte, sectorSize)
+	readH(sector, &buf)
+	copy(buf[pos:], entry[:])
+	writeH(sector, &buf)
+}
+
+//Block id is bound to ciphertext, so blocks can not be swapped
+func blockAD(ib int64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(ib))
+	return ad
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns bytes to be written in place of raw block
+func encryptBlock(ib int64, raw []byte) ([]byte, error) {
+	if SB.Features&featEncrypted == 0 || fsKey == nil {
+		return raw, nil
+	}
+	var entry [cryptEntrySize]byte
+	if !allZero(raw) {
+		ns := fsKey.NonceSize()
+		if _, err := io.ReadFull(rand.Reader, entry[:ns]); err != nil {
+			return nil, fmt.Errorf("block %d nonce: %w", ib, err)
+		}
+		sealed := fsKey.Seal(nil, entry[:ns], raw, blockAD(ib))
+		copy(entry[ns:], sealed[len(raw):])
+		raw = sealed[:len(raw)]
+	}
+	writeCryptEntry(ib, entry)
+	return raw, nil
+}
+
+//Locked image reads zeros, so listings come out empty instead of garbage
+func decryptBlock(ib int64, raw []byte) ([]byte, error) {
+	if SB.Features&featEncrypted == 0 {
+		return raw, nil
+	}
+	entry := readCryptEntry(ib)
+	if entry == [cryptEntrySize]byte{} {
+		if !allZero(raw) {
+			return make([]byte, len(raw)), fmt.Errorf("block %d: %w", ib, errCorrupt)
+		}
+		return raw, nil
+	}
+	if fsKey == nil {
+		return make([]byte, len(raw)), errLocked
+	}
+	ns := fsKey.NonceSize()
+	sealed := append(append([]byte{}, raw...), entry[ns:ns+fsKey.Overhead()]...)
+	plain, err := fsKey.Open(nil, entry[:ns], sealed, blockAD(ib))
+	if err != nil {
+		return make([]byte, len(raw)), fmt.Errorf("block %d: %w", ib, errCorrupt)
+	}
+	return plain, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	t.Setenv("FS_PASSPHRASE", "secret")
+	newTestImage(t, 16, 200*KB, mkfsOptions{Passphrase: "secret"})
+	data := bytes.Repeat([]byte("plain words "), 200)
+	quiet(t, func() {
+		create("hiddenname")
+		open("hiddenname")
+		write(0, &data)
+		close(0)
+	})
+	iid, _, err := lookupPath("/hiddenname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(iid, "user.note", []byte("attrvalue"), 0); err != nil {
+		t.Fatal(err)
+	}
+	quiet(t, umount)
+	image, err := os.ReadFile(ImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(image, []byte("plain words")) || bytes.Contains(image, []byte("hiddenname")) || bytes.Contains(image, []byte("attrvalue")) {
+		t.Fatal("contents, names or attributes stored in clear")
+	}
+
+	//Blocks come back as written with right passphrase
+	if err := mountImage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, inode, err := lookupPath("/hiddenname"); err != nil || !bytes.Equal(readFile(inode), data) {
+		t.Fatalf("/hiddenname after remount: %v", err)
+	}
+
+	//Wrong one leaves image locked: no entries, no writes
+	t.Setenv("FS_PASSPHRASE", "wrong")
+	quiet(t, func() { err = mountImage() })
+	if !errors.Is(err, errWrongKey) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	if !imageLocked() {
+		t.Fatal("image unlocked by wrong passphrase")
+	}
+	var entries []dirEntry
+	quiet(t, func() { entries, _ = readdirAll(0) })
+	if len(entries) != 0 {
+		t.Fatalf("locked image lists %v", entries)
+	}
+	if logged := quiet(t, func() { create("g") }); !strings.Contains(logged, errLocked.Error()) {
+		t.Fatalf("create on locked image logged %q", logged)
+	}
+	after, err := os.ReadFile(ImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, after) {
+		t.Fatal("locked image was written")
+	}
+
+	t.Setenv("FS_PASSPHRASE", "secret")
+	if err := mountImage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupPath("/g"); !errors.Is(err, errNotFound) {
+		t.Fatalf("/g made on locked image: %v", err)
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+//Nonce failure fails write instead of crashing
+func TestEncryptNonceFailure(t *testing.T) {
+	t.Setenv("FS_PASSPHRASE", "secret")
+	newTestImage(t, 16, 200*KB, mkfsOptions{Passphrase: "secret"})
+	quiet(t, func() { create("f") })
+	iid, inode, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := rand.Reader
+	rand.Reader = failReader{}
+	defer func() { rand.Reader = reader }()
+	quiet(t, func() { _, err = writeFile(iid, inode, 0, []byte("data")) })
+	if err == nil {
+		t.Fatal("write sealed block without nonce")
+	}
+}
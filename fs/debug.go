@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"strconv"
+	"unsafe"
+)
+
+//-------------------------Debugger---------------------------
+//Decodes on-disk structures for teaching and debugging: superblock with
+//layout in sectors, inodes, folders, blocks as hex with their owners.
+//Everything is read through usual functions, nothing is written
+
+//Where regions of image start, in sectors
+type imageLayout struct {
+	Inodes int64 `json:"inode_table"`
+	Blocks int64 `json:"blocks"`
+	Sums   int64 `json:"checksum_table"`
+	Nonces int64 `json:"nonce_table,omitempty"`
+	End    int64 `json:"end"`
+}
+
+//Structure using block, Inode is -1 for image tables
+type blockOwner struct {
+	Kind  string `json:"kind"` //folder, file, extent, xattr, snapshot, quota, dedup, free, unknown
+	Inode int64  `json:"inode"`
+	Path  string `json:"path,omitempty"` //Empty for unlinked inodes
+}
+
+type blockDump struct {
+	Index  int64        `json:"index"`
+	Sector int64        `json:"sector"`
+	Sum    string       `json:"checksum"` //ok, bad or none
+	Owners []blockOwner `json:"owners"`
+	Data   []byte       `json:"data"`
+}
+
+type folderEntry struct {
+	Slot  int    `json:"slot"`
+	Name  string `json:"name"`
+	Inode int64  `json:"inode"`
+	Type  string `json:"type"`
+}
+
+func layout() imageLayout {
+	l := imageLayout{Inodes: inodeSector(0), Blocks: blockSector(0)}
+	l.Sums, _ = sumEntry(0)
+	if SB.Features&featEncrypted != 0 {
+		l.Nonces, _ = cryptEntry(0)
+	}
+	l.End = blockSector(SB.BlockTableSize) + tableSectors(SB)
+	return l
+}
+
+func inodeSector(in int64) int64 {
+	offsetSB := int64(math.Ceil(float64(unsafe.Sizeof(SuperBlock{})) / float64(sectorSize)))
+	return offsetSB + in*int64(math.Ceil(float64(unsafe.Sizeof(Inode{}))/float64(sectorSize)))
+}
+
+//Prints every field of struct, byte arrays in hex
+func printFields(v interface{}) {
+	rv := reflect.ValueOf(v)
+	for k := 0; k < rv.NumField(); k++ {
+		f := rv.Field(k)
+		value := fmt.Sprint(f.Interface())
+		if f.Kind() == reflect.Array && f.Type().Elem().Kind() == reflect.Uint8 {
+			value = fmt.Sprintf("%x", f.Interface())
+		}
+		fmt.Printf("%-18s : %s\n", rv.Type().Field(k).Name, value)
+	}
+}
+
+//Paths of inodes reachable from root
+func inodePaths() map[int64]string {
+	inodes, blocks := map[int64]string{0: "/"}, map[int64]string{}
+	scrubOwners(0, "/", inodes, blocks)
+	return inodes
+}
+
+func checkIndex(n, size int64, kind string) error {
+	if n < 0 || n >= size {
+		return fmt.Errorf("%s %d out of range 0..%d", kind, n, size-1)
+	}
+	return nil
+}
+
+//Structures using every block, one pass over tables and inode table
+func allBlockOwners() map[int64][]blockOwner {
+	res := map[int64][]blockOwner{}
+	meta := func(b int64, kind string) { res[b] = append(res[b], blockOwner{Kind: kind, Inode: -1}) }
+	if SB.Snapshots != 0 {
+		meta(SB.Snapshots, "snapshot")
+		for _, rb := range readSnapTable().RefBlocks {
+			if rb != 0 {
+				meta(rb, "snapshot")
+			}
+		}
+	}
+	if SB.Quotas != 0 {
+		meta(SB.Quotas, "quota")
+	}
+	if SB.Dedup != 0 {
+		meta(SB.Dedup, "dedup")
+		for _, rb := range readDedupTable().RefBlocks {
+			if rb != 0 {
+				meta(rb, "dedup")
+			}
+		}
+	}
+	paths := inodePaths()
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		i := readInode(in)
+		owner := func(b int64, kind string) { res[b] = append(res[b], blockOwner{kind, in, paths[in]}) }
+		if i.Mode == 1 {
+			for _, b := range inodeBids(i) {
+				owner(b, "folder")
+			}
+		} else {
+			for _, b := range fileBids(i) {
+				if b != 0 {
+					owner(b, "file")
+				}
+			}
+			if i.Flags&flagExtents != 0 && i.IndirrectPointers != 0 {
+				owner(i.IndirrectPointers, "extent")
+			}
+		}
+		if i.XattrBlock != 0 {
+			owner(i.XattrBlock, "xattr")
+		}
+	}
+	return res
+}
+
+//Kind of block nothing in tables points at
+func unownedKind(ib int64) string {
+	switch {
+	case blockRef(ib) > 0:
+		//Inode table copies and folder copies of snapshots
+		return "snapshot"
+	case blockFree(ib):
+		return "free"
+	default:
+		return "unknown"
+	}
+}
+
+//Every structure pointing at block, image tables first
+func blockOwners(ib int64) []blockOwner {
+	if res := allBlockOwners()[ib]; len(res) > 0 {
+		return res
+	}
+	return []blockOwner{{Kind: unownedKind(ib), Inode: -1}}
+}
+
+func dumpBlock(ib int64, raw bool) (blockDump, error) {
+	if err := checkIndex(ib, SB.BlockTableSize, "block"); err != nil {
+		return blockDump{}, err
+	}
+	d := blockDump{Index: ib, Sector: blockSector(ib), Sum: "none", Owners: blockOwners(ib)}
+	stored := make([]byte, blockSize)
+	readH(d.Sector, &stored)
+	if SB.Features&featChecksums != 0 && readBlockSum(ib) != 0 {
+		d.Sum = "ok"
+		if verifyBlock(ib, stored) != nil {
+			d.Sum = "bad"
+		}
+	}
+	d.Data = stored
+	if !raw {
+		//Decrypted contents, checksum was reported above
+		block, err := readBlockChecked(ib)
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return d, err
+		}
+		d.Data = block.Data[:]
+	}
+	return d, nil
+}
+
+func folderEntries(in int64) ([]folderEntry, error) {
+	if err := checkIndex(in, SB.InodeTableSize, "inode"); err != nil {
+		return nil, err
+	}
+	i := readInode(in)
+	if i.Mode != 1 {
+		return nil, errNotFolder
+	}
+	var res []folderEntry
+	folder := readFolder(inodeBids(i))
+	for k, v := range folder.FileName {
+		if v[0] == 0 {
+			continue
+		}
+		e := folderEntry{Slot: k, Name: entryName(v), Inode: folder.FileInodeID[k], Type: "?"}
+		if e.Inode >= 0 && e.Inode < SB.InodeTableSize {
+			e.Type = inodeType(readInode(e.Inode))
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+func printSuperBlockInfo() {
+	printFields(SB)
+	l := layout()
+	fmt.Printf("Layout (sectors of %d bytes):\n", sectorSize)
+	fmt.Printf("  superblock        : 0\n  inode table       : %d\n  blocks            : %d\n  checksum table    : %d\n",
+		l.Inodes, l.Blocks, l.Sums)
+	if l.Nonces != 0 {
+		fmt.Printf("  nonce table       : %d\n", l.Nonces)
+	}
+	fmt.Printf("  end               : %d\n", l.End)
+}
+
+func printInodeInfo(in int64) error {
+	if err := checkIndex(in, SB.InodeTableSize, "inode"); err != nil {
+		return err
+	}
+	i := readInode(in)
+	fmt.Printf("Inode %d at sector %d, path %q\n", in, inodeSector(in), inodePaths()[in])
+	printFields(i)
+	if i.Mode == 1 {
+		fmt.Printf("Blocks             : %v\n", inodeBids(i))
+	} else {
+		fmt.Printf("Blocks             : %v\n", fileBids(i))
+	}
+	return nil
+}
+
+func printFolderEntries(entries []folderEntry) {
+	for _, e := range entries {
+		fmt.Printf("%3d %-24s %6d %s\n", e.Slot, e.Name, e.Inode, e.Type)
+	}
+}
+
+func printBlockDump(d blockDump) {
+	fmt.Printf("Block %d at sector %d, checksum %s\n", d.Index, d.Sector, d.Sum)
+	for _, o := range d.Owners {
+		if o.Inode < 0 {
+			fmt.Printf("Owner : %s\n", o.Kind)
+			continue
+		}
+		fmt.Printf("Owner : %s of inode %d %s\n", o.Kind, o.Inode, o.Path)
+	}
+	fmt.Print(hex.Dump(d.Data))
+}
+
+func printBlockPath(ib int64) error {
+	if err := checkIndex(ib, SB.BlockTableSize, "block"); err != nil {
+		return err
+	}
+	for _, o := range blockOwners(ib) {
+		switch {
+		case o.Inode < 0:
+			fmt.Println(o.Kind)
+		case o.Path == "":
+			fmt.Printf("inode %d (unlinked) %s\n", o.Inode, o.Kind)
+		default:
+			fmt.Printf("%s %s\n", o.Path, o.Kind)
+		}
+	}
+	return nil
+}
+
+//Shell front-end: debug sb | debug inode|folder|block|path <n> | debug block <n> raw
+func debugCommand(args []string) {
+	mountIfNeeded()
+	if args[0] == "sb" {
+		printSuperBlockInfo()
+		return
+	}
+	if len(args) < 2 {
+		fmt.Println("Usage:", shellCommands["debug"].usage)
+		return
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	switch args[0] {
+	case "inode":
+		err = printInodeInfo(n)
+	case "folder":
+		var entries []folderEntry
+		if entries, err = folderEntries(n); err == nil {
+			printFolderEntries(entries)
+		}
+	case "block":
+		var d blockDump
+		if d, err = dumpBlock(n, len(args) > 2 && args[2] == "raw"); err == nil {
+			printBlockDump(d)
+		}
+	case "path":
+		err = printBlockPath(n)
+	default:
+		fmt.Println("Usage:", shellCommands["debug"].usage)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"strings"
+)
+
+//-------------------------Deduplication---------------------------
+//File blocks with same contents are stored once. Index from SHA-256 of
+//contents to block lives in memory, storeBlock drops blocks it rewrites.
+//One byte count per block in DedupTable tells how many files beyond
+//first hold it, writes copy such block first like snapshot blocks
+
+var dedupMagic = [4]byte{'D', 'D', 'U', 'P'}
+
+//Lives in block SuperBlock.Dedup
+type DedupTable struct {
+	Magic     [4]byte   //Checked by fsck
+	RefBlocks [16]int64 //One byte count of extra holders per data block
+}
+
+//Savings of dedup over files of image
+type dedupInfo struct {
+	Logical  int64 `json:"logical_blocks"`  //Blocks files map
+	Physical int64 `json:"physical_blocks"` //Distinct blocks behind them
+	Shared   int64 `json:"shared_blocks"`   //Blocks held by more than one file
+	Saved    int64 `json:"saved_bytes"`
+}
+
+var (
+	dedupIndex  map[[sha256.Size]byte]int64 //Contents to block, nil until first dedup
+	dedupHashes map[int64][sha256.Size]byte
+)
+
+func readDedupTable() DedupTable {
+	block := readBlock(SB.Dedup)
+	var t DedupTable
+	err := binary.Read(bytes.NewReader(block.Data[:]), binary.BigEndian, &t)
+	if err != nil {
+		log.Println(err)
+	}
+	return t
+}
+
+func writeDedupTable(t DedupTable) {
+	binBuf := new(bytes.Buffer)
+	err := binary.Write(binBuf, binary.BigEndian, t)
+	if err != nil {
+		log.Println(err)
+	}
+	block := Block{}
+	copy(block.Data[:], binBuf.Bytes())
+	storeBlock(SB.Dedup, block, true)
+}
+
+//Allocates table and counts on first merge
+func ensureDedupTable() error {
+	if SB.Dedup != 0 {
+		return nil
+	}
+	n := int(math.Ceil(float64(SB.BlockTableSize) / float64(blockSize)))
+	t := DedupTable{Magic: dedupMagic}
+	if n > len(t.RefBlocks) {
+		return errors.New("image too large for dedup")
+	}
+	tid, err := bget()
+	if err != nil {
+		return err
+	}
+	for k := 0; k < n; k++ {
+		if t.RefBlocks[k], err = bget(); err != nil {
+			ungetBlocks(append([]int64{tid}, t.RefBlocks[:k]...))
+			return err
+		}
+	}
+	SB.Dedup = tid
+	SB.Modified = true
+	writeDedupTable(t)
+	writeDedupCounts(t, nil)
+	return nil
+}
+
+//Stores counts of holders beyond first, count blocks count themselves once
+func writeDedupCounts(t DedupTable, holders map[int64]int) {
+	counts := make([]Block, len(t.RefBlocks))
+	for b, n := range holders {
+		if n > math.MaxUint8+1 {
+			n = math.MaxUint8 + 1
+		}
+		counts[b/blockSize].Data[b%blockSize] = uint8(n - 1)
+	}
+	for _, rb := range t.RefBlocks {
+		if rb != 0 {
+			counts[rb/blockSize].Data[rb%blockSize] = 1
+		}
+	}
+	for k, rb := range t.RefBlocks {
+		if rb != 0 {
+			storeBlock(rb, counts[k], true)
+		}
+	}
+}
+
+//Number of files beyond first holding block
+func dedupRef(ib int64) uint8 {
+	if SB.Dedup == 0 || snapView != nil {
+		return 0
+	}
+	refs := readDedupTable().RefBlocks
+	if ib < 0 || ib/blockSize >= int64(len(refs)) {
+		return 0
+	}
+	rb := refs[ib/blockSize]
+	if rb == 0 {
+		return 0
+	}
+	return readBlock(rb).Data[ib%blockSize]
+}
+
+//Returns new count
+func addDedupRef(ib int64, delta int) uint8 {
+	rb := readDedupTable().RefBlocks[ib/blockSize]
+	block := readBlock(rb)
+	block.Data[ib%blockSize] = uint8(int(block.Data[ib%blockSize]) + delta)
+	storeBlock(rb, block, true)
+	return block.Data[ib%blockSize]
+}
+
+//Block may not change in place, snapshot or other file holds it
+func blockShared(ib int64) bool {
+	return blockRef(ib) > 0 || dedupRef(ib) > 0
+}
+
+//File drops block: other files keep it, snapshots keep it, else it is zeroed
+func releaseBlock(ib int64) {
+	if dedupRef(ib) > 0 {
+		addDedupRef(ib, -1)
+		return
+	}
+	if blockRef(ib) == 0 {
+		writeBlock(ib, Block{})
+	}
+	setBlockUsed(ib, false)
+}
+
+//Called by storeBlock, contents of block change
+func forgetBlock(ib int64) {
+	if h, ok := dedupHashes[ib]; ok {
+		delete(dedupHashes, ib)
+		if dedupIndex[h] == ib {
+			delete(dedupIndex, h)
+		}
+	}
+}
+
+//Data blocks of inode, the only kind dedup shares
+func dedupBids(i Inode) []int64 {
+	if i.Mode == 1 {
+		return nil
+	}
+	return fileBids(i)
+}
+
+//Hashes file blocks of whole inode table, unlinked inodes hold theirs too
+func buildDedupIndex() {
+	dedupIndex = map[[sha256.Size]byte]int64{}
+	dedupHashes = map[int64][sha256.Size]byte{}
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		for _, b := range dedupBids(readInode(in)) {
+			if _, ok := dedupHashes[b]; b == 0 || ok {
+				continue
+			}
+			block := readBlock(b)
+			if block == (Block{}) {
+				continue
+			}
+			h := sha256.Sum256(block.Data[:])
+			dedupHashes[b] = h
+			if _, ok := dedupIndex[h]; !ok {
+				dedupIndex[h] = b
+			}
+		}
+	}
+}
+
+//Points blocks of file iid at equal blocks stored earlier, returns merged count
+func dedupInode(iid int64) (int, error) {
+	if snapView != nil {
+		return 0, errReadOnly
+	}
+	if dedupIndex == nil {
+		buildDedupIndex()
+	}
+	i := readInode(iid)
+	old := dedupBids(i)
+	bids := append([]int64{}, old...)
+	var dropped []int64
+	for k, b := range bids {
+		if b == 0 {
+			continue
+		}
+		block := readBlock(b)
+		if block == (Block{}) {
+			continue
+		}
+		h := sha256.Sum256(block.Data[:])
+		x, ok := dedupIndex[h]
+		if !ok || x == b {
+			dedupIndex[h], dedupHashes[b] = b, h
+			continue
+		}
+		//Hash alone is not trusted, count byte must not wrap
+		if readBlock(x) != block || dedupRef(x) == math.MaxUint8 {
+			continue
+		}
+		if err := ensureDedupTable(); err != nil {
+			return 0, err
+		}
+		//Count goes up before inode points at block, crash leaks at worst
+		addDedupRef(x, 1)
+		bids[k] = x
+		dropped = append(dropped, b)
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+	if err := setFileBids(&i, bids, newCharge(i)); err != nil {
+		for k, b := range bids {
+			if b != old[k] {
+				addDedupRef(b, -1)
+			}
+		}
+		return 0, err
+	}
+	writeInode(iid, i)
+	for _, b := range dropped {
+		releaseBlock(b)
+	}
+	return len(dropped), nil
+}
+
+//Merges equal blocks of every file under folder or of one file
+func dedupTree(p string) (int, error) {
+	entries, err := reachableInodes(p)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, iid := range entries {
+		n, err := dedupInode(iid)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+//Holders of every file block over whole inode table
+func blockHolders() map[int64]int {
+	holders := map[int64]int{}
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		for _, b := range dedupBids(readInode(in)) {
+			if b != 0 {
+				holders[b]++
+			}
+		}
+	}
+	return holders
+}
+
+func dedupReport() dedupInfo {
+	var info dedupInfo
+	for _, n := range blockHolders() {
+		info.Logical += int64(n)
+		info.Physical++
+		if n > 1 {
+			info.Shared++
+		}
+	}
+	info.Saved = (info.Logical - info.Physical) * blockSize
+	return info
+}
+
+//Frees table and counts, resize lays them out again with recountDedup
+func dropDedupTable() {
+	if SB.Dedup == 0 {
+		return
+	}
+	t := readDedupTable()
+	for _, rb := range t.RefBlocks {
+		if rb != 0 {
+			storeBlock(rb, Block{}, false)
+			setBlockUsed(rb, false)
+		}
+	}
+	storeBlock(SB.Dedup, Block{}, false)
+	setBlockUsed(SB.Dedup, false)
+	SB.Dedup = 0
+	SB.Modified = true
+}
+
+//Sets counts from holders in inode table
+func recountDedup() error {
+	holders := blockHolders()
+	shared := false
+	for _, n := range holders {
+		shared = shared || n > 1
+	}
+	if SB.Dedup == 0 && !shared {
+		return nil
+	}
+	if err := ensureDedupTable(); err != nil {
+		return err
+	}
+	writeDedupCounts(readDedupTable(), holders)
+	return nil
+}
+
+func setDedupMode(on bool) {
+	if on {
+		SB.Features |= featDedup
+	} else {
+		SB.Features &^= featDedup
+	}
+	SB.Modified = true
+}
+
+func printDedupReport(info dedupInfo) {
+	fmt.Printf("Logical : %d blocks\nPhysical : %d blocks\nShared : %d blocks\nSaved : %d bytes\nInline : %t\n",
+		info.Logical, info.Physical, info.Shared, info.Saved, SB.Features&featDedup != 0)
+}
+
+//Shell front-end: dedup on|off|report|run [path]
+func dedupCommand(args []string) {
+	mountIfNeeded()
+	switch args[0] {
+	case "on", "off":
+		setDedupMode(args[0] == "on")
+	case "report":
+		printDedupReport(dedupReport())
+	case "run":
+		p := "/"
+		if len(args) > 1 {
+			p = args[1]
+		}
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join(CWD, p)
+		}
+		n, err := dedupTree(p)
+		if err != nil {
+			log.Println(p, err)
+		}
+		fmt.Printf("Merged %d blocks\n", n)
+	default:
+		fmt.Println("Usage:", shellCommands["dedup"].usage)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+//-------------------------Defragmentation---------------------------
+//Fragment is run of consecutive blocks, holes end runs like extents do.
+//Defrag copies file into free run, stores inode, then frees old blocks:
+//interrupted defrag may leak copied blocks but never loses data
+
+//Fragmentation of one file or folder
+type fragLine struct {
+	Path   string `json:"path"`
+	Blocks int    `json:"blocks"`
+	Runs   int    `json:"runs"`
+	After  int    `json:"runs_after,omitempty"` //Set by defrag
+	Note   string `json:"note,omitempty"`       //Why defrag skipped entry
+}
+
+//Free space map summary
+type freeInfo struct {
+	Blocks  int64 `json:"free_blocks"`
+	Runs    int64 `json:"free_runs"`
+	Largest int64 `json:"largest_free_run"`
+}
+
+//Runs of data blocks in block list
+func blockRuns(bids []int64) int {
+	n := 0
+	for _, e := range toExtents(bids) {
+		if e.Start != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+//Folders have no holes, block 0 of root is real
+func folderRuns(bids []int64) int {
+	n := 0
+	for k, b := range bids {
+		if k == 0 || b != bids[k-1]+1 {
+			n++
+		}
+	}
+	return n
+}
+
+func dataBlocks(bids []int64) int {
+	n := 0
+	for _, b := range bids {
+		if b != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+//Inodes reachable from absolute path prefix, by their paths
+func reachableInodes(prefix string) (map[string]int64, error) {
+	res := map[string]int64{}
+	iid, _, err := lookupPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	var walk func(iid int64, p string)
+	walk = func(iid int64, p string) {
+		if seen[iid] {
+			return
+		}
+		seen[iid] = true
+		res[p] = iid
+		i := readInode(iid)
+		if i.Mode != 1 {
+			return
+		}
+		folder := readFolder(inodeBids(i))
+		for k, v := range folder.FileName {
+			if v[0] == 0 || entryName(v) == ".." {
+				continue
+			}
+			if id := folder.FileInodeID[k]; id >= 0 && id < SB.InodeTableSize {
+				walk(id, path.Join(p, entryName(v)))
+			}
+		}
+	}
+	walk(iid, path.Clean(prefix))
+	return res, nil
+}
+
+//Fragmentation of every entry under prefix, sorted by path
+func fragReport(prefix string) ([]fragLine, error) {
+	entries, err := reachableInodes(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var res []fragLine
+	for p, iid := range entries {
+		i := readInode(iid)
+		if i.Mode == 1 {
+			res = append(res, fragLine{Path: p, Blocks: len(inodeBids(i)), Runs: folderRuns(inodeBids(i))})
+			continue
+		}
+		bids := fileBids(i)
+		res = append(res, fragLine{Path: p, Blocks: dataBlocks(bids), Runs: blockRuns(bids)})
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Path < res[b].Path })
+	return res, nil
+}
+
+//Blocks defrag may take, free in allocation map and held by no file
+func freeBlocks() map[int64]bool {
+	used := usedBlocks()
+	free := map[int64]bool{}
+	for k := int64(1); k < SB.BlockTableSize; k++ {
+		if !used[k] && blockFree(k) {
+			free[k] = true
+		}
+	}
+	return free
+}
+
+func freeSpace() freeInfo {
+	free := freeBlocks()
+	var info freeInfo
+	var run int64
+	for k := int64(1); k <= SB.BlockTableSize; k++ {
+		if k < SB.BlockTableSize && free[k] {
+			run++
+			continue
+		}
+		if run > 0 {
+			info.Blocks += run
+			info.Runs++
+			if run > info.Largest {
+				info.Largest = run
+			}
+		}
+		run = 0
+	}
+	return info
+}
+
+//First run of n free blocks, 0 when there is none
+func findFreeRun(free map[int64]bool, n int) int64 {
+	run := 0
+	for k := int64(1); k < SB.BlockTableSize; k++ {
+		if !free[k] {
+			run = 0
+			continue
+		}
+		run++
+		if run == n {
+			return k - int64(n) + 1
+		}
+	}
+	return 0
+}
+
+//Moves file iid into one run of blocks, returns why it was skipped
+func defragFile(iid int64, free map[int64]bool) (string, error) {
+	i := readInode(iid)
+	bids := fileBids(i)
+	n := dataBlocks(bids)
+	for _, b := range bids {
+		if b != 0 && blockShared(b) {
+			return "shared", nil
+		}
+	}
+	start := findFreeRun(free, n)
+	if start == 0 {
+		return "no free run", nil
+	}
+	moved := make([]int64, len(bids))
+	next := start
+	for k, b := range bids {
+		if b == 0 {
+			continue
+		}
+		block, err := readBlockChecked(b)
+		if err != nil {
+			return "", err
+		}
+		storeBlock(next, block, readBlockSum(b) != 0)
+		setBlockUsed(next, true)
+		delete(free, next)
+		moved[k] = next
+		next++
+	}
+	//Extent block is written fresh too, old one stays valid until inode is stored
+	oldExt := i.IndirrectPointers
+	if i.Flags&flagExtents != 0 {
+		i.IndirrectPointers = 0
+	}
+	//Copies may have taken block bget was about to give out
+	if !blockFree(SB.NextFreeBlockIndex) {
+		SB.NextFreeBlockIndex = firstFreeBlock()
+		SB.Modified = true
+	}
+	if err := setFileBids(&i, moved, newCharge(i)); err != nil {
+		return "", err
+	}
+	delete(free, i.IndirrectPointers)
+	writeInode(iid, i)
+	for _, b := range bids {
+		if b != 0 {
+			storeBlock(b, Block{}, false)
+			setBlockUsed(b, false)
+			free[b] = true
+		}
+	}
+	if oldExt != 0 && oldExt != i.IndirrectPointers && i.Flags&flagExtents != 0 && blockRef(oldExt) == 0 {
+		storeBlock(oldExt, Block{}, false)
+		setBlockUsed(oldExt, false)
+		free[oldExt] = true
+	}
+	return "", nil
+}
+
+//Makes every fragmented file under prefix contiguous where free space allows
+func defrag(prefix string) ([]fragLine, error) {
+	if snapView != nil {
+		return nil, errReadOnly
+	}
+	if imageLocked() {
+		return nil, errLocked
+	}
+	lines, err := fragReport(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := reachableInodes(prefix)
+	free := freeBlocks()
+	var res []fragLine
+	for _, l := range lines {
+		i := readInode(entries[l.Path])
+		if i.Mode == 1 || l.Runs <= 1 {
+			continue
+		}
+		if l.Note, err = defragFile(entries[l.Path], free); err != nil {
+			return res, fmt.Errorf("%s: %w", l.Path, err)
+		}
+		l.After = blockRuns(fileBids(readInode(entries[l.Path])))
+		res = append(res, l)
+	}
+	return res, nil
+}
+
+func printFragReport(lines []fragLine, info freeInfo) {
+	fragmented := 0
+	fmt.Printf("%-32s %8s %6s\n", "Path", "Blocks", "Runs")
+	for _, l := range lines {
+		if l.Runs > 1 {
+			fragmented++
+		}
+		fmt.Printf("%-32s %8d %6d\n", l.Path, l.Blocks, l.Runs)
+	}
+	fmt.Printf("Fragmented : %d of %d\nFree : %d blocks in %d runs, largest %d\n",
+		fragmented, len(lines), info.Blocks, info.Runs, info.Largest)
+}
+
+func printDefrag(lines []fragLine) {
+	for _, l := range lines {
+		if l.Note != "" {
+			fmt.Printf("%s : %d runs, skipped (%s)\n", l.Path, l.Runs, l.Note)
+			continue
+		}
+		fmt.Printf("%s : %d runs -> %d\n", l.Path, l.Runs, l.After)
+	}
+}
+
+//Shell front-end: frag [path], defrag [path]
+func fragCommand(op string, args []string) {
+	mountIfNeeded()
+	p := CWD
+	if len(args) > 0 {
+		p = args[0]
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(CWD, p)
+	}
+	var lines []fragLine
+	var err error
+	if op == "defrag" {
+		if lines, err = defrag(p); err == nil {
+			printDefrag(lines)
+		}
+	} else if lines, err = fragReport(p); err == nil {
+		printFragReport(lines, freeSpace())
+	}
+	if err != nil {
+		log.Println(p, err)
+	}
+}
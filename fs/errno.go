@@ -0,0 +1,48 @@
+package main
+
+import "errors"
+
+//-------------------------Error numbers---------------------------
+//One table for FUSE, 9P and WebDAV, so front-ends do not drift apart.
+//Numbers are Linux ones, 9P clients expect them whatever host we run on
+//and FUSE is built on Linux only. Errors wrapped with %w match too
+
+var errnoTable = []struct {
+	err   error
+	errno uint32
+}{
+	{errNotFound, p9ENOENT},
+	{errNameTooLong, p9ENAMETOOLONG},
+	{errBadName, p9EINVAL},
+	{errFolderFull, p9ENOSPC},
+	{errNoSpace, p9ENOSPC},
+	{errFileTooBig, p9EFBIG},
+	{errExists, p9EEXIST},
+	{errNotFolder, p9ENOTDIR},
+	{errIsFolder, p9EISDIR},
+	{errNotEmpty, p9ENOTEMPTY},
+	{errMoveInside, p9EINVAL},
+	{errCrossLink, p9EXDEV},
+	{errNoData, p9ENXIO},
+	{errNoAttr, p9ENODATA},
+	{errBadNamespace, p9EOPNOTSUPP},
+	{errAttrTooBig, p9ENOSPC},
+	{errQuota, p9EDQUOT},
+}
+
+//Zero for nil, EIO for errors not in table
+func errnoOf(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	for _, e := range errnoTable {
+		if errors.Is(err, e.err) {
+			return e.errno
+		}
+	}
+	var pe p9Error
+	if errors.As(err, &pe) {
+		return uint32(pe)
+	}
+	return p9EIO
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+)
+
+//-------------------------Extents---------------------------
+//Inode with flagExtents keeps (start, length) pairs of block runs in
+//DirrectPointers, runs that do not fit go to block IndirrectPointers.
+//fileBids expands runs, so readers work on both formats
+
+const extentMagic = 'E' //First byte of extent block, checked by fsck
+
+//Runs in inode and in extent block (after 8 byte header)
+const inlineExtents = 6
+const blockExtents = int(blockSize)/16 - 1
+
+//Longest block list of file (4G), damaged extents may claim any length
+const maxFileBlocks = 1 << 20
+
+type extent struct {
+	Start  int64
+	Length int64
+}
+
+func (e extent) String() string {
+	return fmt.Sprintf("%d+%d", e.Start, e.Length)
+}
+
+func readExtents(i Inode) []extent {
+	var res []extent
+	for k := 0; k < inlineExtents; k++ {
+		e := extent{i.DirrectPointers[2*k], i.DirrectPointers[2*k+1]}
+		if e.Length == 0 {
+			return res
+		}
+		res = append(res, e)
+	}
+	if i.IndirrectPointers == 0 {
+		return res
+	}
+	block := readBlock(i.IndirrectPointers)
+	for k := 0; k < blockExtents; k++ {
+		off := 8 + 16*k
+		e := extent{int64(binary.BigEndian.Uint64(block.Data[off:])), int64(binary.BigEndian.Uint64(block.Data[off+8:]))}
+		if e.Length == 0 {
+			break
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+//Joins consecutive blocks into runs, holes make runs starting at 0
+func toExtents(bids []int64) []extent {
+	var res []extent
+	for _, b := range bids {
+		if n := len(res); n > 0 && (res[n-1].Start == 0) == (b == 0) &&
+			(b == 0 || res[n-1].Start+res[n-1].Length == b) {
+			res[n-1].Length++
+			continue
+		}
+		res = append(res, extent{b, 1})
+	}
+	return res
+}
+
+func extentBids(i Inode) []int64 {
+	var res []int64
+	for _, e := range readExtents(i) {
+		for k := int64(0); k < e.Length && len(res) < maxFileBlocks; k++ {
+			if e.Start == 0 {
+				res = append(res, 0)
+			} else {
+				res = append(res, e.Start+k)
+			}
+		}
+	}
+	return res
+}
+
+//Releases extent block unless snapshot holds it
+func dropExtentBlock(i *Inode) {
+	if i.IndirrectPointers == 0 {
+		return
+	}
+	if blockRef(i.IndirrectPointers) == 0 {
+		storeBlock(i.IndirrectPointers, Block{}, false)
+	}
+	setBlockUsed(i.IndirrectPointers, false)
+	i.IndirrectPointers = 0
+}
+
+//Stores runs in inode and extent block, inode itself is not written
+func setExtents(i *Inode, exts []extent, c *blockCharge) error {
+	if len(exts) > inlineExtents+blockExtents {
+		return errFileTooBig
+	}
+	//Shared extent block is copied like any other
+	if len(exts) > inlineExtents && (i.IndirrectPointers == 0 || blockRef(i.IndirrectPointers) > 0) {
+		bid, err := allocBlock(c, 0)
+		if err != nil {
+			return err
+		}
+		i.IndirrectPointers = bid
+	}
+	i.DirrectPointers = [12]int64{}
+	for k := 0; k < len(exts) && k < inlineExtents; k++ {
+		i.DirrectPointers[2*k] = exts[k].Start
+		i.DirrectPointers[2*k+1] = exts[k].Length
+	}
+	if len(exts) <= inlineExtents {
+		dropExtentBlock(i)
+		return nil
+	}
+	block := Block{}
+	block.Data[0] = extentMagic
+	for k, e := range exts[inlineExtents:] {
+		off := 8 + 16*k
+		binary.BigEndian.PutUint64(block.Data[off:], uint64(e.Start))
+		binary.BigEndian.PutUint64(block.Data[off+8:], uint64(e.Length))
+	}
+	storeBlock(i.IndirrectPointers, block, true)
+	return nil
+}
+
+//Maps file onto given blocks in format of inode
+func setFileBids(i *Inode, bids []int64, c *blockCharge) error {
+	if i.Flags&flagExtents != 0 {
+		return setExtents(i, toExtents(bids), c)
+	}
+	if len(bids) > len(i.DirrectPointers) {
+		return errFileTooBig
+	}
+	i.DirrectPointers = [12]int64{}
+	copy(i.DirrectPointers[:], bids)
+	return nil
+}
+
+//Switches file between block pointers and extents, blocks stay in place
+func setExtentFormat(iid int64, on bool) error {
+	i := readInode(iid)
+	if (i.Flags&flagExtents != 0) == on {
+		return nil
+	}
+	if i.Mode == 1 {
+		return errIsFolder
+	}
+	bids := append([]int64{}, fileBids(i)...)
+	conv := i
+	conv.Flags ^= flagExtents
+	if !on {
+		if len(bids) > len(i.DirrectPointers) {
+			return errFileTooBig
+		}
+		dropExtentBlock(&conv)
+	}
+	if err := setFileBids(&conv, bids, newCharge(conv)); err != nil {
+		return err
+	}
+	writeInode(iid, conv)
+	return nil
+}
+
+//Free block is not in allocation map and held by no snapshot or deduplicated file
+func blockFree(ib int64) bool {
+	return ib >= 0 && ib < SB.BlockTableSize && !blockUsed(ib) && blockRef(ib) == 0 && dedupRef(ib) == 0
+}
+
+//Takes goal block when free, so files grow in contiguous runs
+func bgetNear(goal int64) (int64, error) {
+	if goal > 0 && goal < SB.BlockTableSize && goal != SB.NextFreeBlockIndex && blockFree(goal) {
+		SB.Modified = true
+		setBlockUsed(goal, true)
+		debugln("bgetNear RESULT", goal)
+		return goal, nil
+	}
+	return bget()
+}
+
+func formatExtents(i Inode) string {
+	var s []string
+	for _, e := range readExtents(i) {
+		s = append(s, e.String())
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+//Shell front-end: extents <path> on|off
+func extentsCommand(p, state string) {
+	if state != "on" && state != "off" {
+		fmt.Println("Usage:", shellCommands["extents"].usage)
+		return
+	}
+	_, iid, err := getInodeByPath(p)
+	if err == nil {
+		err = setExtentFormat(iid, state == "on")
+	}
+	if err != nil {
+		log.Println(p, err)
+		return
+	}
+	i := readInode(iid)
+	if i.Flags&flagExtents != 0 {
+		fmt.Printf("%s : extents %s\n", p, formatExtents(i))
+	} else {
+		fmt.Printf("%s : blocks %v\n", p, fileBids(i))
+	}
+}
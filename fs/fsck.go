@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+)
+
+//-------------------------Fsck---------------------------
+//Structural check of image: geometry of superblock, every pointer of
+//inodes reachable from root in range, no block owned by two inodes,
+//link counts matching names found in folders, .. naming folder it was
+//reached from. Second pass looks the other way, from tables to tree:
+//allocated inodes no folder names and used blocks no inode holds.
+//Contents are verified by scrub, not here
+
+//Sectors taken by tables after data blocks
+func tableSectors(sb SuperBlock) int64 {
+	n := (sb.BlockTableSize*sumSize + sectorSize - 1) / sectorSize
+	if sb.Features&featEncrypted != 0 {
+		n += (sb.BlockTableSize*cryptEntrySize + sectorSize - 1) / sectorSize
+	}
+	return n
+}
+
+//Superblock sizes fit image, damaged ones would send loops past its end
+func checkGeometry(sb SuperBlock) error {
+	if sb.InodeTableSize <= 0 || sb.InodeTableSize > sb.FsSize/sectorSize ||
+		sb.BlockTableSize <= 0 || sb.BlockTableSize > sb.FsSize/blockSize {
+		return fmt.Errorf("superblock: %d inodes and %d blocks do not fit %d bytes", sb.InodeTableSize, sb.BlockTableSize, sb.FsSize)
+	}
+	for _, b := range []int64{sb.Snapshots, sb.Quotas, sb.Dedup} {
+		if b < 0 || b >= sb.BlockTableSize {
+			return fmt.Errorf("superblock: table block %d out of range", b)
+		}
+	}
+	return nil
+}
+
+//Returns problems found, empty for consistent image
+func fsck() []string {
+	verbose := Verbose
+	Verbose = false
+	defer func() { Verbose = verbose }()
+	//Quota counters are recounted from table checked here
+	quotaUsers, quotaGroups = nil, nil
+
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if info, err := os.Stat(ImagePath); err != nil {
+		report("%s", err)
+	} else if info.Size() != SB.FsSize {
+		report("superblock size %d, image file %d bytes", SB.FsSize, info.Size())
+	}
+	if end := (blockSector(SB.BlockTableSize) + tableSectors(SB)) * sectorSize; end > SB.FsSize {
+		report("tables end at byte %d, past image size %d", end, SB.FsSize)
+	}
+	if SB.NextFreeBlockIndex < 0 || SB.NextFreeBlockIndex >= SB.BlockTableSize {
+		report("next free block %d out of range", SB.NextFreeBlockIndex)
+	}
+	if SB.NextFreeInodeIndex < 0 || SB.NextFreeInodeIndex >= SB.InodeTableSize {
+		report("next free inode %d out of range", SB.NextFreeInodeIndex)
+	}
+	owners := map[int64]string{}
+	holders := map[int64]int{}
+	claim := func(b int64, owner string) {
+		if b < 0 || b >= SB.BlockTableSize {
+			report("%s: block %d out of range", owner, b)
+			return
+		}
+		holders[b]++
+		//Deduplicated blocks count files beyond first
+		if other, ok := owners[b]; ok && holders[b] > int(dedupRef(b))+1 {
+			report("block %d used by %s and %s", b, other, owner)
+			return
+		}
+		owners[b] = owner
+	}
+	magic := func(b int64, m byte, owner, kind string) {
+		claim(b, owner)
+		if b > 0 && b < SB.BlockTableSize && readBlock(b).Data[0] != m {
+			report("%s: %s block %d has no magic", owner, kind, b)
+		}
+	}
+	if SB.Quotas != 0 {
+		magic(SB.Quotas, quotaMagic[0], "quota table", "quota")
+	}
+	if SB.Dedup != 0 {
+		magic(SB.Dedup, dedupMagic[0], "dedup table", "dedup")
+		for _, rb := range readDedupTable().RefBlocks {
+			if rb != 0 {
+				claim(rb, "dedup table")
+			}
+		}
+	}
+	if SB.Snapshots != 0 && (SB.Snapshots < 0 || SB.Snapshots >= SB.BlockTableSize) {
+		report("snapshot table %d out of range", SB.Snapshots)
+	}
+	seen := map[int64]bool{}
+	names := map[int64]int{}
+	paths := map[int64]string{}
+	var walk func(iid, parent int64, p string)
+	walk = func(iid, parent int64, p string) {
+		if seen[iid] {
+			//Files may have more names, folders only one
+			if readInode(iid).Mode == 1 {
+				report("%s: folder inode %d already reached as %s, folder cycle", p, iid, paths[iid])
+			}
+			return
+		}
+		seen[iid] = true
+		paths[iid] = p
+		i := readInode(iid)
+		switch i.Mode {
+		case 0, 2:
+			n := int(math.Ceil(float64(storedSize(i)) / float64(blockSize)))
+			if n > maxFileBlocks {
+				report("%s: size %d over limit", p, storedSize(i))
+				return
+			}
+			bids := fileBids(i)
+			if len(bids) < n {
+				report("%s: %d blocks mapped, size needs %d", p, len(bids), n)
+			}
+			for _, b := range bids {
+				if b != 0 {
+					claim(b, p)
+				}
+			}
+			if i.Flags&flagExtents != 0 && i.IndirrectPointers != 0 {
+				magic(i.IndirrectPointers, extentMagic, p, "extent")
+			}
+		case 1:
+			for _, b := range inodeBids(i) {
+				claim(b, p)
+			}
+		default:
+			report("%s: inode %d has mode %d", p, iid, i.Mode)
+			return
+		}
+		if i.XattrBlock != 0 {
+			magic(i.XattrBlock, xattrMagic, p, "xattr")
+		}
+		if i.Mode != 1 {
+			return
+		}
+		folder := readFolder(inodeBids(i))
+		//Root has no .., unlinked open folder no parent to match
+		if _, ok := folderLookup("..", folder); !ok && iid != 0 && parent >= 0 {
+			report("%s: folder has no ..", p)
+		}
+		for k, v := range folder.FileName {
+			name := entryName(v)
+			if v[0] == 0 {
+				continue
+			}
+			id := folder.FileInodeID[k]
+			if id < 0 || id >= SB.InodeTableSize {
+				report("%s: entry %s points to inode %d out of range", p, name, id)
+				continue
+			}
+			if name == ".." {
+				if readInode(id).Mode != 1 {
+					report("%s: .. points to inode %d which is not folder", p, id)
+				} else if parent >= 0 && id != parent {
+					report("%s: .. points to inode %d, folder is in inode %d", p, id, parent)
+				}
+				continue
+			}
+			names[id]++
+			walk(id, iid, path.Join(p, name))
+		}
+	}
+	walk(0, 0, "/")
+	//Unlinked inodes kept for open descriptors hold their blocks until close
+	for _, id := range sortedIDs(orphans) {
+		walk(id, -1, fmt.Sprintf("unlinked inode %d", id))
+	}
+	var ids []int64
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	for _, id := range ids {
+		//Older images keep no count
+		if i := readInode(id); i.Nlink != 0 && int(i.Nlink) != names[id] {
+			report("%s: inode %d has %d links, %d names", paths[id], id, i.Nlink, names[id])
+		}
+	}
+
+	//Second pass: tables against what tree holds
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		if !seen[in] && !inodeFree(readInode(in)) {
+			report("inode %d is allocated, no folder names it", in)
+		}
+	}
+	for b := int64(0); b < SB.BlockTableSize; b++ {
+		//Snapshots hold blocks of their own, counted in their table
+		if blockRef(b) > 0 {
+			continue
+		}
+		owner, held := owners[b]
+		switch {
+		case held && blockFree(b):
+			report("block %d used by %s is free to allocate", b, owner)
+		case !held && blockUsed(b):
+			report("block %d is marked used, nothing holds it", b)
+		}
+	}
+	return problems
+}
+
+//Keys of inode set in increasing order
+func sortedIDs(set map[int64]bool) []int64 {
+	var ids []int64
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	return ids
+}
+
+//Shell front-end: fsck
+func fsckImage() {
+	mountIfNeeded()
+	problems := fsck()
+	for _, v := range problems {
+		log.Println(v)
+	}
+	fmt.Printf("Fsck finished, %d problems\n", len(problems))
+}
@@ -0,0 +1,431 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+//-------------------------FUSE layer---------------------------
+//Exposes image to host kernel, every request is mapped onto
+//inode and folder operations of the simulator
+
+type fuseNode struct {
+	fs.Inode
+	iid int64
+}
+
+var _ = (fs.NodeGetattrer)((*fuseNode)(nil))
+var _ = (fs.NodeSetattrer)((*fuseNode)(nil))
+var _ = (fs.NodeLookuper)((*fuseNode)(nil))
+var _ = (fs.NodeReaddirer)((*fuseNode)(nil))
+var _ = (fs.NodeOpener)((*fuseNode)(nil))
+var _ = (fs.NodeReader)((*fuseNode)(nil))
+var _ = (fs.NodeWriter)((*fuseNode)(nil))
+var _ = (fs.NodeCreater)((*fuseNode)(nil))
+var _ = (fs.NodeMkdirer)((*fuseNode)(nil))
+var _ = (fs.NodeUnlinker)((*fuseNode)(nil))
+var _ = (fs.NodeRmdirer)((*fuseNode)(nil))
+var _ = (fs.NodeRenamer)((*fuseNode)(nil))
+var _ = (fs.NodeSymlinker)((*fuseNode)(nil))
+var _ = (fs.NodeReadlinker)((*fuseNode)(nil))
+var _ = (fs.NodeLinker)((*fuseNode)(nil))
+var _ = (fs.NodeLseeker)((*fuseNode)(nil))
+var _ = (fs.NodeAllocater)((*fuseNode)(nil))
+var _ = (fs.NodeGetxattrer)((*fuseNode)(nil))
+var _ = (fs.NodeSetxattrer)((*fuseNode)(nil))
+var _ = (fs.NodeRemovexattrer)((*fuseNode)(nil))
+var _ = (fs.NodeListxattrer)((*fuseNode)(nil))
+
+//Mounts image at host dir and serves it until unmounted (or Ctrl-C)
+func fuseMount(dir string) {
+	if err := checkNotTracing(); err != nil {
+		log.Println(err)
+		return
+	}
+	mountIfNeeded()
+	opts := &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      ImagePath,
+			Name:        "osfs",
+			DirectMount: true,
+		},
+	}
+	//Kernel refuses writes to mounted snapshot
+	if snapView != nil {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	server, err := fs.Mount(dir, &fuseNode{iid: 0}, opts)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("Mounted at %s, unmount it or press Ctrl-C to return\n", dir)
+
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{}, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			server.Unmount()
+		case <-done:
+		}
+	}()
+	server.Wait()
+	signal.Stop(sig)
+	done <- struct{}{}
+
+	//Persist superblock changes made by allocations
+	umount()
+}
+
+func fuseMode(i Inode) uint32 {
+	switch i.Mode {
+	case 1:
+		return fuse.S_IFDIR
+	case 2:
+		return fuse.S_IFLNK
+	default:
+		return fuse.S_IFREG
+	}
+}
+
+func fuseErrno(err error) syscall.Errno {
+	return syscall.Errno(errnoOf(err))
+}
+
+func fuseFillAttr(iid int64, i Inode, out *fuse.Attr) {
+	out.Ino = uint64(iid) + 1
+	out.Size = uint64(i.Size)
+	out.Blocks = uint64(len(inodeBlocks(i))) * uint64(blockSize/512)
+	out.Blksize = uint32(blockSize)
+	out.Nlink = inodeNlink(i)
+	out.Owner = fuse.Owner{Uid: i.Uid, Gid: i.Gid}
+	out.Mode = fuseMode(i) | inodePerm(i)
+	out.Mtime = uint64(i.Mtime)
+	out.Ctime = uint64(i.Mtime)
+	out.Atime = uint64(i.Mtime)
+}
+
+//New inodes belong to calling process, shell user when it is unknown
+func fuseOwner(ctx context.Context) (uint32, uint32) {
+	if c, ok := fuse.FromContext(ctx); ok {
+		return c.Uid, c.Gid
+	}
+	return curUid, curGid
+}
+
+//Creates kernel side inode for simulator inode
+func (n *fuseNode) child(ctx context.Context, iid int64, out *fuse.EntryOut) *fs.Inode {
+	inode := readInode(iid)
+	fuseFillAttr(iid, inode, &out.Attr)
+	return n.NewInode(ctx, &fuseNode{iid: iid}, fs.StableAttr{Mode: fuseMode(inode), Ino: uint64(iid) + 1})
+}
+
+//Checks that name can be added to folder of n
+func (n *fuseNode) checkNew(name string) (Inode, syscall.Errno) {
+	dir := readInode(n.iid)
+	return dir, fuseErrno(checkNewEntry(dir, name))
+}
+
+func (n *fuseNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	fuseFillAttr(n.iid, readInode(n.iid), &out.Attr)
+	return 0
+}
+
+//Size, permissions, owners and modification time can be changed
+func (n *fuseNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode := readInode(n.iid)
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		if !uok {
+			uid = inode.Uid
+		}
+		if !gok {
+			gid = inode.Gid
+		}
+		if err := chownInode(n.iid, uid, gid); err != nil {
+			return fuseErrno(err)
+		}
+		inode = readInode(n.iid)
+	}
+	if size, ok := in.GetSize(); ok {
+		if inode.Mode != 0 {
+			return syscall.EISDIR
+		}
+		var err error
+		inode, err = resizeFile(inode, int64(size), newCharge(inode))
+		if err != nil {
+			return fuseErrno(err)
+		}
+	}
+	if mode, ok := in.GetMode(); ok {
+		inode.Perm = mode & 07777
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		inode.Mtime = mtime.Unix()
+	}
+	writeInode(n.iid, inode)
+	fuseFillAttr(n.iid, inode, &out.Attr)
+	return 0
+}
+
+func (n *fuseNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	folder := readFolder(inodeBids(readInode(n.iid)))
+	iid, ok := folderLookup(name, folder)
+	if !ok || name == ".." {
+		return nil, syscall.ENOENT
+	}
+	return n.child(ctx, iid, out), 0
+}
+
+func (n *fuseNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	folder := readFolder(inodeBids(readInode(n.iid)))
+	var entries []fuse.DirEntry
+	for k, v := range folder.FileName {
+		name := entryName(v)
+		if v[0] == 0 || name == ".." {
+			continue
+		}
+		iid := folder.FileInodeID[k]
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Ino:  uint64(iid) + 1,
+			Mode: fuseMode(readInode(iid)),
+		})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *fuseNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	if flags&syscall.O_TRUNC != 0 {
+		inode := readInode(n.iid)
+		inode, err := resizeFile(inode, 0, newCharge(inode))
+		if err != nil {
+			return nil, 0, fuseErrno(err)
+		}
+		writeInode(n.iid, inode)
+	}
+	return nil, 0, 0
+}
+
+func (n *fuseNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	data, err := readFileRange(readInode(n.iid), off, int64(len(dest)))
+	if err != nil {
+		return nil, fuseErrno(err)
+	}
+	return fuse.ReadResultData(data), 0
+}
+
+func (n *fuseNode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	_, err := writeFile(n.iid, readInode(n.iid), off, data)
+	if err != nil {
+		return 0, fuseErrno(err)
+	}
+	return uint32(len(data)), 0
+}
+
+//Only SEEK_DATA and SEEK_HOLE reach filesystem, kernel handles the rest
+func (n *fuseNode) Lseek(ctx context.Context, f fs.FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode := readInode(n.iid)
+	var pos int64
+	var err error
+	switch whence {
+	case seekWhenceData:
+		pos, err = seekData(inode, int64(off))
+	case seekWhenceHole:
+		pos, err = seekHole(inode, int64(off))
+	default:
+		return 0, syscall.EINVAL
+	}
+	if err != nil {
+		return 0, fuseErrno(err)
+	}
+	return uint64(pos), 0
+}
+
+func (n *fuseNode) Allocate(ctx context.Context, f fs.FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	if mode&^(fallocKeepSize|fallocPunchHole) != 0 {
+		return syscall.EOPNOTSUPP
+	}
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode, err := fallocate(readInode(n.iid), int64(off), int64(size), mode)
+	if err != nil {
+		return fuseErrno(err)
+	}
+	writeInode(n.iid, inode)
+	return 0
+}
+
+func (n *fuseNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	v, err := getXattr(readInode(n.iid), attr)
+	if err != nil {
+		return 0, fuseErrno(err)
+	}
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
+	}
+	return uint32(copy(dest, v)), 0
+}
+
+func (n *fuseNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	return fuseErrno(setXattr(n.iid, attr, append([]byte{}, data...), flags))
+}
+
+func (n *fuseNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	return fuseErrno(removeXattr(n.iid, attr))
+}
+
+//Names are written null terminated one after another
+func (n *fuseNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	var names []byte
+	for _, a := range readXattrs(readInode(n.iid)) {
+		names = append(append(names, a.Name...), 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), 0
+}
+
+func (n *fuseNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	dir, errno := n.checkNew(name)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	uid, gid := fuseOwner(ctx)
+	iid, err := createIn(dir, name, 0, uid, gid)
+	if err != nil {
+		return nil, nil, 0, fuseErrno(err)
+	}
+	chmodInode(iid, mode)
+	return n.child(ctx, iid, out), nil, 0, 0
+}
+
+func (n *fuseNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	dir, errno := n.checkNew(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	uid, gid := fuseOwner(ctx)
+	iid, err := mkdirIn(dir, n.iid, name, uid, gid)
+	if err != nil {
+		return nil, fuseErrno(err)
+	}
+	chmodInode(iid, mode)
+	return n.child(ctx, iid, out), 0
+}
+
+func (n *fuseNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	dir, errno := n.checkNew(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	uid, gid := fuseOwner(ctx)
+	iid, err := createIn(dir, name, 2, uid, gid)
+	if err == nil {
+		_, err = writeFile(iid, readInode(iid), 0, []byte(target))
+	}
+	if err != nil {
+		return nil, fuseErrno(err)
+	}
+	return n.child(ctx, iid, out), 0
+}
+
+func (n *fuseNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode := readInode(n.iid)
+	if inode.Mode != 2 {
+		return nil, syscall.EINVAL
+	}
+	return readFile(inode), 0
+}
+
+func (n *fuseNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	t, ok := target.(*fuseNode)
+	if !ok {
+		return nil, syscall.EXDEV
+	}
+	if readInode(t.iid).Mode == 1 {
+		return nil, syscall.EPERM
+	}
+	dir, errno := n.checkNew(name)
+	if errno != 0 {
+		return nil, errno
+	}
+	if err := linkIn(dir, name, t.iid); err != nil {
+		return nil, fuseErrno(err)
+	}
+	return n.child(ctx, t.iid, out), 0
+}
+
+func (n *fuseNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	return fuseErrno(removeEntry(readInode(n.iid), name, false))
+}
+
+func (n *fuseNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	return fuseErrno(removeEntry(readInode(n.iid), name, true))
+}
+
+func (n *fuseNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	//No RENAME_NOREPLACE or RENAME_EXCHANGE
+	if flags != 0 {
+		return syscall.EINVAL
+	}
+	p, ok := newParent.(*fuseNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	return fuseErrno(renameIn(readInode(n.iid), name, readInode(p.iid), p.iid, newName))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "log"
+
+func fuseMount(dir string) {
+	log.Println("FUSE mount is only supported on Linux.")
+}
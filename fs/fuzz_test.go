@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Image bytes with superblock checksum fixed, so mutations reach past it
+func sealImage(data []byte) []byte {
+	n := binary.Size(SuperBlock{})
+	if len(data) < n {
+		data = append(data, make([]byte, n-len(data))...)
+	}
+	var sb SuperBlock
+	binary.Read(bytes.NewReader(data), binary.BigEndian, &sb)
+	//Passphrase prompt and scrypt cost are not what is fuzzed
+	sb.Features &^= featEncrypted
+	sb.Checksum = 0
+	sb.Checksum = structSum(sb)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, sb)
+	return append(buf.Bytes(), data[n:]...)
+}
+
+//Small image with nested folders and files, as bytes
+func seedImage(f *testing.F, opts mkfsOptions) []byte {
+	newTestImage(f, 8, 80*KB, opts)
+	data := []byte("seed contents")
+	quiet(f, func() {
+		mkdir("d")
+		cd("d")
+		create("f")
+		open("f")
+		write(0, &data)
+		symlink("f", "s")
+		cd("/")
+		umount()
+	})
+	image, err := os.ReadFile(ImagePath)
+	if err != nil {
+		f.Fatal(err)
+	}
+	return image
+}
+
+//Walks every folder reachable from root the way shell and servers do,
+//reading contents of every file on the way
+func walkImage() {
+	fsck()
+	entries, err := reachableInodes("/")
+	if err != nil {
+		return
+	}
+	for p, iid := range entries {
+		lookupPath(p)
+		if inode := readInode(iid); inode.Mode != 1 {
+			readFileChecked(inode)
+		}
+		if list, err := folderEntries(iid); err == nil {
+			for _, e := range list {
+				lookupPathFrom(iid, e.Name)
+			}
+		}
+	}
+}
+
+//Seeds are whole images, minimizing them takes long, so fuzz with
+//go test -fuzz FuzzMount -fuzzminimizetime 2s
+func FuzzMount(f *testing.F) {
+	f.Add(seedImage(f, mkfsOptions{}))
+	f.Add(seedImage(f, mkfsOptions{Extents: true, DataSums: true}))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ImagePath = filepath.Join(t.TempDir(), "fs.bin")
+		if err := os.WriteFile(ImagePath, sealImage(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		Verbose = false
+		quiet(t, func() {
+			if err := mountImage(); err != nil {
+				return
+			}
+			walkImage()
+		})
+	})
+}
+
+func FuzzFolder(f *testing.F) {
+	var folder Folder
+	folder = appendToFolder("..", 0, folder)
+	folder = appendToFolder("file", 1, folder)
+	folder = appendToFolder("dir", 2, folder)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, folder)
+	f.Add(buf.Bytes())
+	f.Add([]byte("f\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		newTestImage(t, 8, 80*KB, mkfsOptions{})
+		quiet(t, func() {
+			create("file")
+			mkdir("dir")
+			//Root folder blocks get fuzzed bytes, rest of them zeroed
+			raw := make([]byte, binary.Size(Folder{}))
+			copy(raw, data)
+			bids := inodeBids(readInode(0))
+			for k, b := range bids {
+				var block Block
+				if k*int(blockSize) < len(raw) {
+					copy(block.Data[:], raw[k*int(blockSize):])
+				}
+				storeBlock(b, block, true)
+			}
+			walkImage()
+		})
+	})
+}
@@ -1,3 +1,11 @@
 module FS
 
-go 1.17
+go 1.18
+
+require (
+	github.com/hanwen/go-fuse/v2 v2.8.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
+)
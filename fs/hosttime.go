@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+//Mtime of symlink itself, os.Chtimes would follow it
+func lchtimesInode(p string, i Inode) error {
+	if i.Mtime == 0 {
+		return nil
+	}
+	t := unix.NsecToTimeval(i.Mtime * 1e9)
+	return unix.Lutimes(p, []unix.Timeval{t, t})
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+//Symlink times are only set on Linux
+func lchtimesInode(p string, i Inode) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"syscall"
+)
+
+//Extended attributes of host file, unreadable ones are skipped
+func hostXattrs(p string) []xattr {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(p, names)
+	if err != nil {
+		return nil
+	}
+	var attrs []xattr
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 || checkXattrName(string(name)) != nil {
+			continue
+		}
+		n, err := syscall.Getxattr(p, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		n, err = syscall.Getxattr(p, string(name), value)
+		if err != nil {
+			continue
+		}
+		attrs = append(attrs, xattr{string(name), value[:n]})
+	}
+	return attrs
+}
+
+//Host may refuse namespaces (trusted. needs root), failures are logged
+func setHostXattrs(p string, attrs []xattr) {
+	for _, a := range attrs {
+		if err := syscall.Setxattr(p, a.Name, a.Value, 0); err != nil {
+			log.Println(p, a.Name, err)
+		}
+	}
+}
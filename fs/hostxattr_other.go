@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+//Host attributes are only read and written on Linux
+func hostXattrs(p string) []xattr {
+	return nil
+}
+
+func setHostXattrs(p string, attrs []xattr) {}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+//-------------------------HTTP/WebDAV layer---------------------------
+//GET and HEAD browse the tree and download files, with WebDAV enabled
+//other methods change the image through create, write, mkdir, unlink, rename
+
+//Same type serves both net/http and webdav file systems
+type davFS struct{}
+
+var _ http.FileSystem = davFS{}
+var _ webdav.FileSystem = davFS{}
+
+//Open file of image, implements http.File and webdav.File
+type davFile struct {
+	iid    int64
+	name   string
+	offset int64
+	dir    *dirCursor //Set by first Readdir
+}
+
+type davFileInfo struct {
+	name  string
+	inode Inode
+}
+
+//File server over image, WebDAV methods too when dav is set
+func httpHandler(dav bool) http.Handler {
+	var handler http.Handler = http.FileServer(davFS{})
+	if dav {
+		browse := handler
+		davHandler := &webdav.Handler{
+			FileSystem: davFS{},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					log.Println(r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			//webdav does not list folders on GET
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				browse.ServeHTTP(w, r)
+				return
+			}
+			davHandler.ServeHTTP(w, r)
+		})
+	}
+	return handler
+}
+
+//Serves image on addr until Ctrl-C
+func serveHTTP(addr string, dav bool) {
+	if err := checkNotTracing(); err != nil {
+		log.Println(err)
+		return
+	}
+	mountIfNeeded()
+	srv := &http.Server{Addr: addr, Handler: httpHandler(dav)}
+	fmt.Printf("Serving image on http://%s (WebDAV: %t), press Ctrl-C to return\n", addr, dav)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+	}
+	signal.Stop(sig)
+
+	fsMu.Lock()
+	umount()
+	fsMu.Unlock()
+}
+
+//os errors are what net/http and webdav turn into status codes
+func davErr(err error) error {
+	switch errnoOf(err) {
+	case p9ENOENT, p9ENOTDIR:
+		return os.ErrNotExist
+	case p9EEXIST:
+		return os.ErrExist
+	case p9EISDIR, p9ENOTEMPTY, p9EINVAL:
+		return os.ErrPermission
+	case p9ENOSPC:
+		return syscall.ENOSPC
+	}
+	return err
+}
+
+func (davFS) Open(name string) (http.File, error) {
+	return davFS{}.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+}
+
+func (davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	iid, inode, err := lookupPath(name)
+	if err == errNotFound && flag&os.O_CREATE != 0 {
+		var dirID int64
+		var dir Inode
+		var base string
+		dirID, dir, base, err = lookupParent(name)
+		if err != nil {
+			return nil, davErr(err)
+		}
+		if err = checkNewEntry(dir, base); err != nil {
+			return nil, davErr(err)
+		}
+		if iid, err = createIn(readInode(dirID), base, 0, curUid, curGid); err != nil {
+			return nil, davErr(err)
+		}
+		inode = readInode(iid)
+	} else if err != nil {
+		return nil, davErr(err)
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, os.ErrExist
+	}
+	if flag&os.O_TRUNC != 0 && inode.Mode == 0 {
+		inode, err = resizeFile(inode, 0, newCharge(inode))
+		if err != nil {
+			return nil, err
+		}
+		writeInode(iid, inode)
+	}
+	return &davFile{iid: iid, name: path.Base("/" + name)}, nil
+}
+
+func (davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	dirID, dir, base, err := lookupParent(name)
+	if err != nil {
+		return davErr(err)
+	}
+	if err := checkNewEntry(dir, base); err != nil {
+		return davErr(err)
+	}
+	_, err = mkdirIn(dir, dirID, base, curUid, curGid)
+	return davErr(err)
+}
+
+func (davFS) RemoveAll(ctx context.Context, name string) error {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	_, dir, base, err := lookupParent(name)
+	if err != nil {
+		return davErr(err)
+	}
+	if base == "" {
+		return os.ErrPermission
+	}
+	return davErr(removeTree(dir, base))
+}
+
+//Removes entry and, if it is folder, everything below it
+func removeTree(dir Inode, name string) error {
+	iid, ok := folderLookup(name, readFolder(inodeBids(dir)))
+	if !ok || name == ".." {
+		return errNotFound
+	}
+	inode := readInode(iid)
+	if inode.Mode != 1 {
+		return removeEntry(dir, name, false)
+	}
+	for _, v := range readFolder(inodeBids(inode)).FileName {
+		if v[0] != 0 && entryName(v) != ".." {
+			if err := removeTree(inode, entryName(v)); err != nil {
+				return err
+			}
+		}
+	}
+	return removeEntry(dir, name, true)
+}
+
+func (davFS) Rename(ctx context.Context, oldName, newName string) error {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	_, src, oldBase, err := lookupParent(oldName)
+	if err != nil {
+		return davErr(err)
+	}
+	dstID, dst, newBase, err := lookupParent(newName)
+	if err != nil {
+		return davErr(err)
+	}
+	return davErr(renameIn(src, oldBase, dst, dstID, newBase))
+}
+
+func (davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	_, inode, err := lookupPath(name)
+	if err != nil {
+		return nil, davErr(err)
+	}
+	return davFileInfo{path.Base("/" + name), inode}, nil
+}
+
+func (f *davFile) Close() error {
+	return nil
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode := readInode(f.iid)
+	if inode.Mode == 1 {
+		return 0, errIsFolder
+	}
+	data, err := readFileChecked(inode)
+	if err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode := readInode(f.iid)
+	if inode.Mode == 1 {
+		return 0, errIsFolder
+	}
+	_, err := writeFile(f.iid, inode, f.offset, p)
+	if err != nil {
+		return 0, err
+	}
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += readInode(f.iid).Size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+//Entries are returned in folder order, count <= 0 means all of them
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	if f.dir == nil {
+		var err error
+		if f.dir, err = opendirID(f.iid); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := readdir(f.dir, count)
+	if err != nil {
+		return nil, err
+	}
+	var res []os.FileInfo
+	for _, e := range entries {
+		res = append(res, davFileInfo{e.Name, readInode(e.Inode)})
+	}
+	if count > 0 && len(res) == 0 {
+		return nil, io.EOF
+	}
+	return res, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	return davFileInfo{f.name, readInode(f.iid)}, nil
+}
+
+func (fi davFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi davFileInfo) Size() int64 {
+	return fi.inode.Size
+}
+
+func (fi davFileInfo) Mode() os.FileMode {
+	perm := os.FileMode(inodePerm(fi.inode)) & os.ModePerm
+	switch fi.inode.Mode {
+	case 1:
+		return os.ModeDir | perm
+	case 2:
+		return os.ModeSymlink | perm
+	default:
+		return perm
+	}
+}
+
+func (fi davFileInfo) ModTime() time.Time {
+	return time.Unix(fi.inode.Mtime, 0)
+}
+
+func (fi davFileInfo) IsDir() bool {
+	return fi.inode.Mode == 1
+}
+
+func (fi davFileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+//-------------------------io/fs layer---------------------------
+//Image as standard fs.FS, so fs.WalkDir, http.FS, template.ParseFS and
+//fstest.TestFS work on it. Names are unrooted and slash separated, "." is
+//root. Opened files are davFile, which also write, seek and read at offset
+
+type imageFS struct{}
+
+var (
+	_ fs.FS          = imageFS{}
+	_ fs.ReadDirFS   = imageFS{}
+	_ fs.StatFS      = imageFS{}
+	_ fs.ReadDirFile = (*davFile)(nil)
+	_ fs.DirEntry    = davFileInfo{}
+
+	_ io.ReadWriteSeeker = (*davFile)(nil)
+	_ io.ReaderAt        = (*davFile)(nil)
+	_ io.Closer          = (*davFile)(nil)
+)
+
+//Absolute image path of fs name
+func fsPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return "/" + name, nil
+}
+
+func (imageFS) Open(name string) (fs.File, error) {
+	p, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	iid, _, err := lookupPath(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: davErr(err)}
+	}
+	return &davFile{iid: iid, name: path.Base(name)}, nil
+}
+
+//Like os.OpenFile, O_CREATE makes missing file and O_TRUNC empties it
+func (imageFS) OpenFile(name string, flag int, perm os.FileMode) (*davFile, error) {
+	p, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := davFS{}.OpenFile(context.Background(), p, flag, perm)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	df := f.(*davFile)
+	df.name = path.Base(name)
+	return df, nil
+}
+
+func (imageFS) Stat(name string) (fs.FileInfo, error) {
+	p, err := fsPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	_, inode, err := lookupPath(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: davErr(err)}
+	}
+	return davFileInfo{path.Base(name), inode}, nil
+}
+
+//Entries sorted by name, as fs.ReadDir promises
+func (fsys imageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list, err := f.(*davFile).ReadDir(-1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name() < list[b].Name() })
+	return list, nil
+}
+
+//Entries in folder order, n <= 0 means rest of them
+func (f *davFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	res := make([]fs.DirEntry, len(infos))
+	for k, v := range infos {
+		res[k] = v.(davFileInfo)
+	}
+	return res, err
+}
+
+//Does not move offset used by Read and Write
+func (f *davFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	fsMu.Lock()
+	defer fsMu.Unlock()
+	inode := readInode(f.iid)
+	if inode.Mode == 1 {
+		return 0, errIsFolder
+	}
+	data, err := readFileRange(inode, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (fi davFileInfo) Type() fs.FileMode {
+	return fi.Mode().Type()
+}
+
+func (fi davFileInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+)
+
+func TestImageFS(t *testing.T) {
+	newTestImage(t, 32, 800*KB, mkfsOptions{})
+	page := []byte("{{define \"page\"}}hello {{.}}{{end}}")
+	big := []byte(strings.Repeat("xyz", int(blockSize)))
+	quiet(t, func() {
+		mkdir("d")
+		cd("d")
+		for name, data := range map[string][]byte{"page.tmpl": page, "big": big} {
+			create(name)
+			open(name)
+			write(len(OFT)-1, &data)
+		}
+		mkdir("e")
+		cd("/")
+		symlink("d/big", "s")
+	})
+	fsys := imageFS{}
+	if err := fstest.TestFS(fsys, "d/page.tmpl", "d/big", "d/e", "s"); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked []string
+	fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		walked = append(walked, p)
+		return err
+	})
+	if got := strings.Join(walked, " "); got != ". d d/big d/e d/page.tmpl s" {
+		t.Fatalf("walked %s", got)
+	}
+
+	tmpl, err := template.ParseFS(fsys, "d/*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := tmpl.ExecuteTemplate(&out, "page", "world"); err != nil || out.String() != "hello world" {
+		t.Fatalf("template gave %q, %v", out.String(), err)
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.FS(fsys)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/d/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != string(big) {
+		t.Fatalf("served %d bytes, want %d", len(body), len(big))
+	}
+
+	//Writes through io.Writer land at seek offset
+	f, err := fsys.OpenFile("d/new", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "abcdef")
+	f.Seek(2, io.SeekStart)
+	io.WriteString(f, "XY")
+	buf := make([]byte, 3)
+	if n, err := f.ReadAt(buf, 3); n != 3 || err != nil || string(buf) != "Yef" {
+		t.Fatalf("ReadAt gave %q, %d, %v", buf, n, err)
+	}
+	f.Close()
+	if data, err := fs.ReadFile(fsys, "d/new"); err != nil || string(data) != "abXYef" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+	if _, err := fsys.Open("d/missing"); !os.IsNotExist(err) {
+		t.Fatalf("missing file gave %v", err)
+	}
+}
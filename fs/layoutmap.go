@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+//-------------------------Layout map---------------------------
+//Draws image as grid of cells: superblock and inode table one cell per
+//sector, data blocks one cell each, checksum and nonce tables per sector.
+//Cell tooltips name owner, colors show owner, free/used status or fragmentation
+
+const (
+	mapCell    = 12 //Cell side in pixels, with 2 pixel gap
+	mapColumns = 64
+)
+
+//Ways of coloring data blocks
+var mapModes = []string{"owner", "status", "frag"}
+
+//Colors of structures that are not files
+var mapColors = map[string]string{
+	"superblock": "#444444",
+	"inode":      "#7f8fa6",
+	"inode free": "#dcdde1",
+	"folder":     "#273c75",
+	"extent":     "#8c7ae6",
+	"xattr":      "#e1b12c",
+	"snapshot":   "#44bd32",
+	"quota":      "#c23616",
+	"dedup":      "#00a8ff",
+	"table":      "#718093",
+	"free":       "#ffffff",
+	"unknown":    "#e84118",
+	"used":       "#40739e",
+	"shared":     "#9c88ff",
+	"contiguous": "#4cd137",
+	"few runs":   "#fbc531",
+	"fragmented": "#e84118",
+}
+
+type mapCellInfo struct {
+	Color string
+	Title string
+}
+
+type mapBand struct {
+	Name  string
+	Cells []mapCellInfo
+}
+
+//Stable color of file, same inode and path get same hue on every render
+func fileColor(o blockOwner) string {
+	h := fnv.New32a()
+	fmt.Fprint(h, o.Inode, o.Path)
+	return fmt.Sprintf("hsl(%d,65%%,55%%)", h.Sum32()%360)
+}
+
+//Legend name of file owner
+func ownerName(o blockOwner) string {
+	if o.Path == "" {
+		return fmt.Sprintf("unlinked inode %d", o.Inode)
+	}
+	return o.Path
+}
+
+//Runs of every inode, for frag coloring
+func inodeRuns() map[int64]int {
+	res := map[int64]int{}
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		i := readInode(in)
+		if i.Mode == 1 {
+			res[in] = folderRuns(inodeBids(i))
+		} else {
+			res[in] = blockRuns(fileBids(i))
+		}
+	}
+	return res
+}
+
+func fragColor(runs int) string {
+	switch {
+	case runs <= 1:
+		return mapColors["contiguous"]
+	case runs <= 3:
+		return mapColors["few runs"]
+	}
+	return mapColors["fragmented"]
+}
+
+//Cells of image regions colored by mode
+func layoutBands(mode string) []mapBand {
+	paths := inodePaths()
+	owners := allBlockOwners()
+	runs := inodeRuns()
+	head := mapBand{Name: "Superblock and inode table"}
+	head.Cells = append(head.Cells, mapCellInfo{mapColors["superblock"], "superblock, sector 0"})
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		title := fmt.Sprintf("inode %d, sector %d", in, inodeSector(in))
+		color := mapColors["inode free"]
+		if p, ok := paths[in]; ok {
+			title += ", " + p
+			color = mapColors["inode"]
+		} else if !inodeFree(readInode(in)) {
+			title += ", unlinked"
+			color = mapColors["inode"]
+		}
+		head.Cells = append(head.Cells, mapCellInfo{color, title})
+	}
+	data := mapBand{Name: "Data blocks"}
+	for b := int64(0); b < SB.BlockTableSize; b++ {
+		list := owners[b]
+		kind := "free"
+		if len(list) > 0 {
+			kind = list[0].Kind
+		} else {
+			kind = unownedKind(b)
+		}
+		var names []string
+		for _, o := range list {
+			if o.Inode < 0 {
+				names = append(names, o.Kind)
+				continue
+			}
+			names = append(names, fmt.Sprintf("%s of %s", o.Kind, ownerName(o)))
+		}
+		title := fmt.Sprintf("block %d, sector %d: %s", b, blockSector(b), kind)
+		if len(names) > 0 {
+			title = fmt.Sprintf("block %d, sector %d: %s", b, blockSector(b), strings.Join(names, ", "))
+		}
+		color := mapColors[kind]
+		switch mode {
+		case "owner":
+			if kind == "file" {
+				color = fileColor(list[0])
+			}
+		case "status":
+			if kind != "free" && kind != "unknown" {
+				color = mapColors["used"]
+				if len(list) > 1 || blockRef(b) > 0 {
+					color = mapColors["shared"]
+				}
+			}
+		case "frag":
+			if kind == "file" || kind == "folder" {
+				n := runs[list[0].Inode]
+				color = fragColor(n)
+				title += fmt.Sprintf(", %d runs", n)
+			}
+		}
+		data.Cells = append(data.Cells, mapCellInfo{color, title})
+	}
+	tables := mapBand{Name: "Checksum and nonce tables"}
+	l := layout()
+	for s := l.Sums; s < l.End; s++ {
+		name := "checksum table"
+		if l.Nonces != 0 && s >= l.Nonces {
+			name = "nonce table"
+		}
+		tables.Cells = append(tables.Cells, mapCellInfo{mapColors["table"], fmt.Sprintf("%s, sector %d", name, s)})
+	}
+	return []mapBand{head, data, tables}
+}
+
+//Legend entries used by mode, file colors are listed per file in owner mode
+func mapLegend(mode string) [][2]string {
+	var keys []string
+	switch mode {
+	case "status":
+		keys = []string{"used", "shared", "free", "unknown"}
+	case "frag":
+		keys = []string{"contiguous", "few runs", "fragmented"}
+	}
+	keys = append([]string{"superblock", "inode", "inode free", "folder", "extent", "xattr",
+		"snapshot", "quota", "dedup", "table"}, keys...)
+	if mode == "owner" {
+		keys = append(keys, "free", "unknown")
+	}
+	var res [][2]string
+	for _, k := range keys {
+		res = append(res, [2]string{k, mapColors[k]})
+	}
+	if mode == "owner" {
+		files := map[int64]blockOwner{}
+		for _, list := range allBlockOwners() {
+			for _, o := range list {
+				if o.Kind == "file" {
+					files[o.Inode] = o
+				}
+			}
+		}
+		var ids []int64
+		for in := range files {
+			ids = append(ids, in)
+		}
+		sort.Slice(ids, func(a, b int) bool { return ownerName(files[ids[a]]) < ownerName(files[ids[b]]) })
+		for _, in := range ids {
+			res = append(res, [2]string{ownerName(files[in]), fileColor(files[in])})
+		}
+	}
+	return res
+}
+
+//Writes SVG of image, HTML page around it when asked
+func renderMap(w io.Writer, mode string, asHTML bool) error {
+	valid := false
+	for _, m := range mapModes {
+		valid = valid || m == mode
+	}
+	if !valid {
+		return fmt.Errorf("unknown color mode %q, want %s", mode, strings.Join(mapModes, ", "))
+	}
+	if imageLocked() {
+		return errLocked
+	}
+	bands := layoutBands(mode)
+	legend := mapLegend(mode)
+	step := mapCell + 2
+	height := 0
+	for _, band := range bands {
+		height += 20 + step*((len(band.Cells)+mapColumns-1)/mapColumns) + 10
+	}
+	legendRows := (len(legend) + 3) / 4
+	width := step*mapColumns + 20
+	total := height + 20 + legendRows*18
+	if asHTML {
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head>\n<body style=\"font-family:sans-serif\">\n",
+			html.EscapeString(ImagePath))
+		fmt.Fprintf(w, "<h1>%s</h1>\n<p>%d bytes, %d inodes, %d blocks of %d bytes, colored by %s. Hover cells for details.</p>\n",
+			html.EscapeString(ImagePath), SB.FsSize, SB.InodeTableSize, SB.BlockTableSize, blockSize, mode)
+	}
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n", width, total)
+	y := 0
+	for _, band := range bands {
+		fmt.Fprintf(w, "<text x=\"10\" y=\"%d\">%s (%d cells)</text>\n", y+15, html.EscapeString(band.Name), len(band.Cells))
+		y += 20
+		for k, c := range band.Cells {
+			x := 10 + step*(k%mapColumns)
+			cy := y + step*(k/mapColumns)
+			fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\" stroke=\"#999\" stroke-width=\"0.5\"><title>%s</title></rect>\n",
+				x, cy, mapCell, mapCell, c.Color, html.EscapeString(c.Title))
+		}
+		y += step*((len(band.Cells)+mapColumns-1)/mapColumns) + 10
+	}
+	y += 10
+	for k, e := range legend {
+		x := 10 + (k%4)*(width/4)
+		ly := y + (k/4)*18
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\" stroke=\"#999\"/>", x, ly, mapCell, mapCell, e[1])
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\">%s</text>\n", x+mapCell+4, ly+mapCell-1, html.EscapeString(e[0]))
+	}
+	fmt.Fprintln(w, "</svg>")
+	if asHTML {
+		fmt.Fprintln(w, "</body></html>")
+	}
+	return nil
+}
+
+//Writes map to file, format follows extension .svg or .html
+func writeMapFile(name, mode string) error {
+	asHTML := strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".htm")
+	if !asHTML && !strings.HasSuffix(name, ".svg") && name != "-" {
+		return errors.New("map file needs .svg or .html extension")
+	}
+	if name == "-" {
+		return renderMap(os.Stdout, mode, false)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := renderMap(f, mode, asHTML); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//Shell front-end: map <file.svg|file.html> [owner|status|frag]
+func mapCommand(args []string) {
+	mountIfNeeded()
+	mode := "owner"
+	if len(args) > 1 {
+		mode = args[1]
+	}
+	if err := writeMapFile(args[0], mode); err != nil {
+		log.Println(args[0], err)
+		return
+	}
+	fmt.Println("Map written to", args[0])
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -38,6 +43,21 @@ type SuperBlock struct {
 	NextFreeInodeIndex int64
 
 	Modified bool
+
+	Features uint32 //featChecksums, featDataSums
+	Checksum uint32 //CRC32C of superblock with this field zeroed
+
+	Snapshots int64 //Block of SnapshotTable, 0 until first snapshot
+
+	//scrypt parameters of encrypted image
+	KDFSalt  [16]byte
+	KDFLogN  uint8
+	KDFR     uint8
+	KDFP     uint8
+	KeyCheck [16]byte //GCM tag proving passphrase
+
+	Quotas int64 //Block of QuotaTable, 0 until first limit
+	Dedup  int64 //Block of DedupTable, 0 until first merge
 }
 
 //Inodes is not fixed, so its array initialize in runtime.
@@ -45,10 +65,20 @@ type SuperBlock struct {
 //Inode -> Blocks (file contents)
 //Includes metadata and pointers to datablocks
 type Inode struct {
-	Mode              int8      //for now 0 for file 1 for dir , 2 for symlink, no rwx modes
-	Size              int64     //in bytes
-	DirrectPointers   [12]int64 //Block index
-	IndirrectPointers int64     //Block index with pointers to data blocks (Not Used)
+	Mode              int8                  //for now 0 for file 1 for dir , 2 for symlink
+	Size              int64                 //in bytes
+	DirrectPointers   [12]int64             //Block index
+	IndirrectPointers int64                 //Block with extents that do not fit in inode
+	Perm              uint32                //rwx bits, 0 means default for mode
+	Mtime             int64                 //Unix seconds of last change
+	Checksum          uint32                //CRC32C of inode with this field zeroed
+	Flags             uint32                //flagCompressed, flagExtents
+	Stored            int64                 //Bytes of cluster slots of compressed file
+	Xattrs            [xattrInlineSize]byte //Extended attributes when they fit
+	XattrBlock        int64                 //Block with extended attributes otherwise
+	Uid               uint32                //Owner, charged by quotas
+	Gid               uint32                //Group owner
+	Nlink             uint32                //Folder entries naming inode, 0 on older images counts as 1
 }
 
 //(fileCount*100*1)+(fileCount*8) = 13824 bytes
@@ -71,31 +101,101 @@ type FileDescriptor struct {
 	refCount int64
 }
 
+var (
+	errNotFound    = errors.New("no such file or folder")
+	errNameTooLong = errors.New("name too long")
+	errFolderFull  = errors.New("folder is full")
+	errFileTooBig  = errors.New("file exceeds dirrect pointers")
+	errExists      = errors.New("name already exists")
+	errNotFolder   = errors.New("not a folder")
+	errIsFolder    = errors.New("is a folder")
+	errNotEmpty    = errors.New("folder is not empty")
+	errLinkLoop    = errors.New("too many levels of symlinks")
+	errCorrupt     = errors.New("checksum mismatch")
+	errIsSymlink   = errors.New("is a symlink")
+	errBadBlock    = errors.New("block out of range")
+	errBadInode    = errors.New("inode out of range")
+	errCrossLink   = errors.New("link target is on another image or snapshot")
+	errNoSpace     = errors.New("no space left on image")
+	errMoveInside  = errors.New("folder cannot move into itself")
+	errBadName     = errors.New("invalid name")
+)
+
+//Servers (FUSE, 9P) take it before touching global state
+var fsMu sync.Mutex
+
 //Globals
+var ImagePath string = "FS.bin"
+var Verbose bool = true //Print internals, off for command line mode
 var SB SuperBlock
 var CWD string = "/"
 var CurrentInode Inode
 var CurrentInodeID int64
+
+//Owner of new inodes, servers set it from caller
+var curUid, curGid = uint32(os.Getuid()), uint32(os.Getgid())
 var OFT OpenFileTable
 
+//Unlinked inodes still open, freed when their last descriptor closes
+var orphans = map[int64]bool{}
+
+//Optional features of new image
+type mkfsOptions struct {
+	DataSums   bool   //Checksum file blocks, not only folders
+	Passphrase string //Encrypt image when set
+	Extents    bool   //New files use extents instead of block pointers
+	Dedup      bool   //Writes share blocks equal to stored ones
+}
+
 //FS with fixed inodes
-func mkfs(iq, sz int64) {
-	f, _ := os.Create("FS.bin")
-	defer f.Close()
+func mkfs(iq, sz int64, opts mkfsOptions) error {
+	traceOp("mkfs", mkfsArgs(iq, sz, opts)...)
 	minSize := float64(blockSize) + float64(unsafe.Sizeof(SuperBlock{})) + float64(iq)*float64(unsafe.Sizeof(Inode{}))
 	if sz <= int64(minSize) {
-		fmt.Println("Invalid size.")
-		os.Exit(1)
+		return errors.New("invalid size")
 	}
+	f, err := os.Create(ImagePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 	f.Truncate(sz)
 
 	sbs := int64(unsafe.Sizeof(SuperBlock{}))
 	is := int64(unsafe.Sizeof(Inode{}))
-	fbc := int64(math.Floor(float64(sz-sbs-is*iq) / float64(blockSize)))
-	fmt.Printf("sbs : %d\n is : %d\nfbc : %d --- %d\n", sbs, is, fbc, fbc*int64(blockSize))
+	//Every block has entry in checksum table (and nonce table) after data blocks,
+	//two more sectors cover rounding of tables
+	perBlock := blockSize + sumSize
+	if opts.Passphrase != "" {
+		perBlock += cryptEntrySize
+	}
+	fbc := (sz - sectorSize*(3+iq)) / perBlock
+	if fbc < 1 {
+		return errors.New("invalid size")
+	}
+	debugf("sbs : %d\n is : %d\nfbc : %d --- %d\n", sbs, is, fbc, fbc*int64(blockSize))
+	features := uint32(featChecksums)
+	if opts.DataSums {
+		features |= featDataSums
+	}
+	if opts.Extents {
+		features |= featExtents
+	}
+	if opts.Dedup {
+		features |= featDedup
+	}
 	//Write Superblock on disk
-	sb := SuperBlock{sz, fbc, fbc, 0, iq, iq, 0, false}
+	sb := SuperBlock{FsSize: sz, BlockTableSize: fbc, FreeBlocksCount: fbc,
+		InodeTableSize: iq, FreeInodeCount: iq, Features: features}
+	fsKey = nil
+	if opts.Passphrase != "" {
+		if err := setupEncryption(&sb, opts.Passphrase); err != nil {
+			return err
+		}
+	}
 	SB = sb
+	blockMap = nil
+	quotaUsers, quotaGroups = nil, nil
 	writeSuperBlock(sb)
 	//Write empty inodes
 	for i := 0; i < int(iq); i++ {
@@ -103,24 +203,54 @@ func mkfs(iq, sz int64) {
 		writeInode(int64(i), inode)
 	}
 
-	err := f.Close()
+	err = f.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	//Create root dirrectory
-	mkdir("/")
+	//Create root dirrectory, not traced as mkdir
+	if _, err := mkdirIn(Inode{}, 0, "/", curUid, curGid); err != nil {
+		return err
+	}
+	//Persist allocations of root folder, mount reads superblock from disk
+	umount()
+	return nil
 }
 
 func mount() {
+	if err := mountImage(); err != nil {
+		log.Println(err)
+	}
+}
+
+//Encrypted image stays mounted but locked when passphrase is wrong
+func mountImage() error {
 	SB = readSuperBlock()
+	dedupIndex = nil
+	//Descriptors of other image can not free its inodes, open unlinked ones stay allocated
+	orphans = map[int64]bool{}
+	blockMap = nil
+	quotaUsers, quotaGroups = nil, nil
+	if err := checkGeometry(SB); err != nil {
+		return err
+	}
+	err := unlockImage()
 	CurrentInode = readInode(int64(0))
 	CurrentInodeID = 0
-	fmt.Println(SB)
+	CWD = "/"
+	debugln(SB)
+	return err
+}
+
+//Commands that work on whole image load superblock themselves
+func mountIfNeeded() {
+	if SB.InodeTableSize == 0 {
+		mount()
+	}
 }
 
 func umount() {
-	if SB.Modified {
+	if SB.Modified && snapView == nil {
 		SB.Modified = false
 		writeSuperBlock(SB)
 	}
@@ -130,243 +260,293 @@ func fstat(id int64) {
 	inode := readInode(id)
 	dps := fmt.Sprint(inode.DirrectPointers)
 	idps := fmt.Sprint(inode.IndirrectPointers)
-	fmt.Printf("Mode : %d\nSize : %d\nDirrectPointers : %s\nIndirrectPointers : %s\n",
+	fmt.Printf("Mode : %d\nPerm : %o\nOwner : %d:%d\nNlink : %d\nSize : %d\nStored : %d\nCompressed : %t\nMtime : %s\nDirrectPointers : %s\nIndirrectPointers : %s\n",
 		inode.Mode,
+		inodePerm(inode),
+		inode.Uid,
+		inode.Gid,
+		inodeNlink(inode),
 		inode.Size,
+		storedSize(inode),
+		inode.Flags&flagCompressed != 0,
+		time.Unix(inode.Mtime, 0).Format(time.RFC3339),
 		dps,
 		idps)
+	if inode.Flags&flagExtents != 0 {
+		fmt.Printf("Extents : %s\n", formatExtents(inode))
+	}
+	for _, a := range readXattrs(inode) {
+		fmt.Printf("Xattr : %s=%q\n", a.Name, a.Value)
+	}
+	if inode.XattrBlock != 0 {
+		fmt.Printf("XattrBlock : %d\n", inode.XattrBlock)
+	}
 }
 
-func ls(i Inode) ([fileCount][fileNameSize]byte, [fileCount]int64) {
-	validPointers := inodeBids(i)
-	currentFolder := readFolder(validPointers)
-	var fnms [fileCount][fileNameSize]byte
-	var iids [fileCount]int64
-	for k, v := range currentFolder.FileName {
-		if v[0] == 0 {
-			break
-		}
-
-		fmt.Printf("%s - %s\n", string(v[:]), fmt.Sprint(currentFolder.FileInodeID[k]))
-		fnms[k] = v
-		iids[k] = currentFolder.FileInodeID[k]
+func create(name string) {
+	traceOp("create", name)
+	if err := checkNewEntry(CurrentInode, name); err != nil {
+		log.Println(name, err)
+		return
+	}
+	if _, err := createIn(CurrentInode, name, 0, curUid, curGid); err != nil {
+		log.Println(name, err)
 	}
-	return fnms, iids
 }
 
-func create(name string) {
-	allPointers := CurrentInode.DirrectPointers[:]
-	var validPointers []int64
-	for k, v := range allPointers {
-		if k == 0 || v != 0 {
-			validPointers = append(validPointers, v)
-		}
+//Creates empty inode of given mode owned by uid and gid, adds it to folder of dir
+func createIn(dir Inode, name string, mode int8, uid, gid uint32) (int64, error) {
+	if err := checkQuota(uid, gid, 0, 1); err != nil {
+		return 0, err
 	}
+	validPointers := inodeBids(dir)
 	currentFolder := readFolder(validPointers)
-	currentFolder = appendToFolder(name, iget(), currentFolder)
+	iid, err := iget()
+	if err != nil {
+		return 0, err
+	}
+	inode := Inode{Mode: mode, Mtime: time.Now().Unix(), Uid: uid, Gid: gid, Nlink: 1}
+	//Files inherit compression of folder
+	if mode == 0 {
+		inode.Flags = dir.Flags & flagCompressed
+		if SB.Features&featExtents != 0 {
+			inode.Flags |= flagExtents
+		}
+	}
+	writeInode(iid, inode)
+	currentFolder = appendToFolder(name, iid, currentFolder)
 	writeFolder(validPointers, currentFolder)
+	return iid, nil
 }
 
 func open(name string) {
-	_, iid := getInodeByPath(name)
+	traceOp("open", name)
+	_, iid, err := getInodeByPath(name)
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
 	fileDescriptor := FileDescriptor{0, iid, 1}
 	OFT = append(OFT, fileDescriptor)
 	fmt.Println(OFT)
 }
 
 func close(fd int) {
+	traceOp("close", strconv.Itoa(fd))
+	iid := OFT[fd].offset
 	OFT = append(OFT[:fd], OFT[fd+1:]...)
+	if orphans[iid] && !fileOpen(iid) {
+		delete(orphans, iid)
+		freeInode(iid)
+	}
 }
 
 func read(fd int, buf *[]byte) {
 	inode := readInode(OFT[fd].offset)
-	bids := inodeBids(inode)
-
-	//Read everything in continuous slice
-	for _, v := range bids {
-		block := readBlock(v)
-		*buf = append(*buf, block.Data[:]...)
-	}
-
+	*buf = append(*buf, readFile(inode)...)
+	traceRead(fd, *buf)
 }
 
+//Writes from beginning of file, growing it when needed
 func write(fd int, buf *[]byte) {
-	inode := readInode(OFT[fd].offset)
-	bids := inodeBids(inode)
-	binBuf := new(bytes.Buffer)
-	err := binary.Write(binBuf, binary.BigEndian, *buf)
+	traceWrite(fd, *buf)
+	iid := OFT[fd].offset
+	_, err := writeFile(iid, readInode(iid), 0, *buf)
 	if err != nil {
 		log.Println(err)
 	}
-	bbBytes := binBuf.Bytes()
-	chunks := chunkSlice(bbBytes, binary.Size(Block{}))
-	for k, v := range chunks {
-		block := Block{}
-		copy(block.Data[:], v)
-		writeBlock(bids[k], block)
-	}
-
 }
 
+//Adds name2 to current folder for file or symlink name1
 func link(name1, name2 string) {
-	allPointers := CurrentInode.DirrectPointers[:]
-	_, iid := getInodeByPath(name1)
-	//Same as create but with different iid
-	var validPointers []int64
-	for k, v := range allPointers {
-		if k == 0 || v != 0 {
-			validPointers = append(validPointers, v)
-		}
+	traceOp("link", name1, name2)
+	_, iid, err := getInodeByPath(name1)
+	if err == nil {
+		err = linkIn(CurrentInode, name2, iid)
+	}
+	if err != nil {
+		log.Println(name1, err)
 	}
-	fmt.Println(validPointers)
-	currentFolder := readFolder(validPointers)
-	currentFolder = appendToFolder(name2, iid, currentFolder)
-	writeFolder(validPointers, currentFolder)
 }
 
+//Removes exactly name from current folder, inode goes with its last name
 func unlink(name string) {
-	//Same as with rmdir but with file check
-	validPointers := inodeBids(CurrentInode)
-	cwd := readFolder(validPointers)
-	for k, v := range cwd.FileName {
-		//Check inode if it is file
-		inode := readInode(cwd.FileInodeID[k])
-		if inode.Mode != 0 {
-			continue
-		}
-		//
-		if string(v[:len(name)]) == name {
-			fmt.Println("match")
+	traceOp("unlink", name)
+	if err := removeEntry(CurrentInode, name, false); err != nil {
+		log.Println(name, err)
+	}
+}
 
-			cwd.FileInodeID[k] = 0
-			var emptyName [fileNameSize]byte
-			cwd.FileName[k] = emptyName
+//Renames entry of current folder, or moves it if name2 is folder
+func rename(name1, name2 string) {
+	traceOp("rename", name1, name2)
+	dst, dstID, newName := CurrentInode, CurrentInodeID, name2
+	cwd := readFolder(inodeBids(CurrentInode))
+	if iid, ok := folderLookup(name2, cwd); ok {
+		if inode := readInode(iid); inode.Mode == 1 {
+			dst, dstID, newName = inode, iid, name1
 		}
 	}
-	writeFolder(validPointers, cwd)
+	err := renameIn(CurrentInode, name1, dst, dstID, newName)
+	if err != nil {
+		log.Println(err)
+	}
+}
 
+//Symlink stores target path as its contents
+func symlink(target, name string) {
+	traceOp("symlink", target, name)
+	iid, err := createIn(CurrentInode, name, 2, curUid, curGid)
+	if err == nil {
+		_, err = writeFile(iid, readInode(iid), 0, []byte(target))
+	}
+	if err != nil {
+		log.Println(err)
+	}
 }
 
+//Size in bytes, blocks are allocated or released to fit it
 func truncate(name string, size int64) {
-	inode, iid := getInodeByPath(name)
-	fmt.Println("Truncate changing: ", iid)
-	var oldSize int64
-	for _, v := range inode.DirrectPointers {
-		if v != 0 {
-			oldSize++
-		}
+	traceOp("truncate", name, strconv.FormatInt(size, 10))
+	inode, iid, err := getInodeByPath(name)
+	if err == nil && inode.Mode == 1 {
+		err = errIsFolder
 	}
-	difference := size - oldSize
-	fmt.Println(difference)
-	if difference > 0 {
-		for i := 0; i < int(math.Abs(float64(difference))); i++ {
-			inode.DirrectPointers[int(oldSize)+i] = bget()
-		}
-	} else {
-		for i := 0; i < int(math.Abs(float64(difference))); i++ {
-			inode.DirrectPointers[int(oldSize)-i] = 0
-		}
+	if err != nil {
+		log.Println(name, err)
+		return
+	}
+	debugln("Truncate changing: ", iid)
+	inode, err = resizeFile(inode, size, newCharge(inode))
+	if err != nil {
+		log.Println(err)
+		return
 	}
 	writeInode(iid, inode)
 }
 
-func cd(path string) { // Inode {
-	//Handle relative path
-	if string(path[len(path)-1]) == "/" {
-		log.Println("Malformed path, remove last '/'")
-		return
+func cd(p string) {
+	traceOp("cd", p)
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(CWD, p)
 	}
-	if string(path[0]) == "." {
-		path = CWD + path[1:len(path)]
+	p = path.Clean(p)
+	ci, ciid, err := getInodeByPath(p)
+	if err != nil {
+		log.Println(p, err)
+		return
 	}
-	ci, ciid := getInodeByPath(path)
 	if ci.Mode == 1 {
-		CurrentInode, CurrentInodeID = ci, ciid
+		CurrentInode, CurrentInodeID, CWD = ci, ciid, p
 	} else {
 		log.Println("Not folder, cpecify different path.")
 	}
 }
 
 func mkdir(name string) {
+	traceOp("mkdir", name)
+	if err := checkNewEntry(CurrentInode, name); err != nil {
+		log.Println(name, err)
+		return
+	}
+	if _, err := mkdirIn(CurrentInode, CurrentInodeID, name, curUid, curGid); err != nil {
+		log.Println(name, err)
+	}
+}
+
+//Creates folder owned by uid and gid inside dir, returns inode id of new folder
+func mkdirIn(dir Inode, dirID int64, name string, uid, gid uint32) (int64, error) {
 	//Change inode
 	folder := Folder{}
-	fin := iget()
+	//In blocks, taken before parent names folder so full image changes nothing
+	folderSize := int(math.Ceil(float64(binary.Size(folder)) / float64(blockSize)))
+	debugln("Folder size", folderSize)
+	if err := checkQuota(uid, gid, int64(folderSize), 1); err != nil {
+		return 0, err
+	}
+	fin, err := iget()
+	if err != nil {
+		return 0, err
+	}
+	//Should not exceed dirrect pointers
+	var bids []int64
+	for i := 0; i < folderSize; i++ {
+		bid, err := bget()
+		if err != nil {
+			ungetBlocks(bids)
+			return 0, err
+		}
+		debugln("bget RESULT", bid)
+		bids = append(bids, bid)
+	}
 
-	//Add new inode id to current inode folder
+	//Add new inode id to parent inode folder
 	if name != "/" {
-		fmt.Println("not root dir created")
+		debugln("not root dir created")
 
-		validPointers := inodeBids(CurrentInode)
+		validPointers := inodeBids(dir)
 		cwd := readFolder(validPointers)
 		cwd = appendToFolder(name, fin, cwd)
 		writeFolder(validPointers, cwd)
 
-		//Append CurrentInode id as .. , to know how to return
-		folder = appendToFolder("..", CurrentInodeID, folder)
+		//Append parent id as .. , to know how to return
+		folder = appendToFolder("..", dirID, folder)
 	}
 
 	inode := readInode(fin)
 	inode.Size = int64(binary.Size(folder))
 	inode.Mode = 1
-	//In blocks
-	folderSize := int(math.Ceil(float64(binary.Size(folder)) / float64(blockSize)))
-	fmt.Println("Folder size", folderSize)
-	//Should not exceed dirrect pointers
-	var bids []int64
-	for i := 0; i < folderSize; i++ {
-		bid := bget()
-		fmt.Println("bget RESULT", bid)
-		inode.DirrectPointers[i] = bid
-		bids = append(bids, bid)
-	}
+	inode.Perm = 0
+	inode.Flags = dir.Flags & flagCompressed
+	inode.Mtime = time.Now().Unix()
+	inode.Uid, inode.Gid = uid, gid
+	inode.Nlink = 1
+	copy(inode.DirrectPointers[:], bids)
 	writeInode(fin, inode)
 	writeFolder(bids, folder)
+	return fin, nil
 }
 
 func rmdir(name string) {
-	if name == ".." {
-		log.Println("Please dont.")
-	}
-	validPointers := inodeBids(CurrentInode) //Change to traverse path (will return bids of folder down the path)
-	cwd := readFolder(validPointers)
-	for k, v := range cwd.FileName {
-		//Check inode if it is folder
-		inode := readInode(cwd.FileInodeID[k])
-		if inode.Mode != 1 {
-			continue
-		}
-		//
-		if string(v[:len(name)]) == name {
-			fmt.Println("match")
-
-			cwd.FileInodeID[k] = 0
-			var emptyName [fileNameSize]byte
-			cwd.FileName[k] = emptyName
-		}
+	traceOp("rmdir", name)
+	if err := removeEntry(CurrentInode, name, true); err != nil {
+		log.Println(name, err)
 	}
-	writeFolder(validPointers, cwd)
 }
 
 //------------------------Assistance functions------------------------
-//Returns first free inode index
-func iget() int64 {
+//Returns first free inode index, errNoSpace when table is full
+func iget() (int64, error) {
 	//Check if there are avaliable space
 	if SB.FreeInodeCount == 0 {
-		log.Fatal("No avaliable inodes left.")
+		return 0, errNoSpace
 	}
 	//Write what will be returned
 	res := SB.NextFreeInodeIndex
-	inode := readInode(res)
-	//Check if previous run of iget found free inode
-	if inode.DirrectPointers[0] != 0 {
-		log.Fatal("No avaliable inodes left.")
+	//Previous run found nothing, table may have room again
+	if res < 0 || res >= SB.InodeTableSize || !inodeFree(readInode(res)) {
+		res = -1
+		for in := int64(0); in < SB.InodeTableSize; in++ {
+			if inodeFree(readInode(in)) {
+				res = in
+				break
+			}
+		}
+		if res < 0 {
+			return 0, errNoSpace
+		}
+		SB.NextFreeInodeIndex = res
 	}
 	//--------Find next candidate--------
 	var count int64
 	pointer := SB.NextFreeInodeIndex + 1
+	//Last inode was taken, scan goes on from start of table
+	if pointer == SB.InodeTableSize {
+		pointer = 0
+	}
 	for count != SB.InodeTableSize-1 {
 		inode := readInode(pointer)
-		if inode.DirrectPointers[0] == 0 && inode.Mode == 0 {
+		if inodeFree(inode) {
 			SB.NextFreeInodeIndex = pointer
 			break
 		}
@@ -382,29 +562,37 @@ func iget() int64 {
 
 	//Return previously found inode
 	SB.Modified = true
-	fmt.Println("iget RESULT", res)
-	return res
+	debugln("iget RESULT", res)
+	return res, nil
 }
 
-//Returns first free block index
-func bget() int64 {
+//Returns first free block index, errNoSpace when image is full
+func bget() (int64, error) {
 	//Check if there are avaliable space
 	if SB.FreeBlocksCount == 0 {
-		log.Fatal("No avaliable blocks left.")
+		return 0, errNoSpace
 	}
 	//Write what will be returned
 	res := SB.NextFreeBlockIndex
-	block := readBlock(res)
-	if block.Data[0] != 0 {
-		log.Fatal("No avaliable blocks left.")
+	//Previous run found nothing, blocks may have been released since
+	if !blockFree(res) {
+		if res = firstFreeBlock(); !blockFree(res) {
+			return 0, errNoSpace
+		}
+		SB.NextFreeBlockIndex = res
 	}
+	setBlockUsed(res, true)
 
 	//--------Find next candidate--------
 	var count int64
 	pointer := SB.NextFreeBlockIndex + 1
+	//Last block was taken, scan goes on from start of table
+	if pointer == SB.BlockTableSize {
+		pointer = 0
+	}
 	for count != SB.BlockTableSize-1 {
-		block := readBlock(pointer)
-		if block.Data[0] == 0 {
+		//Blocks held by snapshots may start with zero too
+		if blockFree(pointer) {
 			SB.NextFreeBlockIndex = pointer
 
 			break
@@ -421,24 +609,44 @@ func bget() int64 {
 
 	//Return previously found inode
 	SB.Modified = true
-	fmt.Println("iget RESULT", res)
-	return res
+	debugln("iget RESULT", res)
+	return res, nil
 
 }
 
 func readSuperBlock() SuperBlock {
+	res, err := readSuperBlockChecked()
+	if err != nil {
+		log.Println(err)
+	}
+	return res
+}
+
+func readSuperBlockChecked() (SuperBlock, error) {
 	readRes := make([]byte, binary.Size(SuperBlock{}))
 	readH(0, &readRes)
 	buffer := bytes.NewBuffer(readRes)
 	var res SuperBlock
 	err := binary.Read(buffer, binary.BigEndian, &res)
 	if err != nil {
-		log.Println(err)
+		return res, err
 	}
-	return res
+	if res.Features&featChecksums != 0 {
+		sum := res.Checksum
+		res.Checksum = 0
+		if sum != structSum(res) {
+			err = fmt.Errorf("superblock: %w", errCorrupt)
+		}
+		res.Checksum = sum
+	}
+	return res, err
 }
 
 func writeSuperBlock(sb SuperBlock) {
+	sb.Checksum = 0
+	if sb.Features&featChecksums != 0 {
+		sb.Checksum = structSum(sb)
+	}
 	binBuf := new(bytes.Buffer)
 	err := binary.Write(binBuf, binary.BigEndian, sb)
 	if err != nil {
@@ -449,6 +657,23 @@ func writeSuperBlock(sb SuperBlock) {
 }
 
 func readInode(in int64) Inode {
+	res, err := readInodeChecked(in)
+	if err != nil {
+		log.Println(err)
+	}
+	return res
+}
+
+func readInodeChecked(in int64) (Inode, error) {
+	if snapView != nil {
+		if in < 0 || in >= int64(len(snapView)) {
+			return Inode{}, errNotFound
+		}
+		return snapView[in], nil
+	}
+	if in < 0 || in >= SB.InodeTableSize {
+		return Inode{}, fmt.Errorf("inode %d: %w", in, errBadInode)
+	}
 	readRes := make([]byte, binary.Size(Inode{}))
 	offsetSB := int64(math.Ceil(float64(unsafe.Sizeof(SuperBlock{})) / float64(sectorSize)))
 	offsetInode := in * int64(math.Ceil(float64(unsafe.Sizeof(Inode{}))/float64(sectorSize)))
@@ -458,12 +683,33 @@ func readInode(in int64) Inode {
 	var res Inode
 	err := binary.Read(buffer, binary.BigEndian, &res)
 	if err != nil {
-		log.Println(err)
+		return res, err
 	}
-	return res
+	if SB.Features&featChecksums != 0 {
+		sum := res.Checksum
+		res.Checksum = 0
+		if sum != structSum(res) {
+			err = fmt.Errorf("inode %d: %w", in, errCorrupt)
+		}
+		res.Checksum = sum
+	}
+	return res, err
 }
 
 func writeInode(in int64, i Inode) {
+	//Past table would land on blocks
+	if in < 0 || in >= SB.InodeTableSize {
+		log.Println(fmt.Errorf("inode %d: %w", in, errBadInode))
+		return
+	}
+	if quotaUsers != nil && snapView == nil {
+		chargeUsage(readInode(in), -1)
+		chargeUsage(i, 1)
+	}
+	i.Checksum = 0
+	if SB.Features&featChecksums != 0 {
+		i.Checksum = structSum(i)
+	}
 	binBuf := new(bytes.Buffer)
 	err := binary.Write(binBuf, binary.BigEndian, i)
 	if err != nil {
@@ -477,25 +723,44 @@ func writeInode(in int64, i Inode) {
 }
 
 func readBlock(ib int64) Block {
+	res, err := readBlockChecked(ib)
+	if err != nil {
+		log.Println(err)
+	}
+	return res
+}
+
+func readBlockChecked(ib int64) (Block, error) {
+	if ib < 0 || ib >= SB.BlockTableSize {
+		return Block{}, fmt.Errorf("block %d: %w", ib, errBadBlock)
+	}
 	readRes := make([]byte, binary.Size(Block{}))
 	offsetSB := int64(math.Ceil(float64(unsafe.Sizeof(SuperBlock{})) / float64(sectorSize)))
 	offsetInode := int64(SB.InodeTableSize) * int64(math.Ceil(float64(unsafe.Sizeof(Inode{}))/float64(sectorSize)))
 	offsetBlock := ib * int64(math.Ceil(float64(unsafe.Sizeof(Block{}))/float64(sectorSize)))
 	offset := offsetSB + offsetInode + offsetBlock
-	fmt.Println("Block read offset", offset)
+	debugln("Block read offset", offset)
 	readH(offset, &readRes)
-	buffer := bytes.NewBuffer(readRes)
+	sumErr := verifyBlock(ib, readRes)
+	plain, err := decryptBlock(ib, readRes)
+	if sumErr != nil {
+		err = sumErr
+	}
 	var res Block
-	err := binary.Read(buffer, binary.BigEndian, &res)
-	if err != nil {
-		log.Println(err)
+	if rerr := binary.Read(bytes.NewBuffer(plain), binary.BigEndian, &res); rerr != nil {
+		return res, rerr
 	}
-	//fmt.Println(res)
-	return res
+	return res, err
+}
 
+//File blocks get checksum only if image was made with data checksums
+func writeBlock(ib int64, b Block) error {
+	return storeBlock(ib, b, SB.Features&featDataSums != 0)
 }
 
-func writeBlock(ib int64, b Block) {
+//Block is left as it was when it can not be sealed
+func storeBlock(ib int64, b Block, sum bool) error {
+	forgetBlock(ib)
 	binBuf := new(bytes.Buffer)
 	err := binary.Write(binBuf, binary.BigEndian, b)
 	if err != nil {
@@ -506,8 +771,16 @@ func writeBlock(ib int64, b Block) {
 	offsetInode := int64(SB.InodeTableSize) * int64(math.Ceil(float64(unsafe.Sizeof(Inode{}))/float64(sectorSize)))
 	offsetBlock := ib * int64(math.Ceil(float64(unsafe.Sizeof(Block{}))/float64(sectorSize)))
 	offset := offsetSB + offsetInode + offsetBlock
-	writeH(offset, &bbBytes)
-
+	bbBytes, err = encryptBlock(ib, bbBytes)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := writeH(offset, &bbBytes); err != nil {
+		return err
+	}
+	updateBlockSum(ib, bbBytes, sum)
+	return nil
 }
 
 func readFolder(bids []int64) Folder {
@@ -517,14 +790,12 @@ func readFolder(bids []int64) Folder {
 		block := readBlock(v)
 		contSlice = append(contSlice, block.Data[:]...)
 	}
-	//Read needed part into buffer
+	//Read needed part into buffer, damaged folder may have fewer blocks
 	readRes := make([]byte, binary.Size(Folder{}))
-	for i := 0; i < len(readRes); i++ {
-		readRes[i] = contSlice[i]
-	}
+	copy(readRes, contSlice)
 
 	buffer := bytes.NewBuffer(readRes)
-	fmt.Printf("\n%d --- %d\n", binary.Size(Folder{}), len(readRes))
+	debugf("\n%d --- %d\n", binary.Size(Folder{}), len(readRes))
 
 	var res Folder
 	err := binary.Read(buffer, binary.BigEndian, &res)
@@ -547,7 +818,8 @@ func writeFolder(bids []int64, f Folder) {
 	for k, v := range chunks {
 		block := Block{}
 		copy(block.Data[:], v)
-		writeBlock(bids[k], block)
+		//Folder blocks are always checksummed
+		storeBlock(bids[k], block, true)
 	}
 
 }
@@ -586,27 +858,549 @@ func appendToFolder(name string, iid int64, f Folder) Folder {
 	return f
 }
 
-//Only absolute paths are accepted
-func getInodeByPath(path string) (Inode, int64) {
-	pathSlice := strings.Split(path, "/")
-	fmt.Println(pathSlice)
+//Permission bits, defaults are used when none were set
+func inodePerm(i Inode) uint32 {
+	if i.Perm != 0 {
+		return i.Perm
+	}
+	switch i.Mode {
+	case 1:
+		return 0755
+	case 2:
+		return 0777
+	default:
+		return 0644
+	}
+}
+
+//Older images keep no count, their inodes have one name
+func inodeNlink(i Inode) uint32 {
+	if i.Nlink == 0 {
+		return 1
+	}
+	return i.Nlink
+}
 
-	//Zero index always empty so will add one to all indexes
-	currentTmp := CurrentInode
-	var currentTmpID int64
-	for i := 1; i < len(pathSlice); i++ {
-		fnms, iids := ls(currentTmp)
-		for k, v := range fnms {
-			if string(v[:len(pathSlice[i])]) == pathSlice[i] {
-				fmt.Println("match")
+//Stores permission bits of inode
+func chmodInode(iid int64, perm uint32) {
+	inode := readInode(iid)
+	inode.Perm = perm & 07777
+	writeInode(iid, inode)
+}
 
-				currentTmp = readInode(iids[k])
-				currentTmpID = iids[k]
+//Name stored in folder without trailing zeros
+func entryName(v [fileNameSize]byte) string {
+	return strings.TrimRight(string(v[:]), "\x00")
+}
+
+//Exact name match, returns inode id of entry
+func folderLookup(name string, f Folder) (int64, bool) {
+	for k, v := range f.FileName {
+		if v[0] != 0 && entryName(v) == name {
+			return f.FileInodeID[k], true
+		}
+	}
+	return 0, false
+}
+
+func removeFromFolder(name string, f Folder) Folder {
+	for k, v := range f.FileName {
+		if v[0] != 0 && entryName(v) == name {
+			f.FileInodeID[k] = 0
+			f.FileName[k] = [fileNameSize]byte{}
+			break
+		}
+	}
+	return f
+}
+
+func folderFull(f Folder) bool {
+	for _, v := range f.FileName {
+		if v[0] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Folder with nothing but .. in it
+func folderEmpty(f Folder) bool {
+	for _, v := range f.FileName {
+		if v[0] != 0 && entryName(v) != ".." {
+			return false
+		}
+	}
+	return true
+}
+
+//Checks that name can be added to folder of dir
+func checkNewEntry(dir Inode, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	folder := readFolder(inodeBids(dir))
+	if _, ok := folderLookup(name, folder); ok {
+		return errExists
+	}
+	if folderFull(folder) {
+		return errFolderFull
+	}
+	return nil
+}
+
+//Name fits one path element, export joins it to host paths
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return errBadName
+	}
+	if len(name) > fileNameSize {
+		return errNameTooLong
+	}
+	return nil
+}
+
+//Removes entry from folder of dir, isFolder tells which kind is expected
+func removeEntry(dir Inode, name string, isFolder bool) error {
+	bids := inodeBids(dir)
+	folder := readFolder(bids)
+	iid, ok := folderLookup(name, folder)
+	if !ok || name == ".." {
+		return errNotFound
+	}
+	inode := readInode(iid)
+	if isFolder && inode.Mode != 1 {
+		return errNotFolder
+	}
+	if !isFolder && inode.Mode == 1 {
+		return errIsFolder
+	}
+	if isFolder && !folderEmpty(readFolder(inodeBids(inode))) {
+		return errNotEmpty
+	}
+	writeFolder(bids, removeFromFolder(name, folder))
+	dropLink(iid)
+	return nil
+}
+
+//Adds another name of file or symlink iid to folder of dir
+func linkIn(dir Inode, name string, iid int64) error {
+	inode := readInode(iid)
+	if inode.Mode == 1 {
+		return errIsFolder
+	}
+	if err := checkNewEntry(dir, name); err != nil {
+		return err
+	}
+	bids := inodeBids(dir)
+	writeFolder(bids, appendToFolder(name, iid, readFolder(bids)))
+	inode.Nlink = inodeNlink(inode) + 1
+	writeInode(iid, inode)
+	return nil
+}
+
+//Name of inode was removed, last one frees it unless file is open
+func dropLink(iid int64) {
+	inode := readInode(iid)
+	if n := inodeNlink(inode); n > 1 {
+		inode.Nlink = n - 1
+		writeInode(iid, inode)
+		return
+	}
+	if fileOpen(iid) {
+		orphans[iid] = true
+		return
+	}
+	freeInode(iid)
+}
+
+func fileOpen(iid int64) bool {
+	for _, fd := range OFT {
+		if fd.offset == iid {
+			return true
+		}
+	}
+	return false
+}
+
+//Releases blocks of inode and clears it, so iget hands it out again
+func freeInode(iid int64) {
+	inode := readInode(iid)
+	if inode.Mode == 1 {
+		for _, b := range inodeBids(inode) {
+			if b != 0 {
+				releaseBlock(b)
 			}
 		}
+	} else {
+		//Compressed stream goes as plain contents
+		inode.Size = storedSize(inode)
+		inode.Flags &^= flagCompressed
+		var err error
+		if inode, err = resizeFile(inode, 0, newCharge(inode)); err != nil {
+			log.Println(err)
+		}
+		dropExtentBlock(&inode)
+	}
+	if err := writeXattrs(&inode, nil); err != nil {
+		log.Println(err)
+	}
+	writeInode(iid, Inode{})
+}
+
+//Moves entry name of src folder into dst folder as newName,
+//replacing whatever was there unless it is non empty folder
+func renameIn(src Inode, name string, dst Inode, dstID int64, newName string) error {
+	if err := checkName(newName); err != nil {
+		return err
+	}
+	if iid, ok := folderLookup(newName, readFolder(inodeBids(dst))); ok {
+		existing := readInode(iid)
+		if existing.Mode == 1 && !folderEmpty(readFolder(inodeBids(existing))) {
+			return errNotEmpty
+		}
+	}
+	srcBids := inodeBids(src)
+	srcFolder := readFolder(srcBids)
+	iid, ok := folderLookup(name, srcFolder)
+	if !ok {
+		return errNotFound
+	}
+	if readInode(iid).Mode == 1 && inFolderTree(dstID, iid) {
+		return errMoveInside
+	}
+	srcFolder = removeFromFolder(name, srcFolder)
+	writeFolder(srcBids, srcFolder)
+
+	dstBids := inodeBids(dst)
+	dstFolder := readFolder(dstBids)
+	replaced, hadName := folderLookup(newName, dstFolder)
+	dstFolder = removeFromFolder(newName, dstFolder)
+	if folderFull(dstFolder) {
+		srcFolder = appendToFolder(name, iid, srcFolder)
+		writeFolder(srcBids, srcFolder)
+		return errFolderFull
+	}
+	dstFolder = appendToFolder(newName, iid, dstFolder)
+	writeFolder(dstBids, dstFolder)
+	if hadName {
+		dropLink(replaced)
+	}
+
+	//Moved folder has to know its new parent
+	inode := readInode(iid)
+	if inode.Mode == 1 {
+		bids := inodeBids(inode)
+		folder := readFolder(bids)
+		folder = removeFromFolder("..", folder)
+		folder = appendToFolder("..", dstID, folder)
+		writeFolder(bids, folder)
+	}
+	return nil
+}
+
+//Folder id is top or lies below it, found walking .. up to root
+func inFolderTree(id, top int64) bool {
+	//Bounded, damaged image may hold .. cycle
+	for k := int64(0); k < SB.InodeTableSize; k++ {
+		if id == top {
+			return true
+		}
+		parent, ok := folderLookup("..", readFolder(inodeBids(readInode(id))))
+		if id == 0 || !ok {
+			return false
+		}
+		id = parent
 	}
+	return false
+}
 
-	return currentTmp, currentTmpID
+//Bytes mapped by blocks, compressed files map their cluster slots
+func storedSize(i Inode) int64 {
+	if i.Flags&flagCompressed != 0 {
+		return i.Stored
+	}
+	return i.Size
+}
+
+//Blocks holding file contents, counted by stored size
+func fileBids(i Inode) []int64 {
+	n := int(math.Ceil(float64(storedSize(i)) / float64(blockSize)))
+	bids := i.DirrectPointers[:]
+	if i.Flags&flagExtents != 0 {
+		bids = extentBids(i)
+	}
+	if n > len(bids) {
+		n = len(bids)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return bids[:n]
+}
+
+//Reads file contents up to inode size
+func readFile(i Inode) []byte {
+	data, err := readFileChecked(i)
+	if err != nil {
+		log.Println(err)
+	}
+	return data
+}
+
+//Same as readFile, also returns first corruption found
+func readFileChecked(i Inode) ([]byte, error) {
+	if i.Flags&flagCompressed != 0 {
+		return readCompressed(i)
+	}
+	var data []byte
+	var firstErr error
+	for _, v := range fileBids(i) {
+		//Hole
+		if v == 0 {
+			data = append(data, make([]byte, blockSize)...)
+			continue
+		}
+		block, err := readBlockChecked(v)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		data = append(data, block.Data[:]...)
+	}
+	//Damaged inode may claim more than its blocks hold
+	size := storedSize(i)
+	if size < 0 || size > int64(len(data)) {
+		return data, fmt.Errorf("size %d, %d bytes mapped: %w", size, len(data), errCorrupt)
+	}
+	return data[:size], firstErr
+}
+
+//Bytes [off, off+n) of file cut at its size, only blocks covering them are read
+func readFileRange(i Inode, off, n int64) ([]byte, error) {
+	end := off + n
+	if end > i.Size || end < off {
+		end = i.Size
+	}
+	if off < 0 || off >= end {
+		return nil, nil
+	}
+	if i.Flags&flagCompressed != 0 {
+		return readCompressedRange(i, off, end)
+	}
+	bids := fileBids(i)
+	if int64(len(bids))*blockSize < i.Size {
+		return nil, fmt.Errorf("size %d, %d bytes mapped: %w", i.Size, int64(len(bids))*blockSize, errCorrupt)
+	}
+	first := off / blockSize
+	var data []byte
+	var firstErr error
+	for k := first; k*blockSize < end; k++ {
+		if bids[k] == 0 {
+			data = append(data, make([]byte, blockSize)...)
+			continue
+		}
+		block, err := readBlockChecked(bids[k])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		data = append(data, block.Data[:]...)
+	}
+	return data[off-first*blockSize : end-first*blockSize], firstErr
+}
+
+//Changes size of file in bytes, allocating or releasing blocks
+func resizeFile(i Inode, size int64, c *blockCharge) (Inode, error) {
+	if i.Flags&flagCompressed != 0 {
+		return resizeCompressed(i, size, c)
+	}
+	if i.Flags&flagExtents == 0 && size > int64(len(i.DirrectPointers))*blockSize || size > maxFileBlocks*blockSize {
+		return i, errFileTooBig
+	}
+	oldSize := i.Size
+	bids := append([]int64{}, fileBids(i)...)
+	n := int(math.Ceil(float64(size) / float64(blockSize)))
+	//File grows by holes, blocks are allocated by writes
+	for len(bids) < n {
+		bids = append(bids, 0)
+	}
+	//Released blocks go back to allocation map,
+	//snapshots and deduplicated files keep theirs
+	for _, bid := range bids[n:] {
+		if bid != 0 {
+			releaseBlock(bid)
+		}
+	}
+	if err := setFileBids(&i, bids[:n], c); err != nil {
+		return i, err
+	}
+	i.Size = size
+	//Zero tail of last block, so growing later reads zeros
+	if size < oldSize && size%blockSize != 0 && bids[n-1] != 0 {
+		bid, err := cowBlock(&i, int64(n-1), c)
+		if err != nil {
+			return i, err
+		}
+		block := readBlock(bid)
+		for k := size % blockSize; k < blockSize; k++ {
+			block.Data[k] = 0
+		}
+		if err := writeBlock(bid, block); err != nil {
+			return i, err
+		}
+	}
+	i.Mtime = time.Now().Unix()
+	return i, nil
+}
+
+//Gives file own copy of block k if snapshot or other file holds it, fills hole
+func cowBlock(i *Inode, k int64, c *blockCharge) (int64, error) {
+	bids := append([]int64{}, fileBids(*i)...)
+	bid := bids[k]
+	if bid != 0 && !blockShared(bid) {
+		return bid, nil
+	}
+	var nb int64
+	if bid == 0 {
+		//New blocks follow previous one when possible
+		var goal int64
+		for p := k - 1; p >= 0 && goal == 0; p-- {
+			if bids[p] != 0 {
+				goal = bids[p] + 1
+			}
+		}
+		var err error
+		if nb, err = allocBlock(c, goal); err != nil {
+			return 0, err
+		}
+		if err := writeBlock(nb, Block{}); err != nil {
+			ungetBlocks([]int64{nb})
+			return 0, err
+		}
+	} else {
+		var err error
+		if nb, err = allocBlock(c, bid+1); err != nil {
+			return 0, err
+		}
+		if err := writeBlock(nb, readBlock(bid)); err != nil {
+			ungetBlocks([]int64{nb})
+			return 0, err
+		}
+		//File leaves block to others holding it
+		if dedupRef(bid) > 0 {
+			addDedupRef(bid, -1)
+		}
+	}
+	bids[k] = nb
+	return nb, setFileBids(i, bids, c)
+}
+
+//Writes data at offset growing file if needed, returns updated inode
+func writeFile(iid int64, i Inode, off int64, data []byte) (Inode, error) {
+	var err error
+	c := newCharge(i)
+	if i.Flags&flagCompressed != 0 {
+		i, err = writeCompressed(i, off, data, c)
+	} else {
+		i, err = writeRaw(i, off, data, c)
+	}
+	if err != nil {
+		//Blocks written before failure stay with file
+		writeInode(iid, i)
+		return i, err
+	}
+	i.Mtime = time.Now().Unix()
+	writeInode(iid, i)
+	if SB.Features&featDedup != 0 {
+		if _, err := dedupInode(iid); err != nil {
+			log.Println(err)
+		}
+		i = readInode(iid)
+	}
+	return i, nil
+}
+
+//Writes data into blocks of uncompressed file, inode is not stored
+func writeRaw(i Inode, off int64, data []byte, c *blockCharge) (Inode, error) {
+	end := off + int64(len(data))
+	if end > i.Size {
+		var err error
+		i, err = resizeFile(i, end, c)
+		if err != nil {
+			return i, err
+		}
+	}
+	for pos := off; pos < end; {
+		bid, err := cowBlock(&i, pos/blockSize, c)
+		if err != nil {
+			return i, err
+		}
+		block := readBlock(bid)
+		n := copy(block.Data[pos%blockSize:], data[pos-off:])
+		if err := writeBlock(bid, block); err != nil {
+			return i, err
+		}
+		pos += int64(n)
+	}
+	return i, nil
+}
+
+//Resolves absolute path from root folder by exact names
+func lookupPath(path string) (int64, Inode, error) {
+	return lookupPathFrom(0, path)
+}
+
+//Resolves path relative to folder iid
+func lookupPathFrom(iid int64, path string) (int64, Inode, error) {
+	inode := readInode(iid)
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if inode.Mode != 1 {
+			return 0, inode, errNotFolder
+		}
+		next, ok := folderLookup(name, readFolder(inodeBids(inode)))
+		if !ok {
+			//Root has no .. entry
+			if name == ".." && iid == 0 {
+				continue
+			}
+			return 0, inode, errNotFound
+		}
+		iid, inode = next, readInode(next)
+	}
+	return iid, inode, nil
+}
+
+//Splits path into parent folder and last name
+func lookupParent(path string) (int64, Inode, string, error) {
+	path = strings.TrimRight(path, "/")
+	k := strings.LastIndex(path, "/")
+	dirID, dir, err := lookupPath(path[:k+1])
+	if err == nil && dir.Mode != 1 {
+		err = errNotFolder
+	}
+	return dirID, dir, path[k+1:], err
+}
+
+//Absolute paths start at root folder, others at current one
+func getInodeByPath(p string) (Inode, int64, error) {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(CWD, p)
+	}
+	iid, inode, err := lookupPath(p)
+	return inode, iid, err
+}
+
+func debugf(format string, a ...interface{}) {
+	if Verbose {
+		fmt.Printf(format, a...)
+	}
+}
+
+func debugln(a ...interface{}) {
+	if Verbose {
+		fmt.Println(a...)
+	}
 }
 
 //-------------------------"Hardware" layer -------------------------
@@ -616,7 +1410,7 @@ func getInodeByPath(path string) (Inode, int64) {
 //returns buffer with read data
 //offset in sectors
 func readH(offset int64, buf *[]byte) error {
-	f, err := os.Open("./FS.bin")
+	f, err := os.Open(ImagePath)
 	if err != nil {
 		return err
 	}
@@ -629,7 +1423,17 @@ func readH(offset int64, buf *[]byte) error {
 //writes passed buffer with data
 //offset in sectors
 func writeH(offset int64, buf *[]byte) error {
-	f, err := os.OpenFile("./FS.bin", os.O_RDWR, 0644)
+	//Mounted snapshot is read-only, nothing reaches the drive
+	if snapView != nil {
+		log.Println(errReadOnly)
+		return errReadOnly
+	}
+	//Locked image sees every block as free, writing would destroy it
+	if imageLocked() {
+		log.Println(errLocked)
+		return errLocked
+	}
+	f, err := os.OpenFile(ImagePath, os.O_RDWR, 0644)
 	if err != nil {
 		log.Println(err)
 	}
@@ -637,13 +1441,18 @@ func writeH(offset int64, buf *[]byte) error {
 	_, err = f.WriteAt(*buf, int64(offset*sectorSize))
 	if err != nil {
 		log.Println(err)
+		return nil
 	}
+	recordWrite(offset, *buf)
 	return nil
 }
 
 //-------------------------------------------------------------------
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 	fmt.Println("Representation of FS")
 
 	tmpBuff := make([]byte, 1)
@@ -653,149 +1462,6 @@ func main() {
 		log.Println("Run mkfs first")
 	}
 
-	for {
-		fmt.Println("\nAvaliable commands : mkfs, mount, umount, fstat, ls, create, open, close, read, write, link, unlink, truncate, cd, mkdir, rmdir ")
-		fmt.Println("Open file table : ", OFT)
-		fmt.Print("Do wish to continue ? [Y/n] : ")
-
-		var ans string
-		fmt.Scanf("%s", &ans)
-		if ans == "Y" || ans == "y" || ans == "" {
-			fmt.Print(">")
-			var ansCommand string
-			fmt.Scanf("%s", &ansCommand)
-			switch ansCommand {
-			case "mkfs":
-				{
-					var iq int64
-					fmt.Print("Enter quantity of inodes: ")
-					fmt.Scanf("%d", &iq)
-					var sz int64
-					fmt.Print("Enter size in bytes: ")
-					fmt.Scanf("%d", &sz)
-					mkfs(iq, sz)
-				}
-			case "mount":
-				{
-					mount()
-				}
-			case "umount":
-				{
-					umount()
-				}
-			case "fstat":
-				{
-					var fd int64
-					fmt.Print("Enter file descriptor id: ")
-					fmt.Scanf("%d", &fd)
-					fstat(fd)
-				}
-			case "ls":
-				{
-					ls(CurrentInode)
-				}
-			case "create":
-				{
-					var fn string
-					fmt.Print("Filename: ")
-					fmt.Scanf("%s", &fn)
-					create(fn)
-				}
-			case "open":
-				{
-					var fn string
-					fmt.Print("Filename: ")
-					fmt.Scanf("%s", &fn)
-					open(fn)
-				}
-			case "close":
-				{
-					var fd int
-					fmt.Print("Enter file descriptor id: ")
-					fmt.Scanf("%d", &fd)
-					close(fd)
-				}
-			case "read":
-				{
-					var fd int
-					fmt.Print("Enter file descriptor id: ")
-					fmt.Scanf("%d", &fd)
-
-					var buf []byte
-					fmt.Scanf("%d", &buf)
-
-					read(fd, &buf)
-					fmt.Println("Read data : ", string(buf))
-				}
-			case "write":
-				{
-					var fd int
-					fmt.Print("Enter file descriptor id: ")
-					fmt.Scanf("%d", &fd)
-					var buf string
-					fmt.Print("Enter what to write: ")
-					fmt.Scanf("%s", &buf)
-					convertedString := []byte(buf)
-					write(fd, &convertedString)
-
-				}
-
-			case "link":
-				{
-					var name1 string
-					fmt.Print("Enter name of file to be linked to (FILE1): ")
-					fmt.Scanf("%s", &name1)
-					var name2 string
-					fmt.Print("Enter name of link (FILE2): ")
-					fmt.Scanf("%s", &name2)
-					link(name1, name2)
-				}
-			case "unlink":
-				{
-					var linkName string
-					fmt.Print("Enter name of link: ")
-					fmt.Scanf("%s", &linkName)
-					unlink(linkName)
-				}
-			case "truncate":
-				{
-					var name string
-					fmt.Print("Path: ")
-					fmt.Scanf("%s", &name)
-					var size int64
-					fmt.Print("Enter new size in blocks: ")
-					fmt.Scanf("%d", &size)
-					truncate(name, size)
-
-				}
-			case "cd":
-				{
-					var path string
-					fmt.Print("Enter path: ")
-					fmt.Scanf("%s", &path)
-					cd(path)
-
-				}
-			case "mkdir":
-				{
-					var fn string
-					fmt.Print("Foldername: ")
-					fmt.Scanf("%s", &fn)
-					mkdir(fn)
-
-				}
-			case "rmdir":
-				{
-					var fn string
-					fmt.Print("Foldername: ")
-					fmt.Scanf("%s", &fn)
-					rmdir(fn)
-
-				}
-			}
-		} else {
-			umount() //To prevent superblock corruption
-			os.Exit(0)
-		}
-	}
+	runShell()
+	umount() //To prevent superblock corruption
 }
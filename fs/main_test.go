@@ -0,0 +1,1604 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Reference model: folders map names to nodes, hard links share node
+type modelNode struct {
+	dir     bool
+	data    []byte
+	entries map[string]*modelNode
+}
+
+type model struct {
+	root *modelNode
+	cwd  []*modelNode //Folders from root to current one
+	path string
+	fds  []*modelNode
+}
+
+func newModel() *model {
+	root := &modelNode{dir: true, entries: map[string]*modelNode{}}
+	return &model{root: root, cwd: []*modelNode{root}, path: "/"}
+}
+
+func (m *model) dir() *modelNode {
+	return m.cwd[len(m.cwd)-1]
+}
+
+//Names of current folder of given kind, sorted so runs repeat by seed
+func (m *model) names(dir bool) []string {
+	var res []string
+	for name, n := range m.dir().entries {
+		if n.dir == dir {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (m *model) freeName(r *rand.Rand, prefix string) (string, bool) {
+	name := fmt.Sprintf("%s%d", prefix, r.Intn(8))
+	_, used := m.dir().entries[name]
+	return name, !used
+}
+
+func pick(r *rand.Rand, names []string) (string, bool) {
+	if len(names) == 0 {
+		return "", false
+	}
+	return names[r.Intn(len(names))], true
+}
+
+//Arbitrary bytes, runs of zeros included so blocks start with zero byte
+func testData(r *rand.Rand) []byte {
+	data := make([]byte, 1+r.Intn(3*int(blockSize)))
+	fill := byte(r.Intn(3))
+	for k := range data {
+		data[k] = fill
+		if r.Intn(4) == 0 {
+			data[k] = byte(r.Intn(256))
+		}
+	}
+	return data
+}
+
+func newTestImage(t testing.TB, inodes, size int64, opts mkfsOptions) {
+	ImagePath = filepath.Join(t.TempDir(), "fs.bin")
+	Verbose = false
+	OFT = nil
+	quiet(t, func() {
+		if err := mkfs(inodes, size, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := mountImage(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+//Runs op with shell output discarded, returns what it logged
+func quiet(t testing.TB, op func()) string {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	stdout := os.Stdout
+	os.Stdout = null
+	log.SetOutput(&logged)
+	defer func() {
+		os.Stdout = stdout
+		log.SetOutput(os.Stderr)
+		null.Close()
+	}()
+	op()
+	return logged.String()
+}
+
+//Runs one random operation valid in model on both, returns its description
+func randomOp(t *testing.T, r *rand.Rand, m *model) string {
+	for {
+		switch r.Intn(12) {
+		case 0:
+			if name, ok := m.freeName(r, "f"); ok {
+				create(name)
+				m.dir().entries[name] = &modelNode{}
+				return "create " + name
+			}
+		case 1:
+			if name, ok := m.freeName(r, "d"); ok && len(m.cwd) < 4 {
+				mkdir(name)
+				m.dir().entries[name] = &modelNode{dir: true, entries: map[string]*modelNode{}}
+				return "mkdir " + name
+			}
+		case 2:
+			if name, ok := pick(r, m.names(false)); ok {
+				open(name)
+				m.fds = append(m.fds, m.dir().entries[name])
+				return "open " + name
+			}
+		case 3:
+			if len(m.fds) > 0 {
+				fd := r.Intn(len(m.fds))
+				close(fd)
+				m.fds = append(m.fds[:fd], m.fds[fd+1:]...)
+				return fmt.Sprint("close ", fd)
+			}
+		case 4:
+			if len(m.fds) > 0 {
+				fd := r.Intn(len(m.fds))
+				data := testData(r)
+				write(fd, &data)
+				n := m.fds[fd]
+				if len(data) >= len(n.data) {
+					n.data = data
+				} else {
+					n.data = append(data, n.data[len(data):]...)
+				}
+				return fmt.Sprintf("write %d (%d bytes)", fd, len(data))
+			}
+		case 5:
+			if len(m.fds) > 0 {
+				fd := r.Intn(len(m.fds))
+				var buf []byte
+				read(fd, &buf)
+				if !bytes.Equal(buf, m.fds[fd].data) {
+					t.Fatalf("read %d returned %d bytes, model has %d", fd, len(buf), len(m.fds[fd].data))
+				}
+				return fmt.Sprint("read ", fd)
+			}
+		case 6:
+			if name, ok := pick(r, m.names(false)); ok {
+				size := r.Intn(3 * int(blockSize))
+				truncate(name, int64(size))
+				n := m.dir().entries[name]
+				if size <= len(n.data) {
+					n.data = n.data[:size]
+				} else {
+					n.data = append(n.data, make([]byte, size-len(n.data))...)
+				}
+				return fmt.Sprint("truncate ", name, " ", size)
+			}
+		case 7:
+			src, ok := pick(r, m.names(false))
+			name, free := m.freeName(r, "f")
+			if ok && free {
+				link(src, name)
+				m.dir().entries[name] = m.dir().entries[src]
+				return "link " + src + " " + name
+			}
+		case 8:
+			if name, ok := pick(r, m.names(false)); ok {
+				unlink(name)
+				delete(m.dir().entries, name)
+				return "unlink " + name
+			}
+		case 9:
+			var empty []string
+			for _, name := range m.names(true) {
+				if len(m.dir().entries[name].entries) == 0 {
+					empty = append(empty, name)
+				}
+			}
+			if name, ok := pick(r, empty); ok {
+				rmdir(name)
+				delete(m.dir().entries, name)
+				return "rmdir " + name
+			}
+		case 10:
+			name, ok := pick(r, append(m.names(false), m.names(true)...))
+			if !ok {
+				continue
+			}
+			n := m.dir().entries[name]
+			//Into sibling folder under same name, or to free name of same kind
+			if dst, ok := pick(r, m.names(true)); ok && dst != name && r.Intn(2) == 0 {
+				if _, used := m.dir().entries[dst].entries[name]; !used {
+					rename(name, dst)
+					delete(m.dir().entries, name)
+					m.dir().entries[dst].entries[name] = n
+					return "rename " + name + " into " + dst
+				}
+			}
+			prefix := "f"
+			if n.dir {
+				prefix = "d"
+			}
+			if newName, free := m.freeName(r, prefix); free {
+				rename(name, newName)
+				delete(m.dir().entries, name)
+				m.dir().entries[newName] = n
+				return "rename " + name + " " + newName
+			}
+		case 11:
+			if len(m.cwd) > 1 && r.Intn(2) == 0 {
+				cd("..")
+				m.cwd = m.cwd[:len(m.cwd)-1]
+				m.path = path.Dir(m.path)
+				return "cd .."
+			}
+			if name, ok := pick(r, m.names(true)); ok {
+				cd(name)
+				m.cwd = append(m.cwd, m.dir().entries[name])
+				m.path = path.Join(m.path, name)
+				return "cd " + name
+			}
+		}
+	}
+}
+
+//Tree leaves as tar and comes back with data, modes, times, xattrs and hard links,
+//host folder round trip keeps data and modes
+func TestTransferRoundTrip(t *testing.T) {
+	newTestImage(t, 32, 400*KB, mkfsOptions{})
+	data := bytes.Repeat([]byte("tree "), 1000)
+	quiet(t, func() {
+		mkdir("src")
+		cd("src")
+		create("a")
+		open("a")
+		write(0, &data)
+		close(0)
+		link("a", "b")
+		symlink("a", "l")
+		mkdir("sub")
+		cd("sub")
+		create("c")
+		cd("/")
+		mkdir("dst")
+		mkdir("dst2")
+	})
+	srcID, _, err := lookupPath("/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aID, a, err := lookupPath("/src/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chmodInode(aID, 0640)
+	if err := setXattr(aID, "user.k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	a = readInode(aID)
+	a.Mtime = 1000000
+	writeInode(aID, a)
+
+	var archive bytes.Buffer
+	if err := exportTarStream(&archive, srcID); err != nil {
+		t.Fatal(err)
+	}
+	dstID, _, _ := lookupPath("/dst")
+	if _, err := importTarStream(&archive, dstID); err != nil {
+		t.Fatal(err)
+	}
+	check := func(root string, links bool) {
+		t.Helper()
+		id, got, err := lookupPath(root + "/a")
+		if err != nil || !bytes.Equal(readFile(got), data) || inodePerm(got) != 0640 || got.Mtime != 1000000 {
+			t.Fatalf("%s/a: %v, perm %o, mtime %d", root, err, inodePerm(got), got.Mtime)
+		}
+		if v, err := getXattr(got, "user.k"); links && (err != nil || string(v) != "v") {
+			t.Fatalf("%s/a xattr: %q %v", root, v, err)
+		}
+		if bID, _, err := lookupPath(root + "/b"); err != nil || links && bID != id {
+			t.Fatalf("%s/b: inode %d of %d, %v", root, bID, id, err)
+		}
+		if _, l, err := lookupPath(root + "/l"); err != nil || l.Mode != 2 || string(readFile(l)) != "a" {
+			t.Fatalf("%s/l: %v", root, err)
+		}
+		if _, _, err := lookupPath(root + "/sub/c"); err != nil {
+			t.Fatalf("%s/sub/c: %v", root, err)
+		}
+	}
+	check("/dst", true)
+
+	host := t.TempDir()
+	if err := exportTree(srcID, host); err != nil {
+		t.Fatal(err)
+	}
+	dst2ID, _, _ := lookupPath("/dst2")
+	quiet(t, func() { importHostTree(host, dst2ID) })
+	check("/dst2", false)
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//File written alone is one run, interleaved appends spill runs to extent block
+func TestExtents(t *testing.T) {
+	newTestImage(t, 16, 600*KB, mkfsOptions{Extents: true})
+	one := bytes.Repeat([]byte{1}, 10*int(blockSize))
+	quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &one)
+		close(0)
+	})
+	_, f, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exts := readExtents(f); len(exts) != 1 || exts[0].Length != 10 {
+		t.Fatalf("file written at once has runs %v", exts)
+	}
+
+	quiet(t, func() {
+		create("a")
+		create("b")
+	})
+	aID, _, _ := lookupPath("/a")
+	bID, _, _ := lookupPath("/b")
+	var want []byte
+	for k := 0; k < 2*inlineExtents; k++ {
+		chunk := bytes.Repeat([]byte{byte(k + 1)}, int(blockSize))
+		for _, id := range []int64{aID, bID} {
+			i := readInode(id)
+			if _, err := writeFile(id, i, i.Size, chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want = append(want, chunk...)
+	}
+	a := readInode(aID)
+	if len(readExtents(a)) <= inlineExtents || a.IndirrectPointers == 0 {
+		t.Fatalf("interleaved file has runs %v, extent block %d", readExtents(a), a.IndirrectPointers)
+	}
+	if !bytes.Equal(readFile(a), want) || !bytes.Equal(readFile(readInode(bID)), want) {
+		t.Fatal("interleaved files read back differently")
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Holes are found by SEEK_DATA and SEEK_HOLE, fallocate fills them and punch makes them
+func TestSparse(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	quiet(t, func() {
+		create("f")
+		truncate("f", 10*blockSize)
+	})
+	iid, i, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inodeBlocks(i)) != 0 {
+		t.Fatalf("truncate allocated %v", inodeBlocks(i))
+	}
+	if i, err = writeFile(iid, i, 4*blockSize+10, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	seek := func(whence int, off, want int64) {
+		t.Helper()
+		var got int64
+		var err error
+		if whence == seekWhenceData {
+			got, err = seekData(readInode(iid), off)
+		} else {
+			got, err = seekHole(readInode(iid), off)
+		}
+		if want < 0 && !errors.Is(err, errNoData) || want >= 0 && (err != nil || got != want) {
+			t.Fatalf("seek %d from %d: %d %v, want %d", whence, off, got, err, want)
+		}
+	}
+	seek(seekWhenceData, 0, 4*blockSize)
+	seek(seekWhenceData, 4*blockSize+100, 4*blockSize+100)
+	seek(seekWhenceHole, 4*blockSize, 5*blockSize)
+	seek(seekWhenceHole, 0, 0)
+	seek(seekWhenceData, 5*blockSize, -1)
+	seek(seekWhenceHole, 10*blockSize, -1)
+
+	//Preallocated blocks read as zeros and count as data
+	if i, err = fallocate(readInode(iid), 6*blockSize, 2*blockSize, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeInode(iid, i)
+	seek(seekWhenceData, 5*blockSize, 6*blockSize)
+	if len(inodeBlocks(i)) != 3 {
+		t.Fatalf("blocks after fallocate: %v", inodeBlocks(i))
+	}
+
+	//Punch of whole block frees it, partial one is zeroed in place
+	if i, err = fallocate(readInode(iid), 4*blockSize, blockSize, fallocPunchHole|fallocKeepSize); err != nil {
+		t.Fatal(err)
+	}
+	if i, err = fallocate(i, 6*blockSize+1, 10, fallocPunchHole|fallocKeepSize); err != nil {
+		t.Fatal(err)
+	}
+	writeInode(iid, i)
+	seek(seekWhenceData, 0, 6*blockSize)
+	if len(inodeBlocks(i)) != 2 || i.Size != 10*blockSize {
+		t.Fatalf("after punch: blocks %v, size %d", inodeBlocks(i), i.Size)
+	}
+	if data := readFile(i); !bytes.Equal(data, make([]byte, 10*blockSize)) {
+		t.Fatal("punched file is not all zeros")
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Small attributes stay in inode, growing ones move to xattr block and back
+func TestXattrSpill(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	quiet(t, func() { create("f") })
+	iid, _, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(iid, "user.a", []byte("small"), xattrCreate); err != nil {
+		t.Fatal(err)
+	}
+	if i := readInode(iid); i.XattrBlock != 0 {
+		t.Fatal("small attribute went to block")
+	}
+	if err := setXattr(iid, "user.a", []byte("again"), xattrCreate); !errors.Is(err, errExists) {
+		t.Fatalf("create of existing: %v", err)
+	}
+	big := bytes.Repeat([]byte("b"), 2*xattrInlineSize)
+	if err := setXattr(iid, "user.big", big, 0); err != nil {
+		t.Fatal(err)
+	}
+	i := readInode(iid)
+	if i.XattrBlock == 0 || i.Xattrs != [xattrInlineSize]byte{} {
+		t.Fatalf("spilled attributes: block %d, inline %q", i.XattrBlock, i.Xattrs[:])
+	}
+	if v, err := getXattr(i, "user.a"); err != nil || string(v) != "small" {
+		t.Fatalf("user.a after spill: %q %v", v, err)
+	}
+	if v, err := getXattr(i, "user.big"); err != nil || !bytes.Equal(v, big) {
+		t.Fatalf("user.big: %v", err)
+	}
+	if err := setXattr(iid, "user.huge", make([]byte, blockSize), 0); !errors.Is(err, errAttrTooBig) {
+		t.Fatalf("attribute past block: %v", err)
+	}
+	if err := removeXattr(iid, "user.big"); err != nil {
+		t.Fatal(err)
+	}
+	if i := readInode(iid); i.XattrBlock != 0 {
+		t.Fatal("xattr block kept after attributes fit inline")
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Shrink moves blocks past new end down, grow adds blocks and inodes
+func TestResize(t *testing.T) {
+	newTestImage(t, 16, 400*KB, mkfsOptions{})
+	filler := bytes.Repeat([]byte{1}, 10*int(blockSize))
+	keep := bytes.Repeat([]byte("keep"), 3*int(blockSize)/4)
+	quiet(t, func() {
+		for k := 0; k < 4; k++ {
+			name := fmt.Sprint("filler", k)
+			create(name)
+			open(name)
+			write(0, &filler)
+			close(0)
+		}
+		create("keep")
+		open("keep")
+		write(0, &keep)
+		close(0)
+		for k := 0; k < 4; k++ {
+			unlink(fmt.Sprint("filler", k))
+		}
+	})
+	_, i, err := lookupPath("/keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const blocks = 20
+	if bids := fileBids(i); bids[len(bids)-1] < blocks {
+		t.Fatalf("keep already below new end: %v", bids)
+	}
+	size := sectorSize*(3+SB.InodeTableSize) + blocks*(blockSize+sumSize)
+	if err := resizeImage(size, 0); err != nil {
+		t.Fatal(err)
+	}
+	if SB.BlockTableSize != blocks {
+		t.Fatalf("%d blocks after shrink", SB.BlockTableSize)
+	}
+	check := func(what string) {
+		t.Helper()
+		if _, i, err := lookupPath("/keep"); err != nil || !bytes.Equal(readFile(i), keep) {
+			t.Fatalf("/keep %s: %v", what, err)
+		}
+		if problems := fsck(); len(problems) > 0 {
+			t.Fatal(what, problems)
+		}
+	}
+	check("after shrink")
+	if err := mountImage(); err != nil {
+		t.Fatal(err)
+	}
+	check("after remount")
+
+	if err := resizeImage(400*KB, 8); err != nil {
+		t.Fatal(err)
+	}
+	if SB.InodeTableSize != 24 || SB.BlockTableSize <= blocks {
+		t.Fatalf("grown to %d inodes, %d blocks", SB.InodeTableSize, SB.BlockTableSize)
+	}
+	logged := quiet(t, func() {
+		for k := 0; k < 20; k++ {
+			create(fmt.Sprint("f", k))
+		}
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	check("after grow")
+}
+
+//Defrag makes interleaved files contiguous without changing contents
+func TestDefrag(t *testing.T) {
+	newTestImage(t, 16, 400*KB, mkfsOptions{})
+	quiet(t, func() {
+		create("a")
+		create("b")
+	})
+	aID, _, _ := lookupPath("/a")
+	bID, _, _ := lookupPath("/b")
+	want := map[int64][]byte{}
+	for k := 0; k < 5; k++ {
+		for _, id := range []int64{aID, bID} {
+			chunk := bytes.Repeat([]byte{byte(id), byte(k)}, int(blockSize)/2)
+			i := readInode(id)
+			if _, err := writeFile(id, i, i.Size, chunk); err != nil {
+				t.Fatal(err)
+			}
+			want[id] = append(want[id], chunk...)
+		}
+	}
+	if runs := blockRuns(fileBids(readInode(aID))); runs != 5 {
+		t.Fatalf("interleaved file has %d runs", runs)
+	}
+	lines, err := defrag("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("defrag moved %+v", lines)
+	}
+	for _, l := range lines {
+		if l.After != 1 || l.Note != "" {
+			t.Fatalf("%s: %d runs after, note %q", l.Path, l.After, l.Note)
+		}
+	}
+	if err := mountImage(); err != nil {
+		t.Fatal(err)
+	}
+	for id, data := range want {
+		if !bytes.Equal(readFile(readInode(id)), data) {
+			t.Fatalf("inode %d changed by defrag", id)
+		}
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Equal blocks merge, write to shared block copies it, report counts savings
+func TestDedup(t *testing.T) {
+	newTestImage(t, 16, 400*KB, mkfsOptions{})
+	var data []byte
+	for k := 0; k < 3; k++ {
+		data = append(data, bytes.Repeat([]byte{'x', byte(k)}, int(blockSize)/2)...)
+	}
+	quiet(t, func() {
+		for _, name := range []string{"a", "b"} {
+			create(name)
+			open(name)
+			write(0, &data)
+			close(0)
+		}
+	})
+	aID, _, _ := lookupPath("/a")
+	bID, _, _ := lookupPath("/b")
+	free := freeBlockCount()
+	if n, err := dedupTree("/"); err != nil || n != 3 {
+		t.Fatalf("merged %d blocks, %v", n, err)
+	}
+	if fmt.Sprint(fileBids(readInode(aID))) != fmt.Sprint(fileBids(readInode(bID))) {
+		t.Fatal("equal files do not share blocks")
+	}
+	if got := freeBlockCount(); got <= free {
+		t.Fatalf("free blocks %d -> %d", free, got)
+	}
+	if info := dedupReport(); info.Shared != 3 || info.Saved != 3*blockSize {
+		t.Fatalf("report %+v", info)
+	}
+
+	//Write to shared block leaves other file as it was
+	b := readInode(bID)
+	if _, err := writeFile(bID, b, blockSize, []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readFile(readInode(aID)), data) {
+		t.Fatal("write to b changed a")
+	}
+	changed := append([]byte{}, data...)
+	copy(changed[blockSize:], "changed")
+	if !bytes.Equal(readFile(readInode(bID)), changed) {
+		t.Fatal("b lost its write")
+	}
+	if info := dedupReport(); info.Shared != 2 {
+		t.Fatalf("report after write %+v", info)
+	}
+	quiet(t, func() { unlink("a") })
+	if !bytes.Equal(readFile(readInode(bID)), changed) {
+		t.Fatal("b changed when a was removed")
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Compares folder tree of image under iid with model
+func compareTree(t *testing.T, iid int64, p string, n *modelNode) {
+	t.Helper()
+	folder := readFolder(inodeBids(readInode(iid)))
+	seen := map[string]bool{}
+	for k, v := range folder.FileName {
+		name := entryName(v)
+		if v[0] == 0 || name == ".." {
+			continue
+		}
+		child, ok := n.entries[name]
+		if !ok {
+			t.Fatalf("%s: image has %s, model does not", p, name)
+		}
+		seen[name] = true
+		id := folder.FileInodeID[k]
+		inode := readInode(id)
+		if (inode.Mode == 1) != child.dir {
+			t.Fatalf("%s: mode %d, model folder %t", path.Join(p, name), inode.Mode, child.dir)
+		}
+		if child.dir {
+			compareTree(t, id, path.Join(p, name), child)
+			continue
+		}
+		if data := readFile(inode); !bytes.Equal(data, child.data) {
+			t.Fatalf("%s: %d bytes, model has %d", path.Join(p, name), len(data), len(child.data))
+		}
+	}
+	for name := range n.entries {
+		if !seen[name] {
+			t.Fatalf("%s: model has %s, image does not", p, name)
+		}
+	}
+}
+
+func TestModel(t *testing.T) {
+	variants := map[string]mkfsOptions{
+		"plain":   {},
+		"extents": {Extents: true, DataSums: true},
+		"dedup":   {Dedup: true},
+	}
+	for name, opts := range variants {
+		t.Run(name, func(t *testing.T) {
+			for seed := int64(1); seed <= 8; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				newTestImage(t, 256, 8*MB, opts)
+				m := newModel()
+				var ops []string
+				for step := 0; step < 150; step++ {
+					var op string
+					if logged := quiet(t, func() { op = randomOp(t, r, m) }); logged != "" {
+						t.Fatalf("seed %d, after %v: %s logged %s", seed, ops, op, logged)
+					}
+					ops = append(ops, op)
+					if CWD != m.path {
+						t.Fatalf("seed %d, after %v: cwd %s, model %s", seed, ops, CWD, m.path)
+					}
+					quiet(t, func() { compareTree(t, 0, "/", m.root) })
+				}
+				quiet(t, func() {
+					if problems := fsck(); len(problems) > 0 {
+						t.Fatalf("seed %d: fsck after %v: %v", seed, ops, problems)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestTruncateHoles(t *testing.T) {
+	newTestImage(t, 16, 400*KB, mkfsOptions{})
+	data := bytes.Repeat([]byte("x"), int(blockSize)+10)
+	logged := quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &data)
+		truncate("f", 3*blockSize)
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	_, inode, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readFile(inode)
+	want := append(data, make([]byte, 3*int(blockSize)-len(data))...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, want %d zero-extended", len(got), len(want))
+	}
+}
+
+func TestLinks(t *testing.T) {
+	newTestImage(t, 16, 400*KB, mkfsOptions{})
+	data := []byte("linked")
+	logged := quiet(t, func() {
+		create("a")
+		create("ab")
+		open("ab")
+		write(0, &data)
+		close(0)
+		link("ab", "c")
+		//Exact names, a is not prefix match for ab
+		unlink("a")
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	iid, inode, err := lookupPath("/ab")
+	if err != nil || inodeNlink(inode) != 2 {
+		t.Fatalf("ab: %v, %d links", err, inodeNlink(inode))
+	}
+	if logged := quiet(t, func() { mkdir("d"); link("d", "e") }); !strings.Contains(logged, errIsFolder.Error()) {
+		t.Fatalf("link to folder logged %q", logged)
+	}
+	var buf []byte
+	quiet(t, func() {
+		unlink("ab")
+		open("c")
+		unlink("c")
+		read(0, &buf)
+	})
+	if string(buf) != string(data) {
+		t.Fatalf("unlinked open file read %q", buf)
+	}
+	if inodeFree(readInode(iid)) {
+		t.Fatal("inode freed while open")
+	}
+	quiet(t, func() { close(0) })
+	if !inodeFree(readInode(iid)) {
+		t.Fatal("inode not freed by last close")
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+func TestReaddir(t *testing.T) {
+	newTestImage(t, 32, 800*KB, mkfsOptions{})
+	var got []string
+	logged := quiet(t, func() {
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			create(name)
+		}
+		//Entries after hole were lost by old ls
+		unlink("b")
+		c, err := opendir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for step := 0; ; step++ {
+			list, err := readdir(c, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) == 0 {
+				break
+			}
+			got = append(got, list[0].Name)
+			//Removed ahead of cursor is not returned, one added into hole ahead is
+			if step == 0 {
+				unlink("c")
+				create("f")
+			}
+		}
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	if s := strings.Join(got, " "); s != "a f d e" {
+		t.Fatalf("readdir returned %s", s)
+	}
+}
+
+//Freed inodes come back once allocation wraps past end of table
+func TestInodeReuse(t *testing.T) {
+	newTestImage(t, 8, 400*KB, mkfsOptions{})
+	for k := 0; k < 3*8; k++ {
+		logged := quiet(t, func() {
+			create("f")
+			unlink("f")
+		})
+		if logged != "" {
+			t.Fatalf("cycle %d: %s", k, logged)
+		}
+		if SB.NextFreeInodeIndex < 0 || SB.NextFreeInodeIndex >= SB.InodeTableSize {
+			t.Fatalf("cycle %d: next free inode %d", k, SB.NextFreeInodeIndex)
+		}
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Root has no .., emptied first slot left its block looking free
+func TestFolderBlockNotFree(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	data := bytes.Repeat([]byte("z"), 2*int(blockSize))
+	logged := quiet(t, func() {
+		create("a")
+		create("keep")
+		mkdir("d")
+		unlink("a")
+		cd("d")
+		//Enough rounds for block scan to wrap around table
+		for k := 0; k < int(SB.BlockTableSize); k++ {
+			create("f")
+			open("f")
+			write(0, &data)
+			close(0)
+			unlink("f")
+		}
+		cd("/")
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	if _, _, err := lookupPath("/keep"); err != nil {
+		t.Fatal("/keep:", err)
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//File block starting with zero byte is not handed out again when block scan wraps
+func TestZeroLeadingBlock(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	kept := append([]byte{0}, bytes.Repeat([]byte("A"), 2*int(blockSize))...)
+	churn := bytes.Repeat([]byte("z"), int(blockSize))
+	logged := quiet(t, func() {
+		create("kept")
+		open("kept")
+		write(0, &kept)
+		close(0)
+		for k := 0; k < 2*int(SB.BlockTableSize); k++ {
+			create("f")
+			open("f")
+			write(0, &churn)
+			close(0)
+			unlink("f")
+		}
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	_, inode, err := lookupPath("/kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(inode); !bytes.Equal(got, kept) {
+		t.Fatalf("kept file changed, starts with %q", got[:8])
+	}
+}
+
+//Full image reports errNoSpace, takes new entries again once some are gone
+func TestFullImage(t *testing.T) {
+	newTestImage(t, 4, 100*KB, mkfsOptions{})
+	var err error
+	quiet(t, func() {
+		for k := 0; err == nil; k++ {
+			_, err = createIn(CurrentInode, fmt.Sprint("f", k), 0, curUid, curGid)
+		}
+	})
+	if !errors.Is(err, errNoSpace) {
+		t.Fatalf("out of inodes: %v", err)
+	}
+	data := bytes.Repeat([]byte("z"), 4*int(blockSize))
+	quiet(t, func() {
+		unlink("f0")
+		iid, _ := createIn(CurrentInode, "big", 0, curUid, curGid)
+		for err = nil; err == nil; {
+			_, err = writeFile(iid, readInode(iid), readInode(iid).Size, data)
+			if errors.Is(err, errFileTooBig) {
+				unlink("f1")
+				iid, err = createIn(CurrentInode, "big2", 0, curUid, curGid)
+			}
+		}
+	})
+	if !errors.Is(err, errNoSpace) {
+		t.Fatalf("out of blocks: %v", err)
+	}
+	if logged := quiet(t, func() { mkdir("d") }); !strings.Contains(logged, errNoSpace.Error()) {
+		t.Fatalf("mkdir on full image logged %q", logged)
+	}
+	logged := quiet(t, func() {
+		unlink("big")
+		mkdir("d")
+		umount()
+		mount()
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	if _, _, err := lookupPath("/d"); err != nil {
+		t.Fatal("/d:", err)
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Walk failing partway answers with qids of names it got through
+func TestP9WalkPartial(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	quiet(t, func() { mkdir("a") })
+	p := &p9Conn{msize: p9MaxSize, fids: map[uint32]*p9Fid{1: {iid: 0}}}
+	req := p9PutU32(nil, 1)
+	req = p9PutU32(req, 2)
+	req = p9PutU16(req, 2)
+	req = p9PutStr(req, "a")
+	req = p9PutStr(req, "missing")
+	body, err := p.safeHandle(p9Twalk, &p9Reader{b: req})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aID, a, _ := lookupPath("/a")
+	want := append(p9PutU16(nil, 1), p9PutQid(nil, aID, a)...)
+	if !bytes.Equal(body, want) {
+		t.Fatalf("reply %x, want %x", body, want)
+	}
+	if _, ok := p.fids[2]; ok {
+		t.Fatal("partial walk made newfid")
+	}
+}
+
+//Mkdir belongs to attached user and given gid, shell user stays
+func TestP9MkdirOwner(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	uid, gid := curUid, curGid
+	p := &p9Conn{msize: p9MaxSize, fids: map[uint32]*p9Fid{1: {iid: 0, uid: 5}}}
+	req := p9PutU32(nil, 1)
+	req = p9PutStr(req, "d")
+	req = p9PutU32(req, 0755)
+	req = p9PutU32(req, 6)
+	if _, err := p.safeHandle(p9Tmkdir, &p9Reader{b: req}); err != nil {
+		t.Fatal(err)
+	}
+	if _, d, err := lookupPath("/d"); err != nil || d.Uid != 5 || d.Gid != 6 {
+		t.Fatalf("/d owner %d:%d, %v", d.Uid, d.Gid, err)
+	}
+	if curUid != uid || curGid != gid {
+		t.Fatalf("shell user changed to %d:%d", curUid, curGid)
+	}
+}
+
+//Files put and folders made over WebDAV read back over HTTP and from image
+func TestHTTPRoundTrip(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	h := httpHandler(true)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if w.Code >= 300 {
+			t.Fatalf("%s %s: %d %s", method, target, w.Code, w.Body)
+		}
+		return w
+	}
+	do("MKCOL", "/d", "")
+	do(http.MethodPut, "/d/f", "over http")
+	if body := do(http.MethodGet, "/d/f", "").Body.String(); body != "over http" {
+		t.Fatalf("GET /d/f: %q", body)
+	}
+	if body := do(http.MethodGet, "/d/", "").Body.String(); !strings.Contains(body, `href="f"`) {
+		t.Fatalf("listing of /d: %q", body)
+	}
+	if _, inode, err := lookupPath("/d/f"); err != nil || string(readFile(inode)) != "over http" {
+		t.Fatalf("/d/f in image: %v", err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("MKCOL", "/d", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("MKCOL of existing folder: %d", w.Code)
+	}
+}
+
+//Readdir offset past last slot is refused, last slot itself ends folder
+func TestP9ReaddirOffset(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	quiet(t, func() { create("f") })
+	p := &p9Conn{msize: p9MaxSize, fids: map[uint32]*p9Fid{1: {iid: 0}}}
+	readdir := func(offset uint64) ([]byte, error) {
+		req := p9PutU32(nil, 1)
+		req = p9PutU64(req, offset)
+		req = p9PutU32(req, 4096)
+		return p.safeHandle(p9Treaddir, &p9Reader{b: req})
+	}
+	if _, err := readdir(1 << 63); p9Errno(err) != p9EINVAL {
+		t.Fatalf("offset 1<<63: %v", err)
+	}
+	if body, err := readdir(fileCount); err != nil || len(body) != 4 {
+		t.Fatalf("offset at end: %v %x", err, body)
+	}
+	if body, err := readdir(0); err != nil || len(body) <= 4 {
+		t.Fatalf("offset 0: %v %x", err, body)
+	}
+}
+
+//Folder moved into itself or below itself would leave tree unreachable
+func TestRenameIntoSelf(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	logged := quiet(t, func() {
+		mkdir("d")
+		mkdir("s")
+		cd("d")
+		mkdir("e")
+		cd("/")
+		rename("d", "d")
+	})
+	if !strings.Contains(logged, errMoveInside.Error()) {
+		t.Fatalf("rename d d logged %q", logged)
+	}
+	eID, e, err := lookupPath("/d/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renameIn(readInode(0), "d", e, eID, "x"); !errors.Is(err, errMoveInside) {
+		t.Fatalf("move into child: %v", err)
+	}
+	if logged := quiet(t, func() { rename("d", "s") }); logged != "" {
+		t.Fatal(logged)
+	}
+	if _, _, err := lookupPath("/s/d/e"); err != nil {
+		t.Fatal("/s/d/e:", err)
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//rmdir takes exact name, keeps full folders and frees removed one
+func TestRmdir(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	logged := quiet(t, func() {
+		mkdir("d")
+		mkdir("dd")
+		cd("dd")
+		create("f")
+		cd("/")
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	dID, _, _ := lookupPath("/d")
+	for name, want := range map[string]error{"..": errNotFound, "dd": errNotEmpty, "abcdefghijklmnop": errNotFound} {
+		if logged := quiet(t, func() { rmdir(name) }); !strings.Contains(logged, want.Error()) {
+			t.Fatalf("rmdir %s logged %q", name, logged)
+		}
+	}
+	if logged := quiet(t, func() { rmdir("d") }); logged != "" {
+		t.Fatal(logged)
+	}
+	if !inodeFree(readInode(dID)) {
+		t.Fatal("removed folder still holds its inode")
+	}
+	if _, _, err := lookupPath("/dd/f"); err != nil {
+		t.Fatal("/dd/f:", err)
+	}
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Damage only second pass of fsck sees, each case on fresh image
+func TestFsckUnreachable(t *testing.T) {
+	addEntry := func(dir, name string, id int64) {
+		_, inode, err := lookupPath(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bids := inodeBids(inode)
+		writeFolder(bids, appendToFolder(name, id, removeFromFolder(name, readFolder(bids))))
+	}
+	for _, c := range []struct {
+		want   string
+		damage func()
+	}{
+		{"no folder names it", func() {
+			create("f")
+			writeFolder(inodeBids(readInode(0)), removeFromFolder("f", readFolder(inodeBids(readInode(0)))))
+		}},
+		{".. points to inode", func() {
+			mkdir("a")
+			mkdir("b")
+			bID, _, _ := lookupPath("/b")
+			addEntry("/a", "..", bID)
+		}},
+		{"folder cycle", func() {
+			mkdir("a")
+			cd("a")
+			mkdir("b")
+			cd("/")
+			aID, _, _ := lookupPath("/a")
+			addEntry("/a/b", "x", aID)
+		}},
+		{"nothing holds it", func() {
+			if _, err := bget(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		newTestImage(t, 16, 200*KB, mkfsOptions{})
+		quiet(t, c.damage)
+		problems := strings.Join(fsck(), "\n")
+		if !strings.Contains(problems, c.want) {
+			t.Errorf("want %q, fsck found %q", c.want, problems)
+		}
+	}
+}
+
+//Names leaving folder are refused, on export too when image already holds one
+func TestBadNames(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	for _, name := range []string{"", ".", "..", "a/b", "/x"} {
+		if logged := quiet(t, func() { create(name) }); !strings.Contains(logged, errBadName.Error()) {
+			t.Fatalf("create %q logged %q", name, logged)
+		}
+	}
+	quiet(t, func() { create("f") })
+	if err := renameIn(readInode(0), "f", readInode(0), 0, ".."); !errors.Is(err, errBadName) {
+		t.Fatalf("rename to ..: %v", err)
+	}
+	//Forged entry, as other tools could leave it
+	bids := inodeBids(readInode(0))
+	fID, _, _ := lookupPath("/f")
+	writeFolder(bids, appendToFolder("../esc", fID, readFolder(bids)))
+	host := filepath.Join(t.TempDir(), "out")
+	if err := exportTree(0, host); !errors.Is(err, errBadName) {
+		t.Fatalf("export: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(host, "..", "esc")); err == nil {
+		t.Fatal("export wrote outside its folder")
+	}
+}
+
+//Size past blocks extents map is reported, not sliced out of range
+func TestReadShortMapping(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{Extents: true})
+	quiet(t, func() { create("f") })
+	fID, inode, _ := lookupPath("/f")
+	inode.Size = 3 * blockSize
+	writeInode(fID, inode)
+	if _, err := readFileChecked(inode); !errors.Is(err, errCorrupt) {
+		t.Fatalf("size past blocks: %v", err)
+	}
+	inode.Size = -1
+	if _, err := readFileChecked(inode); !errors.Is(err, errCorrupt) {
+		t.Fatalf("negative size: %v", err)
+	}
+}
+
+//Trace of empty image starts quietly, warning comes once it holds entries
+func TestTraceEmptyWarning(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	name := filepath.Join(t.TempDir(), "trace")
+	if logged := quiet(t, func() { startTrace(name); stopTrace() }); logged != "" {
+		t.Fatalf("empty image: %q", logged)
+	}
+	quiet(t, func() { create("f") })
+	if logged := quiet(t, func() { startTrace(name); stopTrace() }); !strings.Contains(logged, "not empty") {
+		t.Fatalf("image with entry: %q", logged)
+	}
+}
+
+//Servers would change image behind trace, they do not start while it records
+func TestTraceRefusesServer(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	name := filepath.Join(t.TempDir(), "trace")
+	if err := startTrace(name); err != nil {
+		t.Fatal(err)
+	}
+	defer stopTrace()
+	sock := filepath.Join(t.TempDir(), "9p.sock")
+	if logged := quiet(t, func() { serve9P(sock) }); !strings.Contains(logged, errTracing.Error()) {
+		t.Fatalf("9p while tracing logged %q", logged)
+	}
+	if _, err := os.Stat(sock); err == nil {
+		t.Fatal("9p listened while tracing")
+	}
+}
+
+//Tstatfs counts what is free now, not what mkfs left
+func TestP9Statfs(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	p := &p9Conn{msize: p9MaxSize, fids: map[uint32]*p9Fid{1: {iid: 0}}}
+	statfs := func() (bfree, ffree uint64) {
+		body, err := p.safeHandle(p9Tstatfs, &p9Reader{b: p9PutU32(nil, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &p9Reader{b: body}
+		r.u32()
+		r.u32()
+		r.u64()
+		bfree = r.u64()
+		r.u64()
+		r.u64()
+		return bfree, r.u64()
+	}
+	b0, f0 := statfs()
+	data := bytes.Repeat([]byte("z"), 3*int(blockSize))
+	quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &data)
+		close(0)
+	})
+	if b1, f1 := statfs(); b1 != b0-3 || f1 != f0-1 {
+		t.Fatalf("free blocks %d -> %d, inodes %d -> %d", b0, b1, f0, f1)
+	}
+}
+
+//Front-ends share one table, wrapped errors map like bare ones
+func TestErrno(t *testing.T) {
+	for _, err := range []error{errNotFound, errNoAttr, errBadNamespace, errAttrTooBig, errNoSpace} {
+		wrapped := fmt.Errorf("x: %w", err)
+		if p9Errno(wrapped) != p9Errno(err) || p9Errno(err) == p9EIO {
+			t.Errorf("%v: errno %d, wrapped %d", err, p9Errno(err), p9Errno(wrapped))
+		}
+	}
+	if !errors.Is(davErr(fmt.Errorf("x: %w", errNotFound)), os.ErrNotExist) {
+		t.Error("wrapped errNotFound is not os.ErrNotExist for WebDAV")
+	}
+	if p9Errno(p9Error(p9EBADF)) != p9EBADF {
+		t.Error("protocol errno changed")
+	}
+}
+
+//Soft limit holds for grace period, hard limit never, report shows usage
+func TestQuotaLimits(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	users, _ := quotaUsages()
+	used := users[curUid].Inodes
+	if err := setQuota(false, curUid, 0, 0, used+1, used+3); err != nil {
+		t.Fatal(err)
+	}
+	create := func(name string) error {
+		_, err := createIn(readInode(0), name, 0, curUid, curGid)
+		return err
+	}
+	entry := func() *Quota {
+		tbl := readQuotaTable()
+		for k, q := range tbl.Entries {
+			if !q.unused() {
+				return &tbl.Entries[k]
+			}
+		}
+		t.Fatal("quota entry missing")
+		return nil
+	}
+	if err := create("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("b"); err != nil || entry().InodeUntil == 0 {
+		t.Fatalf("past soft limit: %v, grace until %d", err, entry().InodeUntil)
+	}
+	if err := create("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("d"); !errors.Is(err, errQuota) {
+		t.Fatalf("past hard limit: %v", err)
+	}
+
+	//Grace over refuses even under hard limit
+	quiet(t, func() { unlink("c") })
+	tbl := readQuotaTable()
+	for k := range tbl.Entries {
+		if !tbl.Entries[k].unused() {
+			tbl.Entries[k].InodeUntil = time.Now().Unix() - 1
+		}
+	}
+	writeQuotaTable(tbl)
+	if err := create("c"); !errors.Is(err, errQuota) {
+		t.Fatalf("grace over: %v", err)
+	}
+
+	//Back under soft limit clears grace
+	quiet(t, func() {
+		unlink("a")
+		unlink("b")
+	})
+	if err := create("a"); err != nil || entry().InodeUntil != 0 {
+		t.Fatalf("under soft limit: %v, grace until %d", err, entry().InodeUntil)
+	}
+	var reported bool
+	for _, l := range quotaReport() {
+		if l.Kind == "user" && l.ID == curUid {
+			reported = l.Inodes == used+1 && l.InodeHard == used+3
+		}
+	}
+	if !reported {
+		t.Fatalf("report %+v", quotaReport())
+	}
+}
+
+//Folder blocks count against quota like file blocks
+func TestQuotaMkdir(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	users, _ := quotaUsages()
+	used := users[curUid].Blocks
+	if err := setQuota(false, curUid, 0, used, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	quiet(t, func() { _, err = mkdirIn(readInode(0), 0, "d", curUid, curGid) })
+	if !errors.Is(err, errQuota) {
+		t.Fatalf("mkdir past block limit: %v", err)
+	}
+	if _, _, err := lookupPath("/d"); !errors.Is(err, errNotFound) {
+		t.Fatalf("/d made past limit: %v", err)
+	}
+}
+
+//Counters kept by writeInode match count from table
+func TestQuotaCounters(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	quotaUsages()
+	data := bytes.Repeat([]byte{7}, 3*int(blockSize))
+	quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &data)
+		close(0)
+		mkdir("d")
+		create("g")
+		truncate("f", blockSize)
+		unlink("g")
+		rmdir("d")
+	})
+	kept := fmt.Sprint(quotaUsages())
+	quotaUsers, quotaGroups = nil, nil
+	if counted := fmt.Sprint(quotaUsages()); kept != counted {
+		t.Fatalf("kept %s, counted %s", kept, counted)
+	}
+}
+
+//Blocks of one write are counted together before inode is stored
+func TestQuotaWriteCharge(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	users, _ := quotaUsages()
+	used := users[curUid].Blocks
+	if err := setQuota(false, curUid, 0, used+2, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	quiet(t, func() { create("f") })
+	iid, inode, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{7}, 5*int(blockSize))
+	if _, err := writeFile(iid, inode, 0, data); !errors.Is(err, errQuota) {
+		t.Fatalf("write past block limit: %v", err)
+	}
+	users, _ = quotaUsages()
+	if users[curUid].Blocks > used+2 {
+		t.Fatalf("%d blocks used past limit %d", users[curUid].Blocks, used+2)
+	}
+}
+
+//Writes recompress only clusters they touch, contents match plain copy
+func TestCompressClusters(t *testing.T) {
+	newTestImage(t, 16, 600*KB, mkfsOptions{Extents: true})
+	quiet(t, func() { create("f") })
+	iid, _, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setCompression(iid, true); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	want := bytes.Repeat([]byte("compressible "), 5*int(clusterSize)/13)
+	write := func(off int64, data []byte) {
+		t.Helper()
+		if _, err := writeFile(iid, readInode(iid), off, data); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + int64(len(data)); end > int64(len(want)) {
+			want = append(want, make([]byte, end-int64(len(want)))...)
+		}
+		copy(want[off:], data)
+	}
+	check := func(what string) {
+		t.Helper()
+		got, err := readFileChecked(readInode(iid))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: contents differ, %v", what, err)
+		}
+	}
+	write(0, want)
+	check("write")
+	if kept := keptSize(readInode(iid)); kept >= int64(len(want)) {
+		t.Fatalf("%d bytes kept for %d", kept, len(want))
+	}
+
+	//Write inside cluster 3 leaves slots of others alone
+	before := fileBids(readInode(iid))
+	noise := make([]byte, 100)
+	r.Read(noise)
+	write(3*clusterSize+10, noise)
+	check("small write")
+	after := fileBids(readInode(iid))
+	for k := range before {
+		if int64(k)/clusterBlocks != 3 && before[k] != after[k] {
+			t.Fatalf("block %d of other cluster moved %d -> %d", k, before[k], after[k])
+		}
+	}
+
+	//Random cluster is kept plain, growing past end leaves holes between
+	write(6*clusterSize+5, noise)
+	check("write past end")
+	big := make([]byte, clusterSize)
+	r.Read(big)
+	write(clusterSize, big)
+	check("incompressible")
+	i := readInode(iid)
+	if i, err = resizeFile(i, 2*clusterSize+7, newCharge(i)); err != nil {
+		t.Fatal(err)
+	}
+	writeInode(iid, i)
+	want = want[:2*clusterSize+7]
+	check("truncate")
+	if i, err = fallocate(readInode(iid), 5, clusterSize, fallocPunchHole); err != nil {
+		t.Fatal(err)
+	}
+	writeInode(iid, i)
+	for k := int64(5); k < 5+clusterSize; k++ {
+		want[k] = 0
+	}
+	check("punch")
+	if err := setCompression(iid, false); err != nil {
+		t.Fatal(err)
+	}
+	check("uncompress")
+	if problems := fsck(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+}
+
+//Damaged logical size is reported, not allocated
+func TestCompressBadSize(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	data := bytes.Repeat([]byte("abc"), 1000)
+	quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &data)
+		close(0)
+	})
+	iid, _, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setCompression(iid, true); err != nil {
+		t.Fatal(err)
+	}
+	i := readInode(iid)
+	i.Size = maxFileBlocks * blockSize
+	if _, err := readFileChecked(i); !errors.Is(err, errCorrupt) {
+		t.Fatalf("size %d: %v", i.Size, err)
+	}
+}
+
+//Ranges read alone match same bytes of whole file, plain and compressed
+func TestReadFileRange(t *testing.T) {
+	newTestImage(t, 16, 600*KB, mkfsOptions{Extents: true})
+	r := rand.New(rand.NewSource(2))
+	data := testData(r)
+	data = append(data, bytes.Repeat([]byte("xyz"), 3*int(clusterSize)/3)...)
+	quiet(t, func() {
+		create("f")
+		open("f")
+		write(0, &data)
+		close(0)
+		truncate("f", int64(len(data))+blockSize+3)
+	})
+	data = append(data, make([]byte, blockSize+3)...)
+	iid, _, err := lookupPath("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compressed := range []bool{false, true} {
+		if err := setCompression(iid, compressed); err != nil {
+			t.Fatal(err)
+		}
+		i := readInode(iid)
+		for k := 0; k < 200; k++ {
+			off, n := r.Int63n(int64(len(data))+10), r.Int63n(2*clusterSize)
+			end := off + n
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			got, err := readFileRange(i, off, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if off < end && !bytes.Equal(got, data[off:end]) || off >= end && len(got) != 0 {
+				t.Fatalf("compressed %t: range %d+%d differs", compressed, off, n)
+			}
+		}
+	}
+}
+
+//Front-ends name owner of new inodes, shell user stays as it was
+func TestCreateOwner(t *testing.T) {
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	uid, gid := curUid, curGid
+	fid, err := createIn(readInode(0), "f", 0, 5, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	did, err := mkdirIn(readInode(0), 0, "d", 7, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, d := readInode(fid), readInode(did); f.Uid != 5 || f.Gid != 6 || d.Uid != 7 || d.Gid != 8 {
+		t.Fatalf("owners %d:%d and %d:%d", f.Uid, f.Gid, d.Uid, d.Gid)
+	}
+	if curUid != uid || curGid != gid {
+		t.Fatalf("shell user changed to %d:%d", curUid, curGid)
+	}
+}
+
+//Exported symlink keeps its own mtime, target is not touched
+func TestExportSymlinkTime(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("symlink times are set on Linux only")
+	}
+	newTestImage(t, 16, 200*KB, mkfsOptions{})
+	quiet(t, func() { symlink("missing", "l") })
+	iid, inode, err := lookupPath("/l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode.Mtime = 1000000
+	writeInode(iid, inode)
+	host := t.TempDir()
+	if err := exportTree(0, host); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(host, "l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Unix() != 1000000 {
+		t.Fatalf("symlink mtime %v", info.ModTime())
+	}
+}
@@ -0,0 +1,768 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+//-------------------------9P2000.L layer---------------------------
+//Exports image over network so v9fs (QEMU guests, Linux kernel)
+//can mount it, messages are mapped onto inode and folder operations
+
+const (
+	p9Version = "9P2000.L"
+	p9MaxSize = 64 * 1024
+	p9NoFid   = ^uint32(0)
+	p9HdrSize = 4 + 1 + 2
+	p9IOHdr   = 24 //Header of Rread/Twrite before data
+)
+
+//Message types, T is request and R = T+1 is its reply
+const (
+	p9Rlerror    = 7
+	p9Tstatfs    = 8
+	p9Tlopen     = 12
+	p9Tlcreate   = 14
+	p9Tsymlink   = 16
+	p9Trename    = 20
+	p9Treadlink  = 22
+	p9Tgetattr   = 24
+	p9Tsetattr   = 26
+	p9Txattrwalk = 30
+	p9Treaddir   = 40
+	p9Tfsync     = 50
+	p9Tlock      = 52
+	p9Tgetlock   = 54
+	p9Tlink      = 70
+	p9Tmkdir     = 72
+	p9Trenameat  = 74
+	p9Tunlinkat  = 76
+	p9Tversion   = 100
+	p9Tauth      = 102
+	p9Tattach    = 104
+	p9Tflush     = 108
+	p9Twalk      = 110
+	p9Tread      = 116
+	p9Twrite     = 118
+	p9Tclunk     = 120
+	p9Tremove    = 122
+)
+
+//Qid types
+const (
+	p9QTDir     = 0x80
+	p9QTSymlink = 0x02
+	p9QTFile    = 0x00
+)
+
+//Linux errno values, clients expect them whatever host we run on
+const (
+	p9EPERM        = 1
+	p9ENOENT       = 2
+	p9EIO          = 5
+	p9ENXIO        = 6
+	p9EBADF        = 9
+	p9EEXIST       = 17
+	p9EXDEV        = 18
+	p9ENOTDIR      = 20
+	p9EISDIR       = 21
+	p9EINVAL       = 22
+	p9EFBIG        = 27
+	p9ENOSPC       = 28
+	p9ENAMETOOLONG = 36
+	p9ENOSYS       = 38
+	p9ENOTEMPTY    = 39
+	p9ENODATA      = 61
+	p9EDQUOT       = 122
+	p9EOPNOTSUPP   = 95
+)
+
+const (
+	p9OTrunc       = 01000 //Linux O_TRUNC in Tlopen/Tlcreate flags
+	p9AtRemoveDir  = 0x200 //Tunlinkat flag
+	p9GetattrBasic = 0x7ff
+	p9SetattrMode  = 0x1
+	p9SetattrUid   = 0x2
+	p9SetattrGid   = 0x4
+	p9SetattrSize  = 0x8
+	p9SetattrMtime = 0x20
+	p9SetattrMset  = 0x100 //Mtime is given, not current time
+	p9StatfsMagic  = 0x01021997
+)
+
+//Client side handle of inode
+type p9Fid struct {
+	iid    int64
+	opened bool
+	uid    uint32 //User attached, owns created inodes
+}
+
+type p9Conn struct {
+	rw    io.ReadWriter
+	msize uint32
+	fids  map[uint32]*p9Fid
+}
+
+//Protocol error carries errno to be sent in Rlerror
+type p9Error uint32
+
+func (e p9Error) Error() string {
+	return fmt.Sprintf("9P errno %d", uint32(e))
+}
+
+func p9Errno(err error) p9Error {
+	return p9Error(errnoOf(err))
+}
+
+//Serves image on addr until Ctrl-C, path with / is unix socket
+func serve9P(addr string) {
+	if err := checkNotTracing(); err != nil {
+		log.Println(err)
+		return
+	}
+	mountIfNeeded()
+	network := "tcp"
+	if strings.Contains(addr, "/") {
+		network = "unix"
+		os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("Serving %s on %s %s, press Ctrl-C to return\n", p9Version, network, addr)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			defer c.Close()
+			p := &p9Conn{rw: c, msize: p9MaxSize, fids: map[uint32]*p9Fid{}}
+			err := p.serve()
+			if err != nil && err != io.EOF {
+				log.Println(err)
+			}
+		}()
+	}
+	signal.Stop(sig)
+
+	fsMu.Lock()
+	umount()
+	fsMu.Unlock()
+}
+
+//Reads requests one by one, so Tflush has nothing to cancel
+func (p *p9Conn) serve() error {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(p.rw, hdr[:]); err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(hdr[:])
+		if size < p9HdrSize || size > p.msize {
+			return fmt.Errorf("9P message of invalid size %d", size)
+		}
+		msg := make([]byte, size-4)
+		if _, err := io.ReadFull(p.rw, msg); err != nil {
+			return err
+		}
+		typ := msg[0]
+		tag := binary.LittleEndian.Uint16(msg[1:3])
+		r := &p9Reader{b: msg[3:]}
+
+		fsMu.Lock()
+		body, err := p.safeHandle(typ, r)
+		fsMu.Unlock()
+		if err == nil && r.short {
+			err = p9Error(p9EINVAL)
+		}
+
+		reply := typ + 1
+		if err != nil {
+			reply = p9Rlerror
+			body = p9PutU32(nil, uint32(p9Errno(err)))
+		}
+		out := p9PutU32(nil, uint32(p9HdrSize+len(body)))
+		out = append(out, reply)
+		out = p9PutU16(out, tag)
+		out = append(out, body...)
+		if _, err := p.rw.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *p9Conn) fid(id uint32) (*p9Fid, error) {
+	f, ok := p.fids[id]
+	if !ok {
+		return nil, p9Error(p9EBADF)
+	}
+	return f, nil
+}
+
+//Malformed request must not take server down, panic is answered EIO
+func (p *p9Conn) safeHandle(typ uint8, r *p9Reader) (body []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Println("9P request", typ, "failed:", v)
+			body, err = nil, p9Error(p9EIO)
+		}
+	}()
+	return p.handle(typ, r)
+}
+
+//Decodes request body and returns reply body
+func (p *p9Conn) handle(typ uint8, r *p9Reader) ([]byte, error) {
+	switch typ {
+	case p9Tversion:
+		msize := r.u32()
+		version := r.str()
+		if msize < p.msize {
+			p.msize = msize
+		}
+		//Any version resets the session
+		p.fids = map[uint32]*p9Fid{}
+		if version != p9Version {
+			version = "unknown"
+		}
+		out := p9PutU32(nil, p.msize)
+		return p9PutStr(out, version), nil
+
+	case p9Tauth:
+		return nil, p9Error(p9EOPNOTSUPP)
+
+	case p9Tattach:
+		fid := r.u32()
+		r.u32() //afid
+		r.str() //uname
+		r.str() //aname
+		p.fids[fid] = &p9Fid{iid: 0, uid: r.u32()}
+		return p9PutQid(nil, 0, readInode(0)), nil
+
+	case p9Tflush:
+		return nil, nil
+
+	case p9Twalk:
+		fid, newfid, n := r.u32(), r.u32(), r.u16()
+		f, err := p.fid(fid)
+		if err != nil {
+			return nil, err
+		}
+		iid := f.iid
+		var qids []byte
+		for i := 0; i < int(n); i++ {
+			name := r.str()
+			inode := readInode(iid)
+			next, ok := int64(0), false
+			if inode.Mode == 1 {
+				next, ok = folderLookup(name, readFolder(inodeBids(inode)))
+			}
+			//Root has no .. entry and stays where it is
+			if !ok && name == ".." && iid == 0 {
+				next, ok = 0, true
+			}
+			if !ok {
+				if i == 0 {
+					return nil, p9Error(p9ENOENT)
+				}
+				//Partial walk, newfid is not made
+				return append(p9PutU16(nil, uint16(i)), qids...), nil
+			}
+			iid = next
+			qids = p9PutQid(qids, iid, readInode(iid))
+		}
+		p.fids[newfid] = &p9Fid{iid: iid, uid: f.uid}
+		return append(p9PutU16(nil, n), qids...), nil
+
+	case p9Tclunk, p9Tremove:
+		//Tremove is not sent by v9fs for 9P2000.L, unlinkat is used instead
+		fid := r.u32()
+		if _, err := p.fid(fid); err != nil {
+			return nil, err
+		}
+		delete(p.fids, fid)
+		if typ == p9Tremove {
+			return nil, p9Error(p9EOPNOTSUPP)
+		}
+		return nil, nil
+
+	case p9Tlopen:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		flags := r.u32()
+		inode := readInode(f.iid)
+		if flags&p9OTrunc != 0 && inode.Mode == 0 {
+			inode, err = resizeFile(inode, 0, newCharge(inode))
+			if err != nil {
+				return nil, err
+			}
+			writeInode(f.iid, inode)
+		}
+		f.opened = true
+		out := p9PutQid(nil, f.iid, inode)
+		return p9PutU32(out, p.msize-p9IOHdr), nil
+
+	case p9Tlcreate:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		name := r.str()
+		r.u32() //flags
+		mode := r.u32()
+		gid := r.u32()
+		dir := readInode(f.iid)
+		if err := checkNewEntry(dir, name); err != nil {
+			return nil, err
+		}
+		//Fid now stands for the new opened file
+		iid, err := createIn(dir, name, 0, f.uid, gid)
+		if err != nil {
+			return nil, err
+		}
+		f.iid = iid
+		chmodInode(f.iid, mode)
+		f.opened = true
+		out := p9PutQid(nil, f.iid, readInode(f.iid))
+		return p9PutU32(out, p.msize-p9IOHdr), nil
+
+	case p9Tmkdir, p9Tsymlink:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		name := r.str()
+		//Tmkdir carries mode, Tsymlink target, both end with gid
+		var mode uint32
+		var target string
+		if typ == p9Tmkdir {
+			mode = r.u32()
+		} else {
+			target = r.str()
+		}
+		gid := r.u32()
+		dir := readInode(f.iid)
+		if err := checkNewEntry(dir, name); err != nil {
+			return nil, err
+		}
+		var iid int64
+		if typ == p9Tmkdir {
+			if iid, err = mkdirIn(dir, f.iid, name, f.uid, gid); err != nil {
+				return nil, err
+			}
+			chmodInode(iid, mode)
+		} else {
+			if iid, err = createIn(dir, name, 2, f.uid, gid); err != nil {
+				return nil, err
+			}
+			if _, err := writeFile(iid, readInode(iid), 0, []byte(target)); err != nil {
+				return nil, err
+			}
+		}
+		return p9PutQid(nil, iid, readInode(iid)), nil
+
+	case p9Treadlink:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		inode := readInode(f.iid)
+		if inode.Mode != 2 {
+			return nil, p9Error(p9EINVAL)
+		}
+		return p9PutStr(nil, string(readFile(inode))), nil
+
+	case p9Tgetattr:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		return p9PutAttr(f.iid, readInode(f.iid)), nil
+
+	case p9Tsetattr:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		valid, mode := r.u32(), r.u32()
+		uid, gid := r.u32(), r.u32()
+		size := r.u64()
+		r.u64() //atime_sec
+		r.u64() //atime_nsec
+		mtime := r.u64()
+		//Access time is not stored
+		inode := readInode(f.iid)
+		if valid&(p9SetattrUid|p9SetattrGid) != 0 {
+			if valid&p9SetattrUid == 0 {
+				uid = inode.Uid
+			}
+			if valid&p9SetattrGid == 0 {
+				gid = inode.Gid
+			}
+			if err := chownInode(f.iid, uid, gid); err != nil {
+				return nil, err
+			}
+			inode = readInode(f.iid)
+		}
+		if valid&p9SetattrSize != 0 {
+			if inode.Mode != 0 {
+				return nil, p9Error(p9EISDIR)
+			}
+			inode, err = resizeFile(inode, int64(size), newCharge(inode))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if valid&p9SetattrMode != 0 {
+			inode.Perm = mode & 07777
+		}
+		if valid&p9SetattrMtime != 0 {
+			inode.Mtime = time.Now().Unix()
+			if valid&p9SetattrMset != 0 {
+				inode.Mtime = int64(mtime)
+			}
+		}
+		writeInode(f.iid, inode)
+		return nil, nil
+
+	case p9Txattrwalk:
+		return nil, p9Error(p9EOPNOTSUPP)
+
+	case p9Treaddir:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		offset, count := r.u64(), r.u32()
+		inode := readInode(f.iid)
+		if inode.Mode != 1 {
+			return nil, p9Error(p9ENOTDIR)
+		}
+		//Offset of entry is its slot in folder + 1, last one ends folder
+		if offset > fileCount {
+			return nil, p9Error(p9EINVAL)
+		}
+		folder := readFolder(inodeBids(inode))
+		var data []byte
+		for k := int(offset); k < fileCount; k++ {
+			v := folder.FileName[k]
+			name := entryName(v)
+			if v[0] == 0 || name == ".." {
+				continue
+			}
+			iid := folder.FileInodeID[k]
+			child := readInode(iid)
+			entry := p9PutQid(nil, iid, child)
+			entry = p9PutU64(entry, uint64(k+1))
+			entry = append(entry, p9DirentType(child))
+			entry = p9PutStr(entry, name)
+			if len(data)+len(entry) > int(count) {
+				break
+			}
+			data = append(data, entry...)
+		}
+		out := p9PutU32(nil, uint32(len(data)))
+		return append(out, data...), nil
+
+	case p9Tread:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		offset, count := r.u64(), r.u32()
+		inode := readInode(f.iid)
+		if inode.Mode == 1 {
+			return nil, p9Error(p9EISDIR)
+		}
+		data, err := readFileChecked(inode)
+		if err != nil {
+			return nil, err
+		}
+		if offset > uint64(len(data)) {
+			offset = uint64(len(data))
+		}
+		data = data[offset:]
+		if uint32(len(data)) > count {
+			data = data[:count]
+		}
+		out := p9PutU32(nil, uint32(len(data)))
+		return append(out, data...), nil
+
+	case p9Twrite:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		offset, count := r.u64(), r.u32()
+		data := r.bytes(int(count))
+		if readInode(f.iid).Mode != 0 {
+			return nil, p9Error(p9EISDIR)
+		}
+		if _, err := writeFile(f.iid, readInode(f.iid), int64(offset), data); err != nil {
+			return nil, err
+		}
+		return p9PutU32(nil, uint32(len(data))), nil
+
+	case p9Tfsync:
+		return nil, nil
+
+	case p9Tlock:
+		//Single user image, every lock succeeds
+		return []byte{0}, nil
+
+	case p9Tgetlock:
+		r.u32() //fid
+		r.u8()  //type
+		start, length, procID := r.u64(), r.u64(), r.u32()
+		clientID := r.str()
+		out := []byte{2} //F_UNLCK
+		out = p9PutU64(out, start)
+		out = p9PutU64(out, length)
+		out = p9PutU32(out, procID)
+		return p9PutStr(out, clientID), nil
+
+	case p9Tlink:
+		d, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		name := r.str()
+		if readInode(f.iid).Mode == 1 {
+			return nil, p9Error(p9EPERM)
+		}
+		return nil, linkIn(readInode(d.iid), name, f.iid)
+
+	case p9Trename:
+		f, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		d, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		name := r.str()
+		//Fid does not know its own name, find it through parent
+		parent, oldName, ok := p9FindEntry(f.iid)
+		if !ok {
+			return nil, p9Error(p9ENOENT)
+		}
+		return nil, renameIn(readInode(parent), oldName, readInode(d.iid), d.iid, name)
+
+	case p9Trenameat:
+		od, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		oldName := r.str()
+		nd, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		newName := r.str()
+		return nil, renameIn(readInode(od.iid), oldName, readInode(nd.iid), nd.iid, newName)
+
+	case p9Tunlinkat:
+		d, err := p.fid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		name := r.str()
+		flags := r.u32()
+		return nil, removeEntry(readInode(d.iid), name, flags&p9AtRemoveDir != 0)
+
+	case p9Tstatfs:
+		if _, err := p.fid(r.u32()); err != nil {
+			return nil, err
+		}
+		//Superblock counts are never updated, tables are counted instead
+		free := uint64(freeBlockCount())
+		out := p9PutU32(nil, p9StatfsMagic)
+		out = p9PutU32(out, uint32(blockSize))
+		out = p9PutU64(out, uint64(SB.BlockTableSize))
+		out = p9PutU64(out, free)
+		out = p9PutU64(out, free)
+		out = p9PutU64(out, uint64(SB.InodeTableSize))
+		out = p9PutU64(out, uint64(freeInodeCount()))
+		out = p9PutU64(out, 0)
+		return p9PutU32(out, fileNameSize), nil
+	}
+	return nil, p9Error(p9ENOSYS)
+}
+
+//Searches folders from root for entry pointing at iid
+func p9FindEntry(iid int64) (int64, string, bool) {
+	visited := map[int64]bool{}
+	queue := []int64{0}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		if visited[dir] {
+			continue
+		}
+		visited[dir] = true
+		folder := readFolder(inodeBids(readInode(dir)))
+		for k, v := range folder.FileName {
+			name := entryName(v)
+			if v[0] == 0 || name == ".." {
+				continue
+			}
+			if folder.FileInodeID[k] == iid {
+				return dir, name, true
+			}
+			if readInode(folder.FileInodeID[k]).Mode == 1 {
+				queue = append(queue, folder.FileInodeID[k])
+			}
+		}
+	}
+	return 0, "", false
+}
+
+func p9DirentType(i Inode) uint8 {
+	switch i.Mode {
+	case 1:
+		return 4 //DT_DIR
+	case 2:
+		return 10 //DT_LNK
+	default:
+		return 8 //DT_REG
+	}
+}
+
+//-------------------------Wire format---------------------------
+//Little endian integers, strings are prefixed with 2 byte length
+
+type p9Reader struct {
+	b     []byte
+	short bool
+}
+
+func (r *p9Reader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.short = true
+		n = len(r.b)
+	}
+	res := r.b[:n]
+	r.b = r.b[n:]
+	return res
+}
+
+func (r *p9Reader) u8() uint8 {
+	b := r.bytes(1)
+	if len(b) < 1 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *p9Reader) u16() uint16 {
+	b := r.bytes(2)
+	if len(b) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *p9Reader) u32() uint32 {
+	b := r.bytes(4)
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *p9Reader) u64() uint64 {
+	b := r.bytes(8)
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *p9Reader) str() string {
+	return string(r.bytes(int(r.u16())))
+}
+
+func p9PutU16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func p9PutU32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func p9PutU64(b []byte, v uint64) []byte {
+	return p9PutU32(p9PutU32(b, uint32(v)), uint32(v>>32))
+}
+
+func p9PutStr(b []byte, s string) []byte {
+	return append(p9PutU16(b, uint16(len(s))), s...)
+}
+
+//Qid path is inode id, version is unused
+func p9PutQid(b []byte, iid int64, i Inode) []byte {
+	typ := uint8(p9QTFile)
+	switch i.Mode {
+	case 1:
+		typ = p9QTDir
+	case 2:
+		typ = p9QTSymlink
+	}
+	b = append(b, typ)
+	b = p9PutU32(b, 0)
+	return p9PutU64(b, uint64(iid))
+}
+
+//Body of Rgetattr
+func p9PutAttr(iid int64, i Inode) []byte {
+	mode := uint32(0100000)
+	switch i.Mode {
+	case 1:
+		mode = 040000
+	case 2:
+		mode = 0120000
+	}
+	mode |= inodePerm(i)
+	out := p9PutU64(nil, p9GetattrBasic)
+	out = p9PutQid(out, iid, i)
+	out = p9PutU32(out, mode)
+	out = p9PutU32(out, i.Uid)
+	out = p9PutU32(out, i.Gid)
+	out = p9PutU64(out, uint64(inodeNlink(i)))
+	out = p9PutU64(out, 0) //rdev
+	out = p9PutU64(out, uint64(i.Size))
+	out = p9PutU64(out, uint64(blockSize))
+	out = p9PutU64(out, uint64(len(inodeBlocks(i)))*uint64(blockSize/512))
+	//atime, mtime, ctime (sec, nsec) are all modification time
+	for k := 0; k < 3; k++ {
+		out = p9PutU64(out, uint64(i.Mtime))
+		out = p9PutU64(out, 0)
+	}
+	//btime (sec, nsec), gen, data_version
+	for k := 0; k < 4; k++ {
+		out = p9PutU64(out, 0)
+	}
+	return out
+}
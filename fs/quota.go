@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-------------------------Quotas---------------------------
+//Limits on blocks and inodes per user and per group. Usage is counted
+//over allocated inodes once and then kept up to date as inodes are written.
+//Soft limit may be exceeded for grace period, hard limit never
+
+const maxQuotas = 64
+const defaultGrace = 7 * 24 * time.Hour
+
+var quotaMagic = [4]byte{'Q', 'U', 'O', 'T'}
+
+//Lives in block SuperBlock.Quotas
+type QuotaTable struct {
+	Magic      [4]byte //Checked by fsck
+	BlockGrace int64   //Seconds soft block limit may be exceeded
+	InodeGrace int64
+	Entries    [maxQuotas]Quota
+}
+
+//Entry with all limits 0 is unused
+type Quota struct {
+	Group      bool //Limits group, user otherwise
+	ID         uint32
+	BlockSoft  int64
+	BlockHard  int64
+	InodeSoft  int64
+	InodeHard  int64
+	BlockUntil int64 //Unix seconds when grace of soft limit ends, 0 under it
+	InodeUntil int64
+}
+
+var errQuota = errors.New("disk quota exceeded")
+
+//Owner id no quota entry matches, checks skip it
+const noOwner = ^uint32(0)
+
+type quotaUsage struct {
+	Blocks int64
+	Inodes int64
+}
+
+//Line of quota report
+type quotaLine struct {
+	Kind       string `json:"kind"` //user or group
+	ID         uint32 `json:"id"`
+	Blocks     int64  `json:"blocks"`
+	BlockSoft  int64  `json:"block_soft"`
+	BlockHard  int64  `json:"block_hard"`
+	BlockUntil int64  `json:"block_grace_until,omitempty"`
+	Inodes     int64  `json:"inodes"`
+	InodeSoft  int64  `json:"inode_soft"`
+	InodeHard  int64  `json:"inode_hard"`
+	InodeUntil int64  `json:"inode_grace_until,omitempty"`
+}
+
+func (q Quota) unused() bool {
+	return q.BlockSoft == 0 && q.BlockHard == 0 && q.InodeSoft == 0 && q.InodeHard == 0
+}
+
+func quotaKind(group bool) string {
+	if group {
+		return "group"
+	}
+	return "user"
+}
+
+func readQuotaTable() QuotaTable {
+	block := readBlock(SB.Quotas)
+	var t QuotaTable
+	err := binary.Read(bytes.NewReader(block.Data[:]), binary.BigEndian, &t)
+	if err != nil {
+		log.Println(err)
+	}
+	return t
+}
+
+func writeQuotaTable(t QuotaTable) {
+	binBuf := new(bytes.Buffer)
+	err := binary.Write(binBuf, binary.BigEndian, t)
+	if err != nil {
+		log.Println(err)
+	}
+	block := Block{}
+	copy(block.Data[:], binBuf.Bytes())
+	storeBlock(SB.Quotas, block, true)
+}
+
+//Allocates quota table on first limit
+func ensureQuotaTable() error {
+	if SB.Quotas != 0 {
+		return nil
+	}
+	b, err := bget()
+	if err != nil {
+		return err
+	}
+	SB.Quotas = b
+	SB.Modified = true
+	t := QuotaTable{Magic: quotaMagic,
+		BlockGrace: int64(defaultGrace / time.Second), InodeGrace: int64(defaultGrace / time.Second)}
+	writeQuotaTable(t)
+	return nil
+}
+
+//Usage per user and per group, counted from inode table once then kept
+//by writeInode. Nil until counted, mount, fsck, resize and rollback drop it
+var quotaUsers, quotaGroups map[uint32]quotaUsage
+
+func quotaUsages() (map[uint32]quotaUsage, map[uint32]quotaUsage) {
+	if quotaUsers != nil {
+		return quotaUsers, quotaGroups
+	}
+	quotaUsers, quotaGroups = map[uint32]quotaUsage{}, map[uint32]quotaUsage{}
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		chargeUsage(readInode(in), 1)
+	}
+	return quotaUsers, quotaGroups
+}
+
+//Adds blocks and inode of i to counters of its owners, sign -1 takes them off
+func chargeUsage(i Inode, sign int64) {
+	if quotaUsers == nil || inodeFree(i) {
+		return
+	}
+	n := sign * int64(len(inodeBlocks(i)))
+	u, g := quotaUsers[i.Uid], quotaGroups[i.Gid]
+	u.Blocks, u.Inodes = u.Blocks+n, u.Inodes+sign
+	g.Blocks, g.Inodes = g.Blocks+n, g.Inodes+sign
+	quotaUsers[i.Uid], quotaGroups[i.Gid] = u, g
+}
+
+//Applies limit to usage growing by add, starts or clears grace period
+func checkLimit(used, add, soft, hard int64, until *int64, grace int64) error {
+	n := used + add
+	if hard > 0 && n > hard {
+		return errQuota
+	}
+	now := time.Now().Unix()
+	if soft > 0 && n > soft {
+		if *until == 0 {
+			*until = now + grace
+		} else if now > *until {
+			return errQuota
+		}
+	} else {
+		*until = 0
+	}
+	return nil
+}
+
+//Fails with errQuota if owners uid and gid can not get more blocks and inodes
+func checkQuota(uid, gid uint32, blocks, inodes int64) error {
+	if SB.Quotas == 0 || snapView != nil {
+		return nil
+	}
+	t := readQuotaTable()
+	old := t
+	var users, groups map[uint32]quotaUsage
+	var err error
+	for k, q := range t.Entries {
+		if q.unused() || (q.Group && q.ID != gid) || (!q.Group && q.ID != uid) {
+			continue
+		}
+		if users == nil {
+			users, groups = quotaUsages()
+		}
+		u := users[uid]
+		if q.Group {
+			u = groups[gid]
+		}
+		e := &t.Entries[k]
+		if err = checkLimit(u.Blocks, blocks, e.BlockSoft, e.BlockHard, &e.BlockUntil, t.BlockGrace); err != nil {
+			break
+		}
+		if err = checkLimit(u.Inodes, inodes, e.InodeSoft, e.InodeHard, &e.InodeUntil, t.InodeGrace); err != nil {
+			break
+		}
+	}
+	if t != old {
+		writeQuotaTable(t)
+	}
+	return err
+}
+
+//Owners blocks of one change go to, with blocks given before inode is
+//stored, counters miss those until writeInode
+type blockCharge struct {
+	uid, gid uint32
+	pending  int64
+}
+
+func newCharge(i Inode) *blockCharge {
+	return &blockCharge{uid: i.Uid, gid: i.Gid}
+}
+
+//Block charged to owners of c, placed at goal when possible
+func allocBlock(c *blockCharge, goal int64) (int64, error) {
+	if err := checkQuota(c.uid, c.gid, 1+c.pending, 0); err != nil {
+		return 0, err
+	}
+	b, err := bgetNear(goal)
+	if err != nil {
+		return 0, err
+	}
+	c.pending++
+	return b, nil
+}
+
+//Sets limits of user or group, all zero removes them
+func setQuota(group bool, id uint32, bsoft, bhard, isoft, ihard int64) error {
+	if err := ensureQuotaTable(); err != nil {
+		return err
+	}
+	t := readQuotaTable()
+	slot := -1
+	for k, q := range t.Entries {
+		if !q.unused() && q.Group == group && q.ID == id {
+			slot = k
+			break
+		}
+		if q.unused() && slot < 0 {
+			slot = k
+		}
+	}
+	if slot < 0 {
+		return errors.New("quota table is full")
+	}
+	t.Entries[slot] = Quota{Group: group, ID: id, BlockSoft: bsoft, BlockHard: bhard, InodeSoft: isoft, InodeHard: ihard}
+	writeQuotaTable(t)
+	return nil
+}
+
+func setQuotaGrace(blocks, inodes time.Duration) error {
+	if err := ensureQuotaTable(); err != nil {
+		return err
+	}
+	t := readQuotaTable()
+	t.BlockGrace, t.InodeGrace = int64(blocks/time.Second), int64(inodes/time.Second)
+	writeQuotaTable(t)
+	return nil
+}
+
+//Usage of every owner, with limits where set
+func quotaReport() []quotaLine {
+	users, groups := quotaUsages()
+	var res []quotaLine
+	listed := map[string]bool{}
+	if SB.Quotas != 0 {
+		for _, q := range readQuotaTable().Entries {
+			if q.unused() {
+				continue
+			}
+			u := users[q.ID]
+			if q.Group {
+				u = groups[q.ID]
+			}
+			res = append(res, quotaLine{quotaKind(q.Group), q.ID, u.Blocks, q.BlockSoft, q.BlockHard, q.BlockUntil,
+				u.Inodes, q.InodeSoft, q.InodeHard, q.InodeUntil})
+			listed[fmt.Sprint(q.Group, q.ID)] = true
+		}
+	}
+	for _, group := range []bool{false, true} {
+		usages := users
+		if group {
+			usages = groups
+		}
+		for id, u := range usages {
+			if !listed[fmt.Sprint(group, id)] {
+				res = append(res, quotaLine{Kind: quotaKind(group), ID: id, Blocks: u.Blocks, Inodes: u.Inodes})
+			}
+		}
+	}
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].Kind != res[b].Kind {
+			return res[a].Kind > res[b].Kind
+		}
+		return res[a].ID < res[b].ID
+	})
+	return res
+}
+
+//Remaining grace as printed by report
+func graceLeft(until int64) string {
+	if until == 0 {
+		return "-"
+	}
+	left := time.Until(time.Unix(until, 0))
+	if left <= 0 {
+		return "expired"
+	}
+	return left.Round(time.Second).String()
+}
+
+func printQuotaReport(lines []quotaLine) {
+	fmt.Printf("%-6s %-8s %8s %8s %8s %-10s %8s %8s %8s %-10s\n",
+		"Type", "ID", "Blocks", "Soft", "Hard", "Grace", "Inodes", "Soft", "Hard", "Grace")
+	for _, l := range lines {
+		fmt.Printf("%-6s %-8d %8d %8d %8d %-10s %8d %8d %8d %-10s\n",
+			l.Kind, l.ID, l.Blocks, l.BlockSoft, l.BlockHard, graceLeft(l.BlockUntil),
+			l.Inodes, l.InodeSoft, l.InodeHard, graceLeft(l.InodeUntil))
+	}
+}
+
+//Parses uid or uid:gid, gid stays def when omitted
+func parseOwner(s string, def uint32) (uint32, uint32, error) {
+	us, gs := s, ""
+	if k := strings.Index(s, ":"); k >= 0 {
+		us, gs = s[:k], s[k+1:]
+	}
+	uid, err := strconv.ParseUint(us, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid := uint64(def)
+	if gs != "" {
+		if gid, err = strconv.ParseUint(gs, 10, 32); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uint32(uid), uint32(gid), nil
+}
+
+//Gives inode new owners, they are charged for its blocks
+func chownInode(iid int64, uid, gid uint32) error {
+	i := readInode(iid)
+	if i.Uid == uid && i.Gid == gid {
+		return nil
+	}
+	n := int64(len(inodeBlocks(i)))
+	var err error
+	switch {
+	case i.Uid != uid && i.Gid != gid:
+		err = checkQuota(uid, gid, n, 1)
+	case i.Uid != uid:
+		//Only user changes, group already pays
+		err = checkQuota(uid, noOwner, n, 1)
+	default:
+		err = checkQuota(noOwner, gid, n, 1)
+	}
+	if err != nil {
+		return err
+	}
+	i.Uid, i.Gid = uid, gid
+	writeInode(iid, i)
+	return nil
+}
+
+//Shell front-end: quota report | quota set user|group <id> <bsoft> <bhard> <isoft> <ihard> |
+//quota grace <blocks> <inodes>
+func quotaCommand(args []string) {
+	var err error
+	switch {
+	case args[0] == "report":
+		printQuotaReport(quotaReport())
+	case args[0] == "set" && len(args) == 7 && (args[1] == "user" || args[1] == "group"):
+		var id uint64
+		var limits [4]int64
+		if id, err = strconv.ParseUint(args[2], 10, 32); err != nil {
+			break
+		}
+		for k := range limits {
+			if limits[k], err = strconv.ParseInt(args[3+k], 10, 64); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = setQuota(args[1] == "group", uint32(id), limits[0], limits[1], limits[2], limits[3])
+		}
+	case args[0] == "grace" && len(args) == 3:
+		var b, i time.Duration
+		if b, err = time.ParseDuration(args[1]); err != nil {
+			break
+		}
+		if i, err = time.ParseDuration(args[2]); err != nil {
+			break
+		}
+		err = setQuotaGrace(b, i)
+	default:
+		fmt.Println("Usage:", shellCommands["quota"].usage)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
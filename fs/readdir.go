@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strconv"
+	"time"
+)
+
+//-------------------------Folder iteration---------------------------
+//Cursor is slot index into folder, entries keep their slot until removed,
+//so holes left by unlink are skipped and entries added or removed around
+//cursor do not shift it. Entries added while reading take first free slot,
+//so they show up only when it is past cursor; renamed entry is added anew
+
+type dirEntry struct {
+	Name  string `json:"name"`
+	Inode int64  `json:"inode"`
+	Type  string `json:"type"`
+}
+
+type dirCursor struct {
+	iid  int64
+	slot int //Next slot to look at
+}
+
+//Folders opened by shell, indexes are directory descriptors
+var dirTable []*dirCursor
+
+func opendirID(iid int64) (*dirCursor, error) {
+	if readInode(iid).Mode != 1 {
+		return nil, errNotFolder
+	}
+	return &dirCursor{iid: iid}, nil
+}
+
+//Absolute paths start at root folder, others at current one
+func opendir(p string) (*dirCursor, error) {
+	_, iid, err := getInodeByPath(p)
+	if err != nil {
+		return nil, err
+	}
+	return opendirID(iid)
+}
+
+//Returns up to n entries after cursor, n <= 0 means rest of them,
+//empty list once folder is done. Folder is read again on every call
+func readdir(c *dirCursor, n int) ([]dirEntry, error) {
+	inode := readInode(c.iid)
+	if inode.Mode != 1 {
+		return nil, errNotFolder
+	}
+	folder := readFolder(inodeBids(inode))
+	res := []dirEntry{}
+	for ; c.slot < fileCount && (n <= 0 || len(res) < n); c.slot++ {
+		v := folder.FileName[c.slot]
+		name := entryName(v)
+		if v[0] == 0 || name == ".." {
+			continue
+		}
+		id := folder.FileInodeID[c.slot]
+		res = append(res, dirEntry{name, id, inodeType(readInode(id))})
+	}
+	return res, nil
+}
+
+//Every entry of folder iid
+func readdirAll(iid int64) ([]dirEntry, error) {
+	c, err := opendirID(iid)
+	if err != nil {
+		return nil, err
+	}
+	return readdir(c, 0)
+}
+
+//Mode string as ls prints it, drwxr-xr-x
+func modeString(i Inode) string {
+	s := []byte(fs.FileMode(inodePerm(i) & 0777).String())
+	switch i.Mode {
+	case 1:
+		s[0] = 'd'
+	case 2:
+		s[0] = 'l'
+	}
+	return string(s)
+}
+
+//Line of ls -l: mode, links, owners, size, modification time, name
+func longListing(name string, i Inode) string {
+	if i.Mode == 2 {
+		name += " -> " + string(readFile(i))
+	}
+	return fmt.Sprintf("%s %2d %5d %5d %8d %s %s", modeString(i), inodeNlink(i), i.Uid, i.Gid, i.Size,
+		time.Unix(i.Mtime, 0).Format("2006-01-02 15:04"), name)
+}
+
+//Prints entries of folder iid, one name per line or ls -l lines
+func ls(iid int64, long bool) {
+	entries, err := readdirAll(iid)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, e := range entries {
+		if long {
+			fmt.Println(longListing(e.Name, readInode(e.Inode)))
+		} else {
+			fmt.Printf("%s - %d\n", e.Name, e.Inode)
+		}
+	}
+}
+
+//Shell front-end: ls [-l] [folder]
+func lsCommand(args []string) {
+	long := len(args) > 0 && args[0] == "-l"
+	if long {
+		args = args[1:]
+	}
+	iid := CurrentInodeID
+	if len(args) > 0 {
+		var err error
+		if _, iid, err = getInodeByPath(args[0]); err != nil {
+			log.Println(args[0], err)
+			return
+		}
+	}
+	ls(iid, long)
+}
+
+func shellDd(s string) (int, error) {
+	dd, err := strconv.Atoi(s)
+	if err != nil || dd < 0 || dd >= len(dirTable) {
+		return 0, errors.New("bad directory descriptor " + s)
+	}
+	return dd, nil
+}
+
+//Shell front-end: opendir <folder>, prints directory descriptor
+func opendirCommand(args []string) {
+	c, err := opendir(args[0])
+	if err != nil {
+		log.Println(args[0], err)
+		return
+	}
+	dirTable = append(dirTable, c)
+	fmt.Println(len(dirTable) - 1)
+}
+
+//Shell front-end: readdir <dd> [n]
+func readdirCommand(args []string) {
+	dd, err := shellDd(args[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	n := 0
+	if len(args) > 1 {
+		if n, err = strconv.Atoi(args[1]); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	entries, err := readdir(dirTable[dd], n)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("end of folder")
+	}
+	for _, e := range entries {
+		fmt.Printf("%-10s %6d %s\n", e.Name, e.Inode, e.Type)
+	}
+}
+
+//Shell front-end: closedir <dd>
+func closedirCommand(args []string) {
+	dd, err := shellDd(args[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	dirTable = append(dirTable[:dd], dirTable[dd+1:]...)
+}
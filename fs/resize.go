@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//-------------------------Resize---------------------------
+//Block ids never change when image grows, so block region, checksum table
+//and nonce table are copied raw to their new places. Shrink first moves
+//used blocks out of cut tail and points inodes at new copies
+
+//Blocks of image with given size and inode count, same formula as mkfs
+func blocksFor(size, inodes int64) int64 {
+	perBlock := blockSize + sumSize
+	if SB.Features&featEncrypted != 0 {
+		perBlock += cryptEntrySize
+	}
+	return (size - sectorSize*(3+inodes)) / perBlock
+}
+
+//Changes image to size bytes and adds inodes, fsck must pass before and after
+func resizeImage(size, addInodes int64) error {
+	if snapView != nil {
+		return errReadOnly
+	}
+	if imageLocked() {
+		return errLocked
+	}
+	if addInodes < 0 {
+		return errors.New("inodes can not be removed")
+	}
+	if problems := fsck(); len(problems) > 0 {
+		return fmt.Errorf("fsck found %d problems, resize refused", len(problems))
+	}
+	nsb := SB
+	nsb.FsSize = size
+	nsb.InodeTableSize += addInodes
+	nsb.FreeInodeCount += addInodes
+	nsb.BlockTableSize = blocksFor(size, nsb.InodeTableSize)
+	if nsb.BlockTableSize < 1 {
+		return errors.New("invalid size")
+	}
+	nsb.FreeBlocksCount += nsb.BlockTableSize - SB.BlockTableSize
+	shrink := nsb.BlockTableSize < SB.BlockTableSize
+	if shrink {
+		if addInodes > 0 {
+			return errors.New("inodes can only be added when growing")
+		}
+		if len(OFT) > 0 {
+			return errors.New("close open files before shrinking")
+		}
+		if len(listSnapshots()) > 0 {
+			return errors.New("delete snapshots before shrinking")
+		}
+		dropSnapTable()
+		nsb.Snapshots = 0
+	}
+	var t SnapshotTable
+	refs := int(math.Ceil(float64(nsb.BlockTableSize) / float64(blockSize)))
+	if (SB.Snapshots != 0 || SB.Dedup != 0) && refs > len(t.RefBlocks) {
+		return errors.New("image too large for reference counts")
+	}
+	//Dedup counts are laid out for new block count from scratch
+	dedup := SB.Dedup != 0
+	dropDedupTable()
+	dedupIndex = nil
+	nsb.Dedup = 0
+	if shrink {
+		if err := evacuateBlocks(nsb.BlockTableSize); err != nil {
+			if dedup {
+				recountDedup()
+			}
+			return err
+		}
+		nsb.Quotas = SB.Quotas
+	}
+	if err := relayout(nsb); err != nil {
+		return err
+	}
+	blockMap = nil
+	quotaUsers, quotaGroups = nil, nil
+	if SB.Snapshots != 0 {
+		if err := addRefBlocks(refs); err != nil {
+			return err
+		}
+	}
+	if SB.NextFreeBlockIndex >= SB.BlockTableSize || !blockFree(SB.NextFreeBlockIndex) {
+		SB.NextFreeBlockIndex = firstFreeBlock()
+	}
+	if !inodeFree(readInode(SB.NextFreeInodeIndex)) && addInodes > 0 {
+		SB.NextFreeInodeIndex = SB.InodeTableSize - addInodes
+	}
+	if dedup {
+		if err := recountDedup(); err != nil {
+			return err
+		}
+	}
+	SB.Modified = false
+	writeSuperBlock(SB)
+	if problems := fsck(); len(problems) > 0 {
+		return fmt.Errorf("fsck after resize: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//Same rule as iget
+func inodeFree(i Inode) bool {
+	return i.DirrectPointers[0] == 0 && i.Mode == 0 && i.Nlink == 0
+}
+
+func freeInodeCount() int64 {
+	var n int64
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		if inodeFree(readInode(in)) {
+			n++
+		}
+	}
+	return n
+}
+
+func firstFreeBlock() int64 {
+	for k := int64(1); k < SB.BlockTableSize; k++ {
+		if blockFree(k) {
+			return k
+		}
+	}
+	return 0
+}
+
+//Reference count blocks for blocks added past old ones
+func addRefBlocks(n int) error {
+	t := readSnapTable()
+	var added []int64
+	for k := 0; k < n; k++ {
+		if t.RefBlocks[k] == 0 {
+			var err error
+			if t.RefBlocks[k], err = bget(); err != nil {
+				ungetBlocks(added)
+				return err
+			}
+			storeBlock(t.RefBlocks[k], Block{}, true)
+			added = append(added, t.RefBlocks[k])
+		}
+	}
+	writeSnapTable(t)
+	for _, b := range added {
+		addBlockRef(b, 1)
+	}
+	return nil
+}
+
+//Blocks held by inodes and quota table, whole inode table counts,
+//unlinked inodes still hold their blocks. Snapshot blocks are not listed,
+//blockRef keeps them
+func usedBlocks() map[int64]bool {
+	used := map[int64]bool{0: true}
+	if SB.Quotas != 0 {
+		used[SB.Quotas] = true
+	}
+	for k := int64(0); k < SB.InodeTableSize; k++ {
+		for _, b := range inodeBlocks(readInode(k)) {
+			used[b] = true
+		}
+	}
+	return used
+}
+
+//Moves used blocks at or past limit to free blocks below it
+func evacuateBlocks(limit int64) error {
+	used := usedBlocks()
+	var tail []int64
+	for b := range used {
+		if b >= limit {
+			tail = append(tail, b)
+		}
+	}
+	moved := map[int64]int64{}
+	next := int64(1)
+	for _, b := range tail {
+		for next < limit && used[next] {
+			next++
+		}
+		if next >= limit {
+			return fmt.Errorf("%d blocks in use past new end, not enough free blocks before it", len(tail))
+		}
+		moved[b] = next
+		next++
+	}
+	for from, to := range moved {
+		block, err := readBlockChecked(from)
+		if err != nil {
+			return err
+		}
+		storeBlock(to, block, readBlockSum(from) != 0)
+	}
+	remap := func(b *int64) bool {
+		if to, ok := moved[*b]; ok {
+			*b = to
+			return true
+		}
+		return false
+	}
+	for k := int64(0); k < SB.InodeTableSize; k++ {
+		i := readInode(k)
+		changed := remap(&i.XattrBlock)
+		if i.Mode != 1 && i.Flags&flagExtents != 0 {
+			changed = remap(&i.IndirrectPointers) || changed
+			bids := append([]int64{}, fileBids(i)...)
+			for n := range bids {
+				changed = remap(&bids[n]) || changed
+			}
+			if changed {
+				if err := setFileBids(&i, bids, newCharge(i)); err != nil {
+					return err
+				}
+			}
+		} else {
+			for n := range i.DirrectPointers {
+				changed = remap(&i.DirrectPointers[n]) || changed
+			}
+		}
+		if changed {
+			writeInode(k, i)
+		}
+	}
+	remap(&SB.Quotas)
+	debugln("evacuated", moved)
+	return nil
+}
+
+//Writes tables of image in layout of nsb, file is extended or truncated
+func relayout(nsb SuperBlock) error {
+	keep := SB.BlockTableSize
+	if nsb.BlockTableSize < keep {
+		keep = nsb.BlockTableSize
+	}
+	blocks := make([]byte, nsb.BlockTableSize*blockSize)
+	old := blocks[:keep*blockSize]
+	readH(blockSector(0), &old)
+	sumSectors := (nsb.BlockTableSize*sumSize + sectorSize - 1) / sectorSize
+	sums := make([]byte, sumSectors*sectorSize)
+	old = sums[:keep*sumSize]
+	sector, _ := sumEntry(0)
+	readH(sector, &old)
+	var nonces []byte
+	if SB.Features&featEncrypted != 0 {
+		nonceSectors := (nsb.BlockTableSize*cryptEntrySize + sectorSize - 1) / sectorSize
+		nonces = make([]byte, nonceSectors*sectorSize)
+		old = nonces[:keep*cryptEntrySize]
+		sector, _ = cryptEntry(0)
+		readH(sector, &old)
+	}
+	oldInodes := SB.InodeTableSize
+	if nsb.FsSize > SB.FsSize {
+		if err := os.Truncate(ImagePath, nsb.FsSize); err != nil {
+			return err
+		}
+	}
+	SB = nsb
+	for k := oldInodes; k < SB.InodeTableSize; k++ {
+		writeInode(k, Inode{})
+	}
+	if err := writeH(blockSector(0), &blocks); err != nil {
+		return err
+	}
+	sector, _ = sumEntry(0)
+	if err := writeH(sector, &sums); err != nil {
+		return err
+	}
+	if nonces != nil {
+		sector, _ = cryptEntry(0)
+		if err := writeH(sector, &nonces); err != nil {
+			return err
+		}
+	}
+	//Shrunk image loses its tail here
+	return os.Truncate(ImagePath, SB.FsSize)
+}
+
+//Shell front-end: resize <size> [inodes]
+func resizeCommand(args []string) {
+	size, err := parseSize(args[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var add int64
+	if len(args) > 1 {
+		if add, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if err := resizeImage(size, add); err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("Image is %d bytes, %d blocks, %d inodes\n", SB.FsSize, SB.BlockTableSize, SB.InodeTableSize)
+}
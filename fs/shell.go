@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+//-------------------------Interactive shell---------------------------
+//Prompt shows CWD, arguments are given inline and may be quoted,
+//Tab completes command names and paths inside the image
+
+type shellCommand struct {
+	usage string
+	help  string
+	nargs int //Minimum number of arguments
+	run   func(args []string)
+}
+
+//Filled in init, help refers back to the table
+var shellCommands map[string]shellCommand
+
+//Lines entered in this session
+var shellHistory []string
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"help": {"help [command]", "List commands or show help of one", 0, shellHelp},
+		"history": {"history", "Show lines entered in this session", 0, func(args []string) {
+			for k, v := range shellHistory {
+				fmt.Printf("%4d  %s\n", k+1, v)
+			}
+		}},
+		"verbose": {"verbose on|off", "Toggle printing of internals", 1, func(args []string) {
+			Verbose = args[0] == "on"
+		}},
+		"mkfs": {"mkfs <inodes> <size> [datasums] [encrypt] [extents] [dedup]", "Create new image, size accepts K, M and G suffixes,\ndatasums checksums file blocks too, encrypt asks for passphrase\nand seals blocks (inode sizes, owners and times stay plain),\nextents maps new files by block runs, dedup shares equal blocks", 2, func(args []string) {
+			iq, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			sz, err := parseSize(args[1])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			var opts mkfsOptions
+			for _, v := range args[2:] {
+				switch v {
+				case "datasums":
+					opts.DataSums = true
+				case "extents":
+					opts.Extents = true
+				case "dedup":
+					opts.Dedup = true
+				case "encrypt":
+					if opts.Passphrase, err = newPassphrase(); err != nil {
+						log.Println(err)
+						return
+					}
+				default:
+					log.Printf("unknown mkfs option %q\n", v)
+					return
+				}
+			}
+			if err := mkfs(iq, sz, opts); err != nil {
+				log.Println(err)
+			}
+		}},
+		"scrub": {"scrub", "Verify checksums of whole image and report bad locations", 0, func(args []string) {
+			scrubImage()
+		}},
+		"fsck": {"fsck", "Check structure of image: pointers in range, no block used twice", 0, func(args []string) {
+			fsckImage()
+		}},
+		"resize": {"resize <size> [inodes]", "Grow image and add inodes, or shrink it moving blocks out of cut tail", 1, func(args []string) {
+			mountIfNeeded()
+			resizeCommand(args)
+		}},
+		"frag": {"frag [path]", "Report block runs of every file and free space", 0, func(args []string) {
+			fragCommand("frag", args)
+		}},
+		"defrag": {"defrag [path]", "Move fragmented files into contiguous free runs", 0, func(args []string) {
+			fragCommand("defrag", args)
+		}},
+		"dedup": {"dedup on|off|report|run [path]", "Share equal file blocks: on does it on every write,\nrun merges existing files, report shows space saved", 1, dedupCommand},
+		"debug": {"debug sb | debug inode|folder|block|path <n> | debug block <n> raw",
+			"Decode superblock with layout, inode, folder entries,\nblock as hex with owners (raw as stored), or paths using block", 1, debugCommand},
+		"map":   {"map <file.svg|file.html> [owner|status|frag]", "Draw image layout, blocks colored by owning file,\nfree/used status or fragmentation of owner", 1, mapCommand},
+		"trace": {"trace start <file> | trace stop", "Record every shell file operation with written data to trace file,\nfuse, 9p and http refuse to start while it records", 1, traceCommand},
+		"replay": {"replay <trace> <image>", "Run trace against fresh image, report where reads and writes differ", 2, func(args []string) {
+			info, err := replayTrace(args[0], args[1])
+			if err != nil {
+				log.Println(args[0], err)
+				return
+			}
+			printReplay(info)
+		}},
+		"crash": {"crash [trace]", "Cut power after every prefix of writes of trace (built-in workload\nif omitted), with torn and reordered writes, fsck every image left", 0, crashCommand},
+		"compress": {"compress <path> on|off", "Toggle transparent compression, folders pass it to new files", 2, func(args []string) {
+			compressCommand(args[0], args[1])
+		}},
+		"setxattr": {"setxattr <path> <name> [value...]", "Set extended attribute, name needs user., trusted. or system. prefix", 2, func(args []string) {
+			xattrCommand("set", args)
+		}},
+		"getxattr": {"getxattr <path> <name>", "Print extended attribute", 2, func(args []string) {
+			xattrCommand("get", args)
+		}},
+		"listxattr": {"listxattr <path>", "Print every extended attribute", 1, func(args []string) {
+			xattrCommand("list", args)
+		}},
+		"removexattr": {"removexattr <path> <name>", "Remove extended attribute", 2, func(args []string) {
+			xattrCommand("remove", args)
+		}},
+		"chown": {"chown <path> <uid>[:<gid>]", "Change owners of entry", 2, func(args []string) {
+			_, iid, err := getInodeByPath(args[0])
+			if err != nil {
+				log.Println(args[0], err)
+				return
+			}
+			uid, gid, err := parseOwner(args[1], readInode(iid).Gid)
+			if err == nil {
+				err = chownInode(iid, uid, gid)
+			}
+			if err != nil {
+				log.Println(args[0], err)
+			}
+		}},
+		"user": {"user [<uid>[:<gid>]]", "Show or change owner of new entries", 0, func(args []string) {
+			if len(args) > 0 {
+				uid, gid, err := parseOwner(args[0], curGid)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				curUid, curGid = uid, gid
+			}
+			fmt.Printf("uid=%d gid=%d\n", curUid, curGid)
+		}},
+		"quota": {"quota report | quota set user|group <id> <bsoft> <bhard> <isoft> <ihard> | quota grace <blocks> <inodes>",
+			"Show usage per owner or set block and inode limits (0 is none),\ngrace periods are durations like 168h", 1, quotaCommand},
+		"fallocate": {"fallocate <path> <offset> <length> [punch|keep]", "Preallocate blocks of range, punch turns it into hole,\nkeep does not grow file", 3, fallocateCommand},
+		"seek":      {"seek <path> data|hole <offset>", "Print next offset of data or hole", 3, seekCommand},
+		"extents": {"extents <path> on|off", "Switch file between extents and block pointers", 2, func(args []string) {
+			extentsCommand(args[0], args[1])
+		}},
+		"snapshot": {"snapshot create|list|delete|rollback|mount|umount [name]",
+			"Manage copy-on-write snapshots, mount shows one read-only", 1, snapshotCommand},
+		"mount":  {"mount", "Load superblock and go to root folder", 0, func(args []string) { mount() }},
+		"umount": {"umount", "Write superblock back to image", 0, func(args []string) { umount() }},
+		"fstat": {"fstat <inode>", "Show inode fields", 1, func(args []string) {
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			fstat(id)
+		}},
+		"ls":       {"ls [-l] [folder]", "List folder, current one by default, -l with modes, sizes and times", 0, lsCommand},
+		"opendir":  {"opendir <folder>", "Open folder for reading, prints directory descriptor", 1, opendirCommand},
+		"readdir":  {"readdir <dd> [n]", "Print next n entries of open folder, all remaining by default", 1, readdirCommand},
+		"closedir": {"closedir <dd>", "Remove descriptor from open folder table", 1, closedirCommand},
+		"create":   {"create <name>", "Create empty file in current folder", 1, func(args []string) { create(args[0]) }},
+		"open":     {"open <path>", "Add file to open file table", 1, func(args []string) { open(args[0]) }},
+		"close": {"close <fd>", "Remove descriptor from open file table", 1, func(args []string) {
+			if fd, err := shellFd(args[0]); err != nil {
+				log.Println(err)
+			} else {
+				close(fd)
+			}
+		}},
+		"read": {"read <fd>", "Print contents of open file", 1, func(args []string) {
+			fd, err := shellFd(args[0])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			var buf []byte
+			read(fd, &buf)
+			fmt.Println("Read data : ", string(buf))
+		}},
+		"write": {"write <fd> <text...> | write <fd> < hostfile", "Write text or host file from beginning of open file", 2, shellWrite},
+		"link":  {"link <target> <name>", "Add hard link to target in current folder", 2, func(args []string) { link(args[0], args[1]) }},
+		"unlink": {"unlink <name>", "Remove name from current folder, last name frees file", 1, func(args []string) {
+			unlink(args[0])
+		}},
+		"rename": {"rename <name> <newname|folder>", "Rename entry or move it into folder", 2, func(args []string) {
+			rename(args[0], args[1])
+		}},
+		"symlink": {"symlink <target> <name>", "Create symlink in current folder", 2, func(args []string) {
+			symlink(args[0], args[1])
+		}},
+		"truncate": {"truncate <path> <size>", "Set file size, accepts K, M and G suffixes", 2, func(args []string) {
+			size, err := parseSize(args[1])
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			truncate(args[0], size)
+		}},
+		"cd":    {"cd <path>", "Change current folder", 1, func(args []string) { cd(args[0]) }},
+		"mkdir": {"mkdir <name>", "Create folder in current folder", 1, func(args []string) { mkdir(args[0]) }},
+		"rmdir": {"rmdir <name>", "Remove empty folder from current folder", 1, func(args []string) {
+			rmdir(args[0])
+		}},
+		"fuse": {"fuse <mountpoint>", "Mount image on host folder until Ctrl-C", 1, func(args []string) {
+			fuseMount(args[0])
+		}},
+		"9p": {"9p <host:port|socket>", "Serve image over 9P2000.L until Ctrl-C", 1, func(args []string) {
+			serve9P(args[0])
+		}},
+		"http": {"http <host:port> [dav]", "Serve image over HTTP, with WebDAV if dav is given", 1, func(args []string) {
+			serveHTTP(args[0], len(args) > 1 && args[1] == "dav")
+		}},
+		"import": {"import <hostfolder> <folder>", "Copy host folder contents into image folder", 2, func(args []string) {
+			importDir(args[0], args[1])
+		}},
+		"export": {"export <folder> <hostfolder>", "Copy image folder contents into host folder", 2, func(args []string) {
+			exportDir(args[0], args[1])
+		}},
+		"tarimport": {"tarimport <archive> <folder>", "Extract tar archive into image folder", 2, func(args []string) {
+			importTar(args[0], args[1])
+		}},
+		"tarexport": {"tarexport <folder> <archive>", "Write image folder as tar archive", 2, func(args []string) {
+			exportTar(args[0], args[1])
+		}},
+	}
+}
+
+func runShell() {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		//Piped input, no prompt nor line editing
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !runShellLine(scanner.Text()) {
+				return
+			}
+		}
+		return
+	}
+	fmt.Println("Type help for list of commands, exit or Ctrl-D to quit")
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		return shellComplete(t, line, pos, key)
+	}
+	for {
+		t.SetPrompt(CWD + "> ")
+		//Raw only while editing, so commands and servers get Ctrl-C
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err != nil {
+			fmt.Println()
+			return
+		}
+		if !runShellLine(line) {
+			return
+		}
+	}
+}
+
+//Returns false when shell should quit
+func runShellLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return true
+	}
+	shellHistory = append(shellHistory, line)
+	args, err := splitArgs(line)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	if args[0] == "exit" || args[0] == "quit" {
+		return false
+	}
+	cmd, ok := shellCommands[args[0]]
+	if !ok {
+		log.Printf("unknown command %q, try help\n", args[0])
+		return true
+	}
+	if len(args)-1 < cmd.nargs {
+		fmt.Println("Usage:", cmd.usage)
+		return true
+	}
+	cmd.run(args[1:])
+	return true
+}
+
+func shellHelp(args []string) {
+	if len(args) > 0 {
+		cmd, ok := shellCommands[args[0]]
+		if !ok {
+			log.Printf("unknown command %q\n", args[0])
+			return
+		}
+		fmt.Printf("Usage: %s\n%s\n", cmd.usage, cmd.help)
+		return
+	}
+	for _, name := range shellCommandNames() {
+		fmt.Printf("  %-45s %s\n", shellCommands[name].usage, shellCommands[name].help)
+	}
+	fmt.Printf("  %-45s %s\n", "exit", "Write superblock and quit")
+}
+
+func shellCommandNames() []string {
+	var names []string
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func shellFd(s string) (int, error) {
+	fd, err := strconv.Atoi(s)
+	if err != nil || fd < 0 || fd >= len(OFT) {
+		return 0, errors.New("bad file descriptor " + s)
+	}
+	return fd, nil
+}
+
+func shellWrite(args []string) {
+	fd, err := shellFd(args[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var data []byte
+	if args[1] == "<" {
+		if len(args) != 3 {
+			fmt.Println("Usage:", shellCommands["write"].usage)
+			return
+		}
+		data, err = os.ReadFile(args[2])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	} else {
+		data = []byte(strings.Join(args[1:], " "))
+	}
+	write(fd, &data)
+}
+
+//Tab completes first word as command and others as image paths,
+//ambiguous candidates are printed above prompt
+func shellComplete(t *term.Terminal, line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	head := line[:pos]
+	start := strings.LastIndexAny(head, " \t") + 1
+	word := head[start:]
+	var cands []string
+	if start == 0 {
+		for _, name := range append(shellCommandNames(), "exit", "quit") {
+			if strings.HasPrefix(name, word) {
+				cands = append(cands, name+" ")
+			}
+		}
+	} else {
+		cands = shellPathCandidates(word)
+	}
+	if len(cands) == 0 {
+		return "", 0, false
+	}
+	common := cands[0]
+	for _, c := range cands[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(cands) > 1 && common == word {
+		fmt.Fprintln(t, strings.Join(cands, "  "))
+		return "", 0, false
+	}
+	return head[:start] + common + line[pos:], start + len(common), true
+}
+
+//Entries of folder named by word, folders get trailing /
+func shellPathCandidates(word string) []string {
+	if SB.InodeTableSize == 0 {
+		return nil
+	}
+	verbose := Verbose
+	Verbose = false
+	defer func() { Verbose = verbose }()
+
+	dir, base := path.Split(word)
+	p := dir
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(CWD, p)
+	}
+	_, inode, err := lookupPath(path.Clean(p))
+	if err != nil || inode.Mode != 1 {
+		return nil
+	}
+	folder := readFolder(inodeBids(inode))
+	var cands []string
+	for k, v := range folder.FileName {
+		name := entryName(v)
+		if v[0] == 0 || !strings.HasPrefix(name, base) {
+			continue
+		}
+		c := dir + name
+		if readInode(folder.FileInodeID[k]).Mode == 1 {
+			c += "/"
+		}
+		cands = append(cands, c)
+	}
+	sort.Strings(cands)
+	return cands
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+//-------------------------Snapshots---------------------------
+//Snapshot keeps copy of inode table and of folder blocks, file blocks
+//are shared with live image and copied only when live image writes them.
+//Every block held by snapshot has reference count, bget skips those,
+//so block stays in place until last snapshot using it is deleted
+
+const maxSnapshots = 64
+const snapNameSize = 32
+
+//Lives in block SuperBlock.Snapshots
+type SnapshotTable struct {
+	RefBlocks [16]int64 //Blocks with one byte reference count per data block
+	Entries   [maxSnapshots]Snapshot
+}
+
+type Snapshot struct {
+	Name    [snapNameSize]byte
+	Created int64 //Unix seconds
+	Table   int64 //Block listing blocks of inode table copy, 0 for unused entry
+}
+
+var (
+	errReadOnly   = errors.New("snapshot is read-only")
+	errNoSnapshot = errors.New("no such snapshot")
+)
+
+//Inodes of snapshot mounted read-only, nil while live image is used
+var snapView []Inode
+
+func readSnapTable() SnapshotTable {
+	block := readBlock(SB.Snapshots)
+	var t SnapshotTable
+	err := binary.Read(bytes.NewReader(block.Data[:]), binary.BigEndian, &t)
+	if err != nil {
+		log.Println(err)
+	}
+	return t
+}
+
+func writeSnapTable(t SnapshotTable) {
+	binBuf := new(bytes.Buffer)
+	err := binary.Write(binBuf, binary.BigEndian, t)
+	if err != nil {
+		log.Println(err)
+	}
+	block := Block{}
+	copy(block.Data[:], binBuf.Bytes())
+	storeBlock(SB.Snapshots, block, true)
+}
+
+//Allocates snapshot table and reference counts on first snapshot
+func ensureSnapTable() error {
+	if SB.Snapshots != 0 {
+		return nil
+	}
+	n := int(math.Ceil(float64(SB.BlockTableSize) / float64(blockSize)))
+	var t SnapshotTable
+	if n > len(t.RefBlocks) {
+		return errors.New("image too large for snapshots")
+	}
+	tid, err := bget()
+	if err != nil {
+		return err
+	}
+	for k := 0; k < n; k++ {
+		if t.RefBlocks[k], err = bget(); err != nil {
+			ungetBlocks(append([]int64{tid}, t.RefBlocks[:k]...))
+			return err
+		}
+		storeBlock(t.RefBlocks[k], Block{}, true)
+	}
+	SB.Snapshots = tid
+	SB.Modified = true
+	writeSnapTable(t)
+	addBlockRef(tid, 1)
+	for k := 0; k < n; k++ {
+		addBlockRef(t.RefBlocks[k], 1)
+	}
+	return nil
+}
+
+//Frees table and reference counts once last snapshot is deleted
+func dropSnapTable() {
+	if SB.Snapshots == 0 || len(listSnapshots()) > 0 {
+		return
+	}
+	for _, rb := range readSnapTable().RefBlocks {
+		if rb != 0 {
+			storeBlock(rb, Block{}, false)
+			setBlockUsed(rb, false)
+		}
+	}
+	storeBlock(SB.Snapshots, Block{}, false)
+	setBlockUsed(SB.Snapshots, false)
+	SB.Snapshots = 0
+	SB.Modified = true
+}
+
+//Number of snapshots holding block
+func blockRef(ib int64) uint8 {
+	if SB.Snapshots == 0 || snapView != nil {
+		return 0
+	}
+	refs := readSnapTable().RefBlocks
+	if ib < 0 || ib/blockSize >= int64(len(refs)) {
+		return 0
+	}
+	rb := refs[ib/blockSize]
+	//Blocks added by resize have no counts until it allocates them
+	if rb == 0 {
+		return 0
+	}
+	return readBlock(rb).Data[ib%blockSize]
+}
+
+//Returns new reference count
+func addBlockRef(ib int64, delta int) uint8 {
+	rb := readSnapTable().RefBlocks[ib/blockSize]
+	block := readBlock(rb)
+	block.Data[ib%blockSize] = uint8(int(block.Data[ib%blockSize]) + delta)
+	storeBlock(rb, block, true)
+	return block.Data[ib%blockSize]
+}
+
+//Blocks used by inode, folder blocks or file blocks
+func inodeBlocks(i Inode) []int64 {
+	var res []int64
+	if i.Mode == 1 {
+		res = append(res, inodeBids(i)...)
+	} else {
+		//Block 0 is root folder, free inodes and holes point there
+		for _, b := range fileBids(i) {
+			if b != 0 {
+				res = append(res, b)
+			}
+		}
+	}
+	if i.Flags&flagExtents != 0 && i.IndirrectPointers != 0 {
+		res = append(res, i.IndirrectPointers)
+	}
+	if i.XattrBlock != 0 {
+		res = append(res, i.XattrBlock)
+	}
+	return res
+}
+
+func findSnapshot(t SnapshotTable, name string) (int, bool) {
+	for k, v := range t.Entries {
+		if v.Table != 0 && snapName(v) == name {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+func snapName(s Snapshot) string {
+	return strings.TrimRight(string(s.Name[:]), "\x00")
+}
+
+//Copies blocks of folder inode, so live folders change in place
+func copyFolderBlocks(i Inode) (Inode, error) {
+	for k, b := range inodeBids(i) {
+		nb, err := bget()
+		if err != nil {
+			return i, err
+		}
+		storeBlock(nb, readBlock(b), true)
+		i.DirrectPointers[k] = nb
+	}
+	return i, nil
+}
+
+func takeSnapshot(name string) error {
+	if name == "" || len(name) > snapNameSize {
+		return errNameTooLong
+	}
+	if err := ensureSnapTable(); err != nil {
+		return err
+	}
+	t := readSnapTable()
+	if _, ok := findSnapshot(t, name); ok {
+		return errExists
+	}
+	slot := -1
+	for k, v := range t.Entries {
+		if v.Table == 0 {
+			slot = k
+			break
+		}
+	}
+	if slot < 0 {
+		return errors.New("snapshot table is full")
+	}
+	//Counts change as blocks are taken, so room is checked first
+	need := inodeCopyBlocks()
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		if inode := readInode(in); inode.Mode == 1 {
+			need += int64(len(inodeBids(inode)))
+		}
+	}
+	if freeBlockCount() < need {
+		return errNoSpace
+	}
+	inodes := make([]Inode, SB.InodeTableSize)
+	for in := range inodes {
+		inode := readInode(int64(in))
+		if inode.Mode == 1 {
+			var err error
+			if inode, err = copyFolderBlocks(inode); err != nil {
+				return err
+			}
+		}
+		for _, b := range inodeBlocks(inode) {
+			addBlockRef(b, 1)
+		}
+		inodes[in] = inode
+	}
+	var s Snapshot
+	copy(s.Name[:], name)
+	s.Created = time.Now().Unix()
+	var err error
+	if s.Table, err = writeInodeCopy(inodes); err != nil {
+		return err
+	}
+	t.Entries[slot] = s
+	writeSnapTable(t)
+	return nil
+}
+
+//Blocks taken by inode table copy, list block included
+func inodeCopyBlocks() int64 {
+	perBlock := int64(blockSize) / int64(binary.Size(Inode{}))
+	return (SB.InodeTableSize+perBlock-1)/perBlock + 1
+}
+
+//Stores inode table copy, returns block listing its blocks
+func writeInodeCopy(inodes []Inode) (int64, error) {
+	perBlock := int(blockSize) / binary.Size(Inode{})
+	var bids []int64
+	for k := 0; k < len(inodes); k += perBlock {
+		end := k + perBlock
+		if end > len(inodes) {
+			end = len(inodes)
+		}
+		binBuf := new(bytes.Buffer)
+		err := binary.Write(binBuf, binary.BigEndian, inodes[k:end])
+		if err != nil {
+			log.Println(err)
+		}
+		block := Block{}
+		copy(block.Data[:], binBuf.Bytes())
+		b, err := bget()
+		if err != nil {
+			return 0, err
+		}
+		storeBlock(b, block, true)
+		addBlockRef(b, 1)
+		bids = append(bids, b)
+	}
+	list := Block{}
+	for k, b := range bids {
+		binary.BigEndian.PutUint64(list.Data[k*8:], uint64(b))
+	}
+	lid, err := bget()
+	if err != nil {
+		return 0, err
+	}
+	storeBlock(lid, list, true)
+	addBlockRef(lid, 1)
+	return lid, nil
+}
+
+//Returns inode table copy and blocks holding it, list block included
+func readInodeCopy(lid int64) ([]Inode, []int64) {
+	perBlock := int(blockSize) / binary.Size(Inode{})
+	n := int(math.Ceil(float64(SB.InodeTableSize) / float64(perBlock)))
+	list := readBlock(lid)
+	inodes := make([]Inode, SB.InodeTableSize)
+	bids := []int64{lid}
+	for k := 0; k < n; k++ {
+		b := int64(binary.BigEndian.Uint64(list.Data[k*8:]))
+		bids = append(bids, b)
+		block := readBlock(b)
+		end := (k + 1) * perBlock
+		if end > len(inodes) {
+			end = len(inodes)
+		}
+		err := binary.Read(bytes.NewReader(block.Data[:]), binary.BigEndian, inodes[k*perBlock:end])
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return inodes, bids
+}
+
+func lookupSnapshot(name string) (SnapshotTable, int, error) {
+	if SB.Snapshots == 0 {
+		return SnapshotTable{}, 0, errNoSnapshot
+	}
+	t := readSnapTable()
+	slot, ok := findSnapshot(t, name)
+	if !ok {
+		return t, 0, errNoSnapshot
+	}
+	return t, slot, nil
+}
+
+//Blocks referenced by live inode table
+func liveBlocks() map[int64]bool {
+	live := map[int64]bool{}
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		for _, b := range inodeBlocks(readInode(in)) {
+			live[b] = true
+		}
+	}
+	return live
+}
+
+//Drops references of snapshot, blocks nobody uses any more are zeroed
+func deleteSnapshot(name string) error {
+	t, slot, err := lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	inodes, bids := readInodeCopy(t.Entries[slot].Table)
+	for _, inode := range inodes {
+		bids = append(bids, inodeBlocks(inode)...)
+	}
+	live := liveBlocks()
+	for _, b := range bids {
+		if addBlockRef(b, -1) == 0 && !live[b] {
+			storeBlock(b, Block{}, false)
+			setBlockUsed(b, false)
+		}
+	}
+	t.Entries[slot] = Snapshot{}
+	writeSnapTable(t)
+	return nil
+}
+
+//Replaces live inode table with snapshot one, snapshot itself is kept
+func rollbackSnapshot(name string) error {
+	t, slot, err := lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	inodes, _ := readInodeCopy(t.Entries[slot].Table)
+	//Blocks only live image uses are released, folder copies must fit
+	var liveOnly []int64
+	seen := map[int64]bool{}
+	for in := int64(0); in < SB.InodeTableSize; in++ {
+		for _, b := range inodeBlocks(readInode(in)) {
+			if blockRef(b) == 0 && !seen[b] {
+				seen[b] = true
+				liveOnly = append(liveOnly, b)
+			}
+		}
+	}
+	var need int64
+	for _, inode := range inodes {
+		if inode.Mode == 1 {
+			need += int64(len(inodeBids(inode)))
+		}
+	}
+	if freeBlockCount()+int64(len(liveOnly)) < need {
+		return errNoSpace
+	}
+	for _, b := range liveOnly {
+		storeBlock(b, Block{}, false)
+		setBlockUsed(b, false)
+	}
+	for in, inode := range inodes {
+		if inode.Mode == 1 {
+			if inode, err = copyFolderBlocks(inode); err != nil {
+				return err
+			}
+		}
+		writeInode(int64(in), inode)
+	}
+	//Files sharing blocks are those of snapshot now
+	dedupIndex = nil
+	blockMap = nil
+	quotaUsers, quotaGroups = nil, nil
+	if err := recountDedup(); err != nil {
+		return err
+	}
+	OFT, dirTable = nil, nil
+	CurrentInode = readInode(0)
+	CurrentInodeID = 0
+	CWD = "/"
+	return nil
+}
+
+//Later reads see snapshot, writes are refused until unmountSnapshot
+func mountSnapshot(name string) error {
+	t, slot, err := lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	inodes, _ := readInodeCopy(t.Entries[slot].Table)
+	snapView = inodes
+	OFT, dirTable = nil, nil
+	CurrentInode = snapView[0]
+	CurrentInodeID = 0
+	CWD = "/"
+	return nil
+}
+
+func unmountSnapshot() {
+	snapView = nil
+	OFT, dirTable = nil, nil
+	mount()
+}
+
+func listSnapshots() []Snapshot {
+	if SB.Snapshots == 0 {
+		return nil
+	}
+	var res []Snapshot
+	for _, v := range readSnapTable().Entries {
+		if v.Table != 0 {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+//Shell front-end: snapshot create|list|delete|rollback|mount|umount [name]
+func snapshotCommand(args []string) {
+	if snapView != nil && args[0] != "umount" && args[0] != "list" {
+		log.Println(errReadOnly, ", run snapshot umount first")
+		return
+	}
+	mountIfNeeded()
+	var err error
+	switch args[0] {
+	case "list":
+		if snapView != nil {
+			fmt.Println("Snapshot mounted, live image hidden")
+		}
+		for _, v := range listSnapshots() {
+			fmt.Printf("%-32s %s\n", snapName(v), time.Unix(v.Created, 0).Format(time.RFC3339))
+		}
+		return
+	case "umount":
+		unmountSnapshot()
+		return
+	}
+	if len(args) < 2 {
+		fmt.Println("Usage:", shellCommands["snapshot"].usage)
+		return
+	}
+	switch args[0] {
+	case "create":
+		err = takeSnapshot(args[1])
+	case "delete":
+		err = deleteSnapshot(args[1])
+	case "rollback":
+		err = rollbackSnapshot(args[1])
+	case "mount":
+		err = mountSnapshot(args[1])
+	default:
+		fmt.Println("Usage:", shellCommands["snapshot"].usage)
+		return
+	}
+	if err != nil {
+		log.Println(args[1], err)
+		return
+	}
+	umount()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	newTestImage(t, 32, 400*KB, mkfsOptions{})
+	old := bytes.Repeat([]byte("old"), int(blockSize))
+	changed := bytes.Repeat([]byte("new"), 2*int(blockSize))
+	check := func(when string) {
+		t.Helper()
+		_, f, err := lookupPath("/d/f")
+		if err != nil || !bytes.Equal(readFile(f), old) {
+			t.Fatalf("%s: /d/f %v", when, err)
+		}
+		if _, _, err := lookupPath("/g"); !errors.Is(err, errNotFound) {
+			t.Fatalf("%s: /g %v", when, err)
+		}
+		if problems := fsck(); len(problems) > 0 {
+			t.Fatalf("%s: %v", when, problems)
+		}
+	}
+	logged := quiet(t, func() {
+		mkdir("d")
+		cd("d")
+		create("f")
+		open("f")
+		write(0, &old)
+		close(0)
+		cd("/")
+		if err := takeSnapshot("s1"); err != nil {
+			t.Fatal(err)
+		}
+		//Changes after snapshot, file rewritten in place and tree changed
+		cd("d")
+		open("f")
+		write(0, &changed)
+		close(0)
+		cd("/")
+		create("g")
+		if err := rollbackSnapshot("s1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	check("after rollback")
+
+	//Live image writes after rollback leave snapshot as it was
+	logged = quiet(t, func() {
+		cd("d")
+		open("f")
+		write(0, &changed)
+		close(0)
+		unlink("f")
+		cd("/")
+		create("g")
+		if err := rollbackSnapshot("s1"); err != nil {
+			t.Fatal(err)
+		}
+		umount()
+		mount()
+	})
+	if logged != "" {
+		t.Fatal(logged)
+	}
+	check("second rollback and remount")
+}
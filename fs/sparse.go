@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+//-------------------------Sparse files---------------------------
+//Block id 0 (root folder) never holds file data, so in file's block list
+//it marks hole: block reads as zeros and is allocated on first write.
+//Growing file only adds holes, blocks come with writes
+
+//Mode bits of fallocate, same values as Linux, so FUSE passes them through
+const (
+	fallocKeepSize  = 0x01 //Do not grow file
+	fallocPunchHole = 0x02 //Release blocks of range, size is kept
+)
+
+//Whence of lseek looking for data or hole, Linux values
+const (
+	seekWhenceData = 3
+	seekWhenceHole = 4
+)
+
+//Offset is past end of file (ENXIO of lseek)
+var errNoData = errors.New("no data past offset")
+
+//Returns first offset at or after off inside data, holes are block aligned
+func seekData(i Inode, off int64) (int64, error) {
+	if off < 0 || off >= i.Size {
+		return 0, errNoData
+	}
+	if i.Flags&flagCompressed != 0 {
+		return off, nil
+	}
+	bids := fileBids(i)
+	for k := off / blockSize; k < int64(len(bids)); k++ {
+		if bids[k] != 0 {
+			return maxOffset(off, k*blockSize), nil
+		}
+	}
+	return 0, errNoData
+}
+
+//Returns first offset at or after off inside hole, end of file counts as one
+func seekHole(i Inode, off int64) (int64, error) {
+	if off < 0 || off >= i.Size {
+		return 0, errNoData
+	}
+	if i.Flags&flagCompressed != 0 {
+		return i.Size, nil
+	}
+	bids := fileBids(i)
+	for k := off / blockSize; k < int64(len(bids)); k++ {
+		if bids[k] == 0 {
+			return maxOffset(off, k*blockSize), nil
+		}
+	}
+	return i.Size, nil
+}
+
+func maxOffset(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+//Preallocates blocks of range, or releases them with fallocPunchHole,
+//returns updated inode which is not stored
+func fallocate(i Inode, off, length int64, mode uint32) (Inode, error) {
+	if off < 0 || length <= 0 {
+		return i, errors.New("invalid range")
+	}
+	if i.Mode == 1 {
+		return i, errIsFolder
+	}
+	if i.Mode == 2 {
+		return i, errIsSymlink
+	}
+	end := off + length
+	c := newCharge(i)
+	if mode&fallocPunchHole != 0 {
+		return punchHole(i, off, end, c)
+	}
+	if mode&fallocKeepSize == 0 && end > i.Size {
+		var err error
+		if i, err = resizeFile(i, end, c); err != nil {
+			return i, err
+		}
+	}
+	//Compressed files have no holes to fill
+	if i.Flags&flagCompressed != 0 {
+		return i, nil
+	}
+	//Blocks past end of file are not kept, range stops at size
+	if end > i.Size {
+		end = i.Size
+	}
+	for k := off / blockSize; k*blockSize < end; k++ {
+		if _, err := cowBlock(&i, k, c); err != nil {
+			return i, err
+		}
+	}
+	return i, nil
+}
+
+//Zeroes range, whole blocks inside it become holes
+func punchHole(i Inode, off, end int64, c *blockCharge) (Inode, error) {
+	if end > i.Size {
+		end = i.Size
+	}
+	if off >= end {
+		return i, nil
+	}
+	if i.Flags&flagCompressed != 0 {
+		return punchCompressed(i, off, end, c)
+	}
+	bids := append([]int64{}, fileBids(i)...)
+	for k := off / blockSize; k*blockSize < end; k++ {
+		if bids[k] == 0 {
+			continue
+		}
+		from, to := maxOffset(off, k*blockSize), (k+1)*blockSize
+		if end < to {
+			to = end
+		}
+		//Partial block keeps rest of its data, tail past size does not count
+		if from > k*blockSize || (to < (k+1)*blockSize && to < i.Size) {
+			bid, err := cowBlock(&i, k, c)
+			if err != nil {
+				return i, err
+			}
+			block := readBlock(bid)
+			for p := from; p < to; p++ {
+				block.Data[p%blockSize] = 0
+			}
+			writeBlock(bid, block)
+			bids = append(bids[:0], fileBids(i)...)
+			continue
+		}
+		releaseBlock(bids[k])
+		bids[k] = 0
+	}
+	return i, setFileBids(&i, bids, c)
+}
+
+//Shell front-end: fallocate <path> <offset> <length> [punch|keep]
+func fallocateCommand(args []string) {
+	var mode uint32
+	for _, v := range args[3:] {
+		switch v {
+		case "punch":
+			mode |= fallocPunchHole | fallocKeepSize
+		case "keep":
+			mode |= fallocKeepSize
+		default:
+			fmt.Println("Usage:", shellCommands["fallocate"].usage)
+			return
+		}
+	}
+	off, err := parseSize(args[1])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	length, err := parseSize(args[2])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	inode, iid, err := getInodeByPath(args[0])
+	if err == nil {
+		inode, err = fallocate(inode, off, length, mode)
+	}
+	if err != nil {
+		log.Println(args[0], err)
+		return
+	}
+	writeInode(iid, inode)
+	fmt.Printf("%s : %d bytes, blocks %v\n", args[0], inode.Size, fileBids(inode))
+}
+
+//Shell front-end: seek <path> data|hole <offset>
+func seekCommand(args []string) {
+	off, err := parseSize(args[2])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	inode, _, err := getInodeByPath(args[0])
+	if err != nil {
+		log.Println(args[0], err)
+		return
+	}
+	var pos int64
+	switch args[1] {
+	case "data":
+		pos, err = seekData(inode, off)
+	case "hole":
+		pos, err = seekHole(inode, off)
+	default:
+		fmt.Println("Usage:", shellCommands["seek"].usage)
+		return
+	}
+	if err != nil {
+		log.Println(args[0], err)
+		return
+	}
+	fmt.Println(pos)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+//-------------------------Trace and replay---------------------------
+//Trace is JSON Lines file, one record per operation of shell. First record
+//is mkfs with geometry of image, so replay starts from same empty image.
+//Writes keep their data with SHA-256, reads keep hash of what they returned,
+//replay compares both and reports first steps where image behaves differently
+
+type traceRecord struct {
+	Seq  int      `json:"seq"`
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+	Data []byte   `json:"data,omitempty"`   //Written bytes, base64 in file
+	Hash string   `json:"sha256,omitempty"` //Of written data or of data read
+}
+
+//Outcome of replay
+type replayInfo struct {
+	Ops        int      `json:"operations"`
+	Mismatches []string `json:"mismatches"`
+	Problems   []string `json:"fsck_problems"` //Fsck of image after last step
+}
+
+var (
+	traceFile *os.File //nil while not tracing
+	traceSeq  int
+)
+
+var errTracing = errors.New("trace is being recorded, stop it first")
+
+//Servers change image past shell, trace would miss what they do
+func checkNotTracing() error {
+	if traceFile != nil {
+		return fmt.Errorf("serving: %w", errTracing)
+	}
+	return nil
+}
+
+func hashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func traceRecordOp(r traceRecord) {
+	if traceFile == nil {
+		return
+	}
+	traceSeq++
+	r.Seq = traceSeq
+	b, err := json.Marshal(r)
+	if err == nil {
+		_, err = traceFile.Write(append(b, '\n'))
+	}
+	if err != nil {
+		log.Println("trace:", err)
+	}
+}
+
+//Called by operations of shell before they run
+func traceOp(op string, args ...string) {
+	traceRecordOp(traceRecord{Op: op, Args: args})
+}
+
+func traceWrite(fd int, data []byte) {
+	traceRecordOp(traceRecord{Op: "write", Args: []string{strconv.Itoa(fd)}, Data: data, Hash: hashHex(data)})
+}
+
+func traceRead(fd int, data []byte) {
+	traceRecordOp(traceRecord{Op: "read", Args: []string{strconv.Itoa(fd)}, Hash: hashHex(data)})
+}
+
+//Arguments of mkfs giving image of same geometry, passphrase is never stored
+func mkfsArgs(iq, sz int64, opts mkfsOptions) []string {
+	args := []string{strconv.FormatInt(iq, 10), strconv.FormatInt(sz, 10)}
+	if opts.DataSums {
+		args = append(args, "datasums")
+	}
+	if opts.Extents {
+		args = append(args, "extents")
+	}
+	if opts.Dedup {
+		args = append(args, "dedup")
+	}
+	return args
+}
+
+//Starts trace of mounted image, header is mkfs of its geometry
+func startTrace(name string) error {
+	if traceFile != nil {
+		return errTracing
+	}
+	if SB.InodeTableSize == 0 {
+		return errors.New("no image mounted")
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	traceFile, traceSeq = f, 0
+	opts := mkfsOptions{
+		DataSums: SB.Features&featDataSums != 0,
+		Extents:  SB.Features&featExtents != 0,
+		Dedup:    SB.Features&featDedup != 0,
+	}
+	traceOp("mkfs", mkfsArgs(SB.InodeTableSize, SB.FsSize, opts)...)
+	//Replay starts from empty image at root
+	if entries, _ := readdirAll(0); len(entries) > 0 || len(OFT) > 0 {
+		log.Println("trace: image is not empty, replay starts from empty one")
+	}
+	if CWD != "/" {
+		traceOp("cd", CWD)
+	}
+	return nil
+}
+
+func stopTrace() error {
+	if traceFile == nil {
+		return errors.New("no trace is being recorded")
+	}
+	err := traceFile.Close()
+	traceFile = nil
+	return err
+}
+
+func readTrace(name string) ([]traceRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []traceRecord
+	scanner := bufio.NewScanner(f)
+	//Write records carry file data
+	scanner.Buffer(nil, int(64*MB))
+	for line := 1; scanner.Scan(); line++ {
+		var r traceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		res = append(res, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 || res[0].Op != "mkfs" {
+		return nil, errors.New("trace does not start with mkfs")
+	}
+	return res, nil
+}
+
+//Number of arguments of every operation replay knows
+var traceOps = map[string]int{
+	"mkfs": 2, "create": 1, "open": 1, "close": 1, "read": 1, "write": 1,
+	"link": 2, "unlink": 1, "rename": 2, "symlink": 2, "truncate": 2,
+	"cd": 1, "mkdir": 1, "rmdir": 1,
+}
+
+//Runs one record, returns mismatch found or error stopping replay
+func replayRecord(r traceRecord) (string, error) {
+	n, ok := traceOps[r.Op]
+	if !ok {
+		return "", fmt.Errorf("step %d: unknown operation %q", r.Seq, r.Op)
+	}
+	if len(r.Args) < n {
+		return "", fmt.Errorf("step %d: %s needs %d arguments", r.Seq, r.Op, n)
+	}
+	a := r.Args
+	switch r.Op {
+	case "mkfs":
+		iq, err := strconv.ParseInt(a[0], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		sz, err := strconv.ParseInt(a[1], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		var opts mkfsOptions
+		for _, v := range a[2:] {
+			opts.DataSums = opts.DataSums || v == "datasums"
+			opts.Extents = opts.Extents || v == "extents"
+			opts.Dedup = opts.Dedup || v == "dedup"
+		}
+		OFT, dirTable = nil, nil
+		if err := mkfs(iq, sz, opts); err != nil {
+			return "", err
+		}
+		return "", mountImage()
+	case "create":
+		create(a[0])
+	case "open":
+		open(a[0])
+	case "close", "read", "write":
+		fd, err := shellFd(a[0])
+		if err != nil {
+			return fmt.Sprintf("step %d: %s %s", r.Seq, r.Op, err), nil
+		}
+		switch r.Op {
+		case "close":
+			close(fd)
+		case "read":
+			var buf []byte
+			read(fd, &buf)
+			if h := hashHex(buf); h != r.Hash {
+				return fmt.Sprintf("step %d: read %d returned %d bytes with sha256 %s, trace has %s", r.Seq, fd, len(buf), h, r.Hash), nil
+			}
+		case "write":
+			if hashHex(r.Data) != r.Hash {
+				return "", fmt.Errorf("step %d: data does not match its sha256", r.Seq)
+			}
+			write(fd, &r.Data)
+			got := readFile(readInode(OFT[fd].offset))
+			if !bytes.HasPrefix(got, r.Data) {
+				return fmt.Sprintf("step %d: write %d of %d bytes did not read back", r.Seq, fd, len(r.Data)), nil
+			}
+		}
+	case "link":
+		link(a[0], a[1])
+	case "unlink":
+		unlink(a[0])
+	case "rename":
+		rename(a[0], a[1])
+	case "symlink":
+		symlink(a[0], a[1])
+	case "truncate":
+		size, err := strconv.ParseInt(a[1], 10, 64)
+		if err != nil {
+			return "", err
+		}
+		truncate(a[0], size)
+	case "cd":
+		cd(a[0])
+	case "mkdir":
+		mkdir(a[0])
+	case "rmdir":
+		rmdir(a[0])
+	}
+	return "", nil
+}
+
+//Runs trace against fresh image created at name, image stays mounted
+func replayTrace(traceName, name string) (replayInfo, error) {
+	info := replayInfo{Mismatches: []string{}, Problems: []string{}}
+	if traceFile != nil {
+		return info, errTracing
+	}
+	records, err := readTrace(traceName)
+	if err != nil {
+		return info, err
+	}
+	umount()
+	ImagePath = name
+	for _, r := range records {
+		mismatch, err := replayRecord(r)
+		if err != nil {
+			return info, err
+		}
+		if mismatch != "" {
+			info.Mismatches = append(info.Mismatches, mismatch)
+		}
+		info.Ops++
+	}
+	umount()
+	info.Problems = append(info.Problems, fsck()...)
+	return info, nil
+}
+
+func printReplay(info replayInfo) {
+	for _, v := range info.Mismatches {
+		fmt.Println("Mismatch :", v)
+	}
+	for _, v := range info.Problems {
+		fmt.Println("Fsck :", v)
+	}
+	fmt.Printf("Replayed %d operations, %d mismatches, %d fsck problems\n", info.Ops, len(info.Mismatches), len(info.Problems))
+}
+
+//Shell front-end: trace start <file> | trace stop
+func traceCommand(args []string) {
+	var err error
+	switch args[0] {
+	case "start":
+		if len(args) < 2 {
+			fmt.Println("Usage:", shellCommands["trace"].usage)
+			return
+		}
+		mountIfNeeded()
+		if err = startTrace(args[1]); err == nil {
+			fmt.Println("Tracing to", args[1])
+		}
+	case "stop":
+		err = stopTrace()
+	default:
+		fmt.Println("Usage:", shellCommands["trace"].usage)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
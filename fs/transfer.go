@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//-------------------------Import/Export---------------------------
+//Copies trees between host and image, keeping names, permissions,
+//modification times, extended attributes, symlinks and (in tar) hard links
+
+//Copies contents of host folder into image folder
+func importDir(hostDir, imagePath string) {
+	mountIfNeeded()
+	iid, inode, err := lookupPath(imagePath)
+	if err == nil && inode.Mode != 1 {
+		err = errNotFolder
+	}
+	if err != nil {
+		log.Println(imagePath, err)
+		return
+	}
+	count := importHostTree(hostDir, iid)
+	fmt.Printf("Imported %d entries from %s\n", count, hostDir)
+}
+
+//Copies contents of image folder into host folder
+func exportDir(imagePath, hostDir string) {
+	mountIfNeeded()
+	iid, inode, err := lookupPath(imagePath)
+	if err == nil && inode.Mode != 1 {
+		err = errNotFolder
+	}
+	if err != nil {
+		log.Println(imagePath, err)
+		return
+	}
+	if err := exportTree(iid, hostDir); err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("Exported %s to %s\n", imagePath, hostDir)
+}
+
+//Extracts tar archive into image folder
+func importTar(tarPath, imagePath string) {
+	mountIfNeeded()
+	iid, inode, err := lookupPath(imagePath)
+	if err == nil && inode.Mode != 1 {
+		err = errNotFolder
+	}
+	if err != nil {
+		log.Println(imagePath, err)
+		return
+	}
+	f, err := os.Open(tarPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	count, err := importTarStream(f, iid)
+	if err != nil {
+		log.Println(err)
+	}
+	fmt.Printf("Imported %d entries from %s\n", count, tarPath)
+}
+
+//Writes image folder as tar archive
+func exportTar(imagePath, tarPath string) {
+	mountIfNeeded()
+	iid, inode, err := lookupPath(imagePath)
+	if err == nil && inode.Mode != 1 {
+		err = errNotFolder
+	}
+	if err != nil {
+		log.Println(imagePath, err)
+		return
+	}
+	f, err := os.Create(tarPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	if err := exportTarStream(f, iid); err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("Exported %s to %s\n", imagePath, tarPath)
+}
+
+//Creates or replaces entry of folder dirID, folders are reused,
+//files and symlinks get data as their new contents
+func importEntry(dirID int64, name string, mode int8, perm uint32, mtime int64, data []byte) (int64, error) {
+	dir := readInode(dirID)
+	iid, ok := folderLookup(name, readFolder(inodeBids(dir)))
+	if ok {
+		if (readInode(iid).Mode == 1) != (mode == 1) {
+			return 0, errExists
+		}
+	} else {
+		if err := checkNewEntry(dir, name); err != nil {
+			return 0, err
+		}
+		var err error
+		if mode == 1 {
+			iid, err = mkdirIn(dir, dirID, name, curUid, curGid)
+		} else {
+			iid, err = createIn(dir, name, mode, curUid, curGid)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	inode := readInode(iid)
+	if mode != 1 {
+		var err error
+		inode.Mode = mode
+		inode, err = resizeFile(inode, 0, newCharge(inode))
+		if err != nil {
+			return 0, err
+		}
+		inode, err = writeFile(iid, inode, 0, data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	inode.Perm = perm & 07777
+	inode.Mtime = mtime
+	writeInode(iid, inode)
+	return iid, nil
+}
+
+//Sets attributes of imported entry, failing ones are logged and skipped
+func importXattrs(iid int64, name string, attrs []xattr) {
+	for _, a := range attrs {
+		if err := setXattr(iid, a.Name, a.Value, 0); err != nil {
+			log.Println(name, a.Name, err)
+		}
+	}
+}
+
+//Makes every folder of rel path below dirID, existing ones are reused
+func ensureFolder(dirID int64, rel string) (int64, error) {
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		dir := readInode(dirID)
+		iid, ok := folderLookup(name, readFolder(inodeBids(dir)))
+		if !ok {
+			if err := checkNewEntry(dir, name); err != nil {
+				return 0, err
+			}
+			var err error
+			if iid, err = mkdirIn(dir, dirID, name, curUid, curGid); err != nil {
+				return 0, err
+			}
+		} else if readInode(iid).Mode != 1 {
+			return 0, errNotFolder
+		}
+		dirID = iid
+	}
+	return dirID, nil
+}
+
+//Returns number of imported entries, failed ones are logged and skipped
+func importHostTree(hostDir string, dirID int64) int {
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		log.Println(err)
+		return 0
+	}
+	var count int
+	for _, e := range entries {
+		p := filepath.Join(hostDir, e.Name())
+		info, err := os.Lstat(p)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		perm := uint32(info.Mode().Perm())
+		mtime := info.ModTime().Unix()
+		switch {
+		case info.IsDir():
+			iid, err := importEntry(dirID, e.Name(), 1, perm, mtime, nil)
+			if err != nil {
+				log.Println(p, err)
+				continue
+			}
+			importXattrs(iid, p, hostXattrs(p))
+			count += 1 + importHostTree(p, iid)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err == nil {
+				_, err = importEntry(dirID, e.Name(), 2, perm, mtime, []byte(target))
+			}
+			if err != nil {
+				log.Println(p, err)
+				continue
+			}
+			count++
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(p)
+			var iid int64
+			if err == nil {
+				iid, err = importEntry(dirID, e.Name(), 0, perm, mtime, data)
+			}
+			if err != nil {
+				log.Println(p, err)
+				continue
+			}
+			importXattrs(iid, p, hostXattrs(p))
+			count++
+		default:
+			log.Println(p, "skipped, only files, folders and symlinks are supported")
+		}
+	}
+	return count
+}
+
+func exportTree(dirID int64, hostDir string) error {
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return err
+	}
+	dir := readInode(dirID)
+	folder := readFolder(inodeBids(dir))
+	for k, v := range folder.FileName {
+		name := entryName(v)
+		if v[0] == 0 || name == ".." {
+			continue
+		}
+		//Image written by other tools may hold names leaving hostDir
+		if err := checkName(name); err != nil {
+			return fmt.Errorf("%q: %w", name, err)
+		}
+		iid := folder.FileInodeID[k]
+		inode := readInode(iid)
+		p := filepath.Join(hostDir, name)
+		switch inode.Mode {
+		case 1:
+			if err := exportTree(iid, p); err != nil {
+				return err
+			}
+			continue
+		case 2:
+			os.Remove(p)
+			if err := os.Symlink(string(readFile(inode)), p); err != nil {
+				return err
+			}
+			if err := lchtimesInode(p, inode); err != nil {
+				return err
+			}
+			continue
+		default:
+			if err := os.WriteFile(p, readFile(inode), os.FileMode(inodePerm(inode))); err != nil {
+				return err
+			}
+			//Attributes before permissions, read only file refuses them
+			setHostXattrs(p, readXattrs(inode))
+			if err := os.Chmod(p, os.FileMode(inodePerm(inode))); err != nil {
+				return err
+			}
+		}
+		if err := chtimesInode(p, inode); err != nil {
+			return err
+		}
+	}
+	setHostXattrs(hostDir, readXattrs(dir))
+	//Folder permissions last, read only folder could not be filled
+	if err := os.Chmod(hostDir, os.FileMode(inodePerm(dir))); err != nil {
+		return err
+	}
+	return chtimesInode(hostDir, dir)
+}
+
+func chtimesInode(p string, i Inode) error {
+	if i.Mtime == 0 {
+		return nil
+	}
+	t := time.Unix(i.Mtime, 0)
+	return os.Chtimes(p, t, t)
+}
+
+func importTarStream(r io.Reader, dirID int64) (int, error) {
+	tr := tar.NewReader(r)
+	var count int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		//Clean against root, so .. can not escape target folder
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		parent, base := path.Split(name)
+		pid, err := ensureFolder(dirID, parent)
+		if err != nil {
+			log.Println(hdr.Name, err)
+			continue
+		}
+		perm := uint32(hdr.Mode) & 07777
+		mtime := hdr.ModTime.Unix()
+		var iid int64
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			iid, err = importEntry(pid, base, 1, perm, mtime, nil)
+		case tar.TypeReg:
+			var data []byte
+			data, err = io.ReadAll(tr)
+			if err == nil {
+				iid, err = importEntry(pid, base, 0, perm, mtime, data)
+			}
+		case tar.TypeSymlink:
+			iid, err = importEntry(pid, base, 2, perm, mtime, []byte(hdr.Linkname))
+		case tar.TypeLink:
+			err = importHardLink(dirID, pid, base, hdr.Linkname)
+		default:
+			log.Println(hdr.Name, "skipped, unsupported tar entry type")
+			continue
+		}
+		if err != nil {
+			log.Println(hdr.Name, err)
+			continue
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			importXattrs(iid, hdr.Name, tarXattrs(hdr))
+		}
+		count++
+	}
+}
+
+//Attributes are kept in PAX records, as GNU tar and bsdtar do
+const tarXattrPrefix = "SCHILY.xattr."
+
+func tarXattrs(hdr *tar.Header) []xattr {
+	var attrs []xattr
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, tarXattrPrefix) {
+			attrs = append(attrs, xattr{strings.TrimPrefix(k, tarXattrPrefix), []byte(v)})
+		}
+	}
+	return attrs
+}
+
+//Adds name to folder pid pointing at inode of target (relative to archive root)
+func importHardLink(rootID, pid int64, name, target string) error {
+	tid, tinode, err := lookupPathFrom(rootID, path.Clean("/"+target))
+	if err != nil {
+		return err
+	}
+	if tinode.Mode == 1 {
+		return errIsFolder
+	}
+	dir := readInode(pid)
+	bids := inodeBids(dir)
+	folder := readFolder(bids)
+	if old, ok := folderLookup(name, folder); ok {
+		//Archive extracted again over its own links
+		if old == tid {
+			return nil
+		}
+		writeFolder(bids, removeFromFolder(name, folder))
+		dropLink(old)
+	}
+	return linkIn(dir, name, tid)
+}
+
+func exportTarStream(w io.Writer, dirID int64) error {
+	tw := tar.NewWriter(w)
+	if err := tarTree(tw, dirID, "", map[int64]string{}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+//Second name of same file inode is written as hard link to the first
+func tarTree(tw *tar.Writer, dirID int64, prefix string, seen map[int64]string) error {
+	folder := readFolder(inodeBids(readInode(dirID)))
+	for k, v := range folder.FileName {
+		name := entryName(v)
+		if v[0] == 0 || name == ".." {
+			continue
+		}
+		iid := folder.FileInodeID[k]
+		inode := readInode(iid)
+		hdr := &tar.Header{
+			Name:    prefix + name,
+			Mode:    int64(inodePerm(inode)),
+			ModTime: time.Unix(inode.Mtime, 0),
+		}
+		var data []byte
+		switch inode.Mode {
+		case 1:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case 2:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(readFile(inode))
+		default:
+			if first, ok := seen[iid]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+			} else {
+				seen[iid] = hdr.Name
+				hdr.Typeflag = tar.TypeReg
+				data = readFile(inode)
+				hdr.Size = int64(len(data))
+			}
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			for _, a := range readXattrs(inode) {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = map[string]string{}
+				}
+				hdr.PAXRecords[tarXattrPrefix+a.Name] = string(a.Value)
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		if inode.Mode == 1 {
+			if err := tarTree(tw, iid, hdr.Name, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+//-------------------------Extended attributes---------------------------
+//Attributes are list of (name, value) entries: name length (1 byte),
+//value length (2 bytes), name, value, zero name length ends list.
+//Small list lives in Inode.Xattrs, bigger one in block Inode.XattrBlock
+
+const xattrMagic = 'X' //First byte of xattr block, checked by fsck
+const xattrInlineSize = 96
+
+//Namespaces accepted in attribute names
+var xattrNamespaces = []string{"user.", "trusted.", "system."}
+
+//Flags of setxattr, same values as Linux
+const (
+	xattrCreate  = 0x1 //Fail if attribute exists
+	xattrReplace = 0x2 //Fail if attribute is missing
+)
+
+var (
+	errNoAttr       = errors.New("no such attribute")
+	errBadNamespace = errors.New("attribute name needs user., trusted. or system. prefix")
+	errAttrTooBig   = errors.New("attributes do not fit in xattr block")
+)
+
+type xattr struct {
+	Name  string
+	Value []byte
+}
+
+func checkXattrName(name string) error {
+	if len(name) > 255 {
+		return errNameTooLong
+	}
+	for _, ns := range xattrNamespaces {
+		if strings.HasPrefix(name, ns) && len(name) > len(ns) {
+			return nil
+		}
+	}
+	return errBadNamespace
+}
+
+func encodeXattrs(attrs []xattr) []byte {
+	var buf []byte
+	for _, a := range attrs {
+		buf = append(buf, uint8(len(a.Name)), 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(a.Value)))
+		buf = append(buf, a.Name...)
+		buf = append(buf, a.Value...)
+	}
+	return buf
+}
+
+func decodeXattrs(buf []byte) []xattr {
+	var res []xattr
+	for len(buf) >= 3 && buf[0] != 0 {
+		nl, vl := int(buf[0]), int(binary.BigEndian.Uint16(buf[1:]))
+		if 3+nl+vl > len(buf) {
+			break
+		}
+		res = append(res, xattr{string(buf[3 : 3+nl]), append([]byte{}, buf[3+nl:3+nl+vl]...)})
+		buf = buf[3+nl+vl:]
+	}
+	return res
+}
+
+//Attributes of inode sorted by name
+func readXattrs(i Inode) []xattr {
+	if i.XattrBlock == 0 {
+		return decodeXattrs(i.Xattrs[:])
+	}
+	block := readBlock(i.XattrBlock)
+	return decodeXattrs(block.Data[8:])
+}
+
+//Stores attributes inline or in xattr block, inode itself is not written.
+//Encrypted image keeps them in block only, inodes are not sealed
+func writeXattrs(i *Inode, attrs []xattr) error {
+	sort.Slice(attrs, func(a, b int) bool { return attrs[a].Name < attrs[b].Name })
+	buf := encodeXattrs(attrs)
+	if len(buf) > int(blockSize)-8 {
+		return errAttrTooBig
+	}
+	i.Xattrs = [xattrInlineSize]byte{}
+	if len(buf) <= len(i.Xattrs) && (SB.Features&featEncrypted == 0 || len(attrs) == 0) {
+		copy(i.Xattrs[:], buf)
+		if i.XattrBlock != 0 {
+			if blockRef(i.XattrBlock) == 0 {
+				storeBlock(i.XattrBlock, Block{}, false)
+			}
+			setBlockUsed(i.XattrBlock, false)
+		}
+		i.XattrBlock = 0
+		return nil
+	}
+	//Block shared with snapshot is copied
+	if i.XattrBlock == 0 || blockRef(i.XattrBlock) > 0 {
+		bid, err := allocBlock(newCharge(*i), 0)
+		if err != nil {
+			return err
+		}
+		i.XattrBlock = bid
+	}
+	block := Block{}
+	block.Data[0] = xattrMagic
+	copy(block.Data[8:], buf)
+	return storeBlock(i.XattrBlock, block, true)
+}
+
+func getXattr(i Inode, name string) ([]byte, error) {
+	for _, a := range readXattrs(i) {
+		if a.Name == name {
+			return a.Value, nil
+		}
+	}
+	return nil, errNoAttr
+}
+
+//Sets attribute of inode iid, flags are xattrCreate and xattrReplace
+func setXattr(iid int64, name string, value []byte, flags uint32) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+	i := readInode(iid)
+	attrs := readXattrs(i)
+	found := false
+	for k, a := range attrs {
+		if a.Name == name {
+			if flags&xattrCreate != 0 {
+				return errExists
+			}
+			attrs[k].Value = value
+			found = true
+		}
+	}
+	if !found {
+		if flags&xattrReplace != 0 {
+			return errNoAttr
+		}
+		attrs = append(attrs, xattr{name, value})
+	}
+	if err := writeXattrs(&i, attrs); err != nil {
+		return err
+	}
+	writeInode(iid, i)
+	return nil
+}
+
+func removeXattr(iid int64, name string) error {
+	i := readInode(iid)
+	attrs := readXattrs(i)
+	for k, a := range attrs {
+		if a.Name == name {
+			if err := writeXattrs(&i, append(attrs[:k], attrs[k+1:]...)); err != nil {
+				return err
+			}
+			writeInode(iid, i)
+			return nil
+		}
+	}
+	return errNoAttr
+}
+
+//Shell front-end: setxattr, getxattr, listxattr, removexattr
+func xattrCommand(op string, args []string) {
+	i, iid, err := getInodeByPath(args[0])
+	if err != nil {
+		log.Println(args[0], err)
+		return
+	}
+	switch op {
+	case "set":
+		err = setXattr(iid, args[1], []byte(strings.Join(args[2:], " ")), 0)
+	case "get":
+		var v []byte
+		if v, err = getXattr(i, args[1]); err == nil {
+			fmt.Printf("%s=%q\n", args[1], v)
+		}
+	case "list":
+		for _, a := range readXattrs(i) {
+			fmt.Printf("%s=%q\n", a.Name, a.Value)
+		}
+	case "remove":
+		err = removeXattr(iid, args[1])
+	}
+	if err != nil {
+		log.Println(args[0], err)
+	}
+}